@@ -0,0 +1,119 @@
+package sshserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SSHPreambleLength is the size of the big endian length that precedes the preamble, and
+// its acknowledgment.
+const SSHPreambleLength = 2
+
+// SSHPreambleVersion is the preamble format written by WriteSSHPreamble, which starts the
+// preamble with a version byte so that later formats can be told apart.
+const SSHPreambleVersion = 1
+
+// sshPreambleVersionBase is added to the version to make the version byte. Unversioned
+// preambles start with the high byte of their length, which only reaches this for payloads
+// of 60KiB or more, far larger than a destination and JWT.
+const sshPreambleVersionBase = 0xf0
+
+// SSHPreamble is sent by the client before any SSH traffic, with the user's JWT and the
+// ultimate destination.
+type SSHPreamble struct {
+	Destination string
+	JWT         string
+	// WantAck asks the SSH proxy to reply with an SSHPreambleAck before any SSH traffic.
+	// Clients that don't set it get no reply, as before acknowledgments existed.
+	WantAck bool `json:",omitempty"`
+}
+
+// SSHPreambleAck tells a client that asked for it whether the SSH proxy accepted its
+// preamble. If it was rejected, the proxy closes the connection after sending it.
+type SSHPreambleAck struct {
+	Accepted bool
+	// Reason explains why the preamble was rejected.
+	Reason string `json:",omitempty"`
+}
+
+// ReadSSHPreamble reads a length prefixed, JSON encoded preamble from r. It is the counterpart
+// of websocket.SendSSHPreamble. The length prefix bounds the payload to 64KiB. Preambles
+// that start with a version byte, as written by WriteSSHPreamble, are also accepted, and
+// versions other than SSHPreambleVersion are an error.
+func ReadSSHPreamble(r io.Reader) (*SSHPreamble, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return nil, err
+	}
+	if first[0] < sshPreambleVersionBase {
+		// The first byte is the start of an unversioned preamble's length
+		r = io.MultiReader(bytes.NewReader(first), r)
+	} else if version := int(first[0] - sshPreambleVersionBase); version != SSHPreambleVersion {
+		return nil, fmt.Errorf("unsupported ssh preamble version %d, expected version %d", version, SSHPreambleVersion)
+	}
+
+	var preamble SSHPreamble
+	if err := readFramedJSON(r, &preamble); err != nil {
+		return nil, err
+	}
+	return &preamble, nil
+}
+
+// WriteSSHPreamble writes preamble to w, preceded by the SSHPreambleVersion version byte,
+// in a single write. Only SSH proxies that read preambles with ReadSSHPreamble accept it.
+func WriteSSHPreamble(w io.Writer, preamble SSHPreamble) error {
+	var buf bytes.Buffer
+	buf.WriteByte(sshPreambleVersionBase + SSHPreambleVersion)
+	if err := writeFramedJSON(&buf, preamble); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteSSHPreambleAck writes ack to w, framed like the preamble.
+func WriteSSHPreambleAck(w io.Writer, ack SSHPreambleAck) error {
+	return writeFramedJSON(w, ack)
+}
+
+// ReadSSHPreambleAck reads the acknowledgment of a preamble sent with WantAck from r.
+func ReadSSHPreambleAck(r io.Reader) (*SSHPreambleAck, error) {
+	var ack SSHPreambleAck
+	if err := readFramedJSON(r, &ack); err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+// readFramedJSON reads a JSON payload preceded by its length into v.
+func readFramedJSON(r io.Reader, v interface{}) error {
+	size := make([]byte, SSHPreambleLength)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return err
+	}
+	payloadLength := binary.BigEndian.Uint16(size)
+	payload := make([]byte, payloadLength)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// writeFramedJSON writes v as JSON preceded by its length, in a single write.
+func writeFramedJSON(w io.Writer, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(payload) > int(^uint16(0)) {
+		return errors.New("ssh preamble payload too large")
+	}
+	frame := make([]byte, SSHPreambleLength, SSHPreambleLength+len(payload))
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	_, err = w.Write(append(frame, payload...))
+	return err
+}
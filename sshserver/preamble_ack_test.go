@@ -0,0 +1,65 @@
+package sshserver
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHPreambleAckRoundTrip(t *testing.T) {
+	tests := []SSHPreambleAck{
+		{Accepted: true},
+		{Accepted: false, Reason: "invalid destination"},
+	}
+
+	for _, ack := range tests {
+		var buf bytes.Buffer
+		require.NoError(t, WriteSSHPreambleAck(&buf, ack))
+		received, err := ReadSSHPreambleAck(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, ack, *received)
+		assert.Equal(t, 0, buf.Len())
+	}
+}
+
+func TestSSHPreambleWantAck(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeFramedJSON(&buf, SSHPreamble{Destination: "localhost:22", JWT: "jwt"}))
+	assert.NotContains(t, buf.String(), "WantAck")
+	preamble, err := ReadSSHPreamble(&buf)
+	require.NoError(t, err)
+	assert.False(t, preamble.WantAck)
+
+	require.NoError(t, writeFramedJSON(&buf, SSHPreamble{Destination: "localhost:22", WantAck: true}))
+	preamble, err = ReadSSHPreamble(&buf)
+	require.NoError(t, err)
+	assert.True(t, preamble.WantAck)
+}
+
+func TestSSHPreambleVersion(t *testing.T) {
+	expected := SSHPreamble{Destination: "localhost:22", JWT: "jwt"}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteSSHPreamble(&buf, expected))
+	assert.Equal(t, byte(sshPreambleVersionBase+SSHPreambleVersion), buf.Bytes()[0])
+	preamble, err := ReadSSHPreamble(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, expected, *preamble)
+	assert.Equal(t, 0, buf.Len())
+
+	// Unversioned preambles are still accepted
+	require.NoError(t, writeFramedJSON(&buf, expected))
+	preamble, err = ReadSSHPreamble(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, expected, *preamble)
+
+	// A version this reader doesn't know is refused
+	buf.Reset()
+	buf.WriteByte(sshPreambleVersionBase + SSHPreambleVersion + 1)
+	require.NoError(t, writeFramedJSON(&buf, expected))
+	_, err = ReadSSHPreamble(&buf)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported ssh preamble version 2")
+}
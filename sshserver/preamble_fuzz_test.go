@@ -0,0 +1,63 @@
+//go:build go1.18
+// +build go1.18
+
+package sshserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+// preambleFrame returns payload with its length prefix.
+func preambleFrame(length uint16, payload []byte) []byte {
+	frame := make([]byte, SSHPreambleLength, SSHPreambleLength+len(payload))
+	binary.BigEndian.PutUint16(frame, length)
+	return append(frame, payload...)
+}
+
+func FuzzReadSSHPreamble(f *testing.F) {
+	valid, _ := json.Marshal(SSHPreamble{Destination: "ssh.example.com:22", JWT: "token"})
+	seeds := [][]byte{
+		preambleFrame(uint16(len(valid)), valid),
+		preambleFrame(2, []byte("{}")),
+		preambleFrame(0, nil),
+		{},
+		{0x00},
+		preambleFrame(uint16(len(valid)), valid[:len(valid)/2]),
+		preambleFrame(^uint16(0), valid),
+		preambleFrame(5, []byte("{\"Des")),
+		preambleFrame(4, []byte("null")),
+		preambleFrame(7, []byte("[1,2,3]")),
+		preambleFrame(uint16(len(valid)-1), valid),
+		append([]byte{sshPreambleVersionBase + SSHPreambleVersion}, preambleFrame(uint16(len(valid)), valid)...),
+		append([]byte{0xff}, preambleFrame(uint16(len(valid)), valid)...),
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		preamble, err := ReadSSHPreamble(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if preamble == nil {
+			t.Fatal("no preamble and no error")
+		}
+		// Versioned preambles have their length after the version byte
+		if data[0] >= sshPreambleVersionBase {
+			data = data[1:]
+		}
+		// A preamble is only decoded from a complete payload, so it can't be larger than the
+		// input
+		length := int(binary.BigEndian.Uint16(data))
+		if length+SSHPreambleLength > len(data) {
+			t.Fatalf("decoded a %d byte payload from %d bytes", length, len(data))
+		}
+		if len(preamble.Destination)+len(preamble.JWT) > length {
+			t.Fatalf("decoded %d bytes of fields from a %d byte payload", len(preamble.Destination)+len(preamble.JWT), length)
+		}
+	})
+}
@@ -6,7 +6,6 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -35,7 +34,6 @@ const (
 	sshContextEventLogger = "eventLogger"
 	sshContextPreamble    = "sshPreamble"
 	sshContextSSHClient   = "sshClient"
-	SSHPreambleLength     = 2
 	defaultSSHPort        = "22"
 )
 
@@ -72,11 +70,6 @@ type SSHProxy struct {
 	logManager sshlog.Manager
 }
 
-type SSHPreamble struct {
-	Destination string
-	JWT         string
-}
-
 // New creates a new SSHProxy and configures its host keys and authentication by the data provided
 func New(logManager sshlog.Manager, logger logger.Service, version, localAddress, hostname, hostKeyDir string, shutdownC chan struct{}, idleTimeout, maxTimeout time.Duration) (*SSHProxy, error) {
 	sshProxy := SSHProxy{
@@ -152,8 +145,10 @@ func (s *SSHProxy) connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
 	logger, sessionID, err := s.auditLogger()
 	if err != nil {
 		s.logger.Errorf("failed to configure logger: %s", err)
+		s.acknowledgePreamble(conn, preamble, errors.New("internal error"))
 		return nil
 	}
+	s.acknowledgePreamble(conn, preamble, nil)
 	ctx.SetValue(sshContextEventLogger, logger)
 	ctx.SetValue(sshContextSessionID, sessionID)
 
@@ -282,27 +277,32 @@ func (s *SSHProxy) readPreamble(conn net.Conn) (*SSHPreamble, error) {
 		}
 	}()
 
-	size := make([]byte, SSHPreambleLength)
-	if _, err := io.ReadFull(conn, size); err != nil {
-		return nil, err
-	}
-	payloadLength := binary.BigEndian.Uint16(size)
-	payload := make([]byte, payloadLength)
-	if _, err := io.ReadFull(conn, payload); err != nil {
+	preamble, err := ReadSSHPreamble(conn)
+	if err != nil {
 		return nil, err
 	}
 
-	var preamble SSHPreamble
-	err := json.Unmarshal(payload, &preamble)
+	preamble.Destination, err = canonicalizeDest(preamble.Destination)
 	if err != nil {
+		s.acknowledgePreamble(conn, preamble, err)
 		return nil, err
 	}
+	return preamble, nil
+}
 
-	preamble.Destination, err = canonicalizeDest(preamble.Destination)
+// acknowledgePreamble tells the client whether its preamble was accepted, if it asked to be told.
+// A non-nil err rejects the preamble with err as the reason.
+func (s *SSHProxy) acknowledgePreamble(conn net.Conn, preamble *SSHPreamble, err error) {
+	if !preamble.WantAck {
+		return
+	}
+	ack := SSHPreambleAck{Accepted: err == nil}
 	if err != nil {
-		return nil, err
+		ack.Reason = err.Error()
+	}
+	if err := WriteSSHPreambleAck(conn, ack); err != nil {
+		s.logger.Errorf("Failed to acknowledge SSH preamble: %s", err)
 	}
-	return &preamble, nil
 }
 
 // canonicalizeDest adds a default port if one doesnt exist
@@ -11,15 +11,8 @@ import (
 	"github.com/cloudflare/cloudflared/sshlog"
 )
 
-const SSHPreambleLength = 2
-
 type SSHServer struct{}
 
-type SSHPreamble struct {
-	Destination string
-	JWT         string
-}
-
 func New(_ sshlog.Manager, _ logger.Service, _, _, _, _ string, _ chan struct{}, _, _ time.Duration) (*SSHServer, error) {
 	return nil, errors.New("cloudflared ssh server is not supported on windows")
 }
@@ -0,0 +1,37 @@
+package websocket
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+	"github.com/gorilla/websocket"
+)
+
+// accessServiceTokenDialler adds Cloudflare Access service token headers to each handshake.
+type accessServiceTokenDialler struct {
+	inner        Dialler
+	clientID     string
+	clientSecret string
+}
+
+// NewAccessServiceTokenDialler returns a Dialler that authenticates each handshake to an
+// origin behind Cloudflare Access with a service token, by adding the CF-Access-Client-Id
+// and CF-Access-Client-Secret headers. The connection is made by inner, or the default
+// dialler if inner is nil.
+func NewAccessServiceTokenDialler(inner Dialler, clientID, clientSecret string) Dialler {
+	if inner == nil {
+		inner = new(defaultDialler)
+	}
+	return &accessServiceTokenDialler{inner: inner, clientID: clientID, clientSecret: clientSecret}
+}
+
+func (d *accessServiceTokenDialler) Dial(url *url.URL, header http.Header) (*websocket.Conn, *http.Response, error) {
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set(h2mux.CFAccessClientIDHeader, d.clientID)
+	header.Set(h2mux.CFAccessClientSecretHeader, d.clientSecret)
+	return d.inner.Dial(url, header)
+}
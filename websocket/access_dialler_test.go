@@ -0,0 +1,37 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessServiceTokenDialler(t *testing.T) {
+	headersC := make(chan http.Header, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headersC <- r.Header
+		upgrader := gws.Upgrader{}
+		if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+			conn.Close()
+		}
+	}))
+	defer origin.Close()
+
+	req := testRequest(t, origin.URL, nil)
+	req.Header.Set("CF-Access-Client-Id", "spoofed")
+	dialler := NewAccessServiceTokenDialler(nil, "client-id.access", "s3cr3t+/=")
+	conn, _, err := ClientConnect(req, dialler)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+
+	headers := <-headersC
+	assert.Equal(t, []string{"client-id.access"}, headers.Values("CF-Access-Client-Id"))
+	assert.Equal(t, []string{"s3cr3t+/="}, headers.Values("CF-Access-Client-Secret"))
+	// The caller's request is left alone
+	assert.Equal(t, "spoofed", req.Header.Get("CF-Access-Client-Id"))
+}
@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+)
+
+// backendTimeoutReason is sent in the close frame when the backend timed out.
+const backendTimeoutReason = "backend timeout"
+
+// Why connections end, as counted by the connections_closed_total metric.
+const (
+	closeReasonNormal         = "normal"
+	closeReasonBackendError   = "backend_error"
+	closeReasonTimeout        = "timeout"
+	closeReasonIdle           = "idle"
+	closeReasonSessionExpired = "session_expired"
+)
+
+// backendErrorConn remembers the first error reading from or writing to the backend, so the
+// client can be told why the backend went away.
+type backendErrorConn struct {
+	net.Conn
+	lock sync.Mutex
+	err  error
+}
+
+func (c *backendErrorConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.record(err)
+	return n, err
+}
+
+func (c *backendErrorConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.record(err)
+	return n, err
+}
+
+func (c *backendErrorConn) record(err error) {
+	if err == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// normalClosure is the close code and reason for a connection that ended normally.
+func normalClosure() (int, string) {
+	return websocket.CloseNormalClosure, ""
+}
+
+// closeMessage returns the close code and reason to send the client for the way the backend
+// went away: 1000 if it closed cleanly, or 1011 with a reason describing its failure.
+func (c *backendErrorConn) closeMessage() (int, string) {
+	c.lock.Lock()
+	err := c.err
+	c.lock.Unlock()
+
+	var netErr net.Error
+	switch {
+	case err == nil || err == io.EOF:
+		return websocket.CloseNormalClosure, ""
+	case errors.Is(err, errInitialBackendPayload):
+		return websocket.CloseInternalServerErr, "backend initial payload failed"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return websocket.CloseInternalServerErr, backendTimeoutReason
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return websocket.CloseInternalServerErr, "backend connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return websocket.CloseInternalServerErr, "backend connection reset"
+	default:
+		return websocket.CloseInternalServerErr, "backend error"
+	}
+}
+
+// closeReason returns why a connection ended, given the close code and reason sent to the
+// client. The client going idle and the session expiring take precedence, since the backend
+// is closed because of them.
+func closeReason(keepAlive *keepAlive, sessionExpired bool, closeMessage func() (int, string)) string {
+	if keepAlive.idle() {
+		return closeReasonIdle
+	}
+	if sessionExpired {
+		return closeReasonSessionExpired
+	}
+	switch code, reason := closeMessage(); {
+	case code == websocket.CloseNormalClosure:
+		return closeReasonNormal
+	case reason == backendTimeoutReason:
+		return closeReasonTimeout
+	default:
+		return closeReasonBackendError
+	}
+}
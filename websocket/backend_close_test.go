@@ -0,0 +1,113 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acceptOnce starts a TCP server that passes its first connection to handle.
+func acceptOnce(t *testing.T, handle func(conn *net.TCPConn)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			handle(conn.(*net.TCPConn))
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func TestBackendCloseCodes(t *testing.T) {
+	closed := acceptOnce(t, func(conn *net.TCPConn) {
+		io.WriteString(conn, "bye")
+		conn.Close()
+	})
+	reset := acceptOnce(t, func(conn *net.TCPConn) {
+		io.WriteString(conn, "bye")
+		// Send a RST rather than a FIN
+		conn.SetLinger(0)
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+	})
+	silent := acceptOnce(t, func(conn *net.TCPConn) {
+		io.Copy(ioutil.Discard, conn)
+	})
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused.Close()
+
+	tests := []struct {
+		name    string
+		backend string
+		options ProxyOptions
+		code    int
+		reason  string
+	}{
+		{name: "clean close", backend: closed.Addr().String(), code: gws.CloseNormalClosure},
+		{name: "reset", backend: reset.Addr().String(), code: gws.CloseInternalServerErr, reason: "backend connection reset"},
+		{name: "refused", backend: refused.Addr().String(), options: ProxyOptions{LazyBackendDial: true}, code: gws.CloseInternalServerErr, reason: "backend connection refused"},
+		{
+			name:    "timeout",
+			backend: silent.Addr().String(),
+			options: ProxyOptions{DialBackend: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := new(net.Dialer).DialContext(ctx, network, address)
+				if err == nil {
+					conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				}
+				return conn, err
+			}},
+			code:   gws.CloseInternalServerErr,
+			reason: "backend timeout",
+		},
+		{
+			name:    "initial payload",
+			backend: closed.Addr().String(),
+			options: ProxyOptions{
+				LazyBackendDial:       true,
+				InitialBackendPayload: []byte("preamble"),
+				DialBackend: func(context.Context, string, string) (net.Conn, error) {
+					client, backend := net.Pipe()
+					backend.Close()
+					return client, nil
+				},
+			},
+			code:   gws.CloseInternalServerErr,
+			reason: "backend initial payload failed",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := test.options
+			options.CloseGracePeriod = 10 * time.Millisecond
+			addr := startTestProxy(t, test.backend, DefaultStreamHandler, options)
+			conn := dialTestProxy(t, addr, nil)
+			if test.options.LazyBackendDial {
+				// Make the proxy dial the backend
+				require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("hello")))
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				_, _, err := conn.ReadMessage()
+				if err == nil {
+					continue
+				}
+				closeErr, ok := err.(*gws.CloseError)
+				require.True(t, ok, "expected a close frame, got %v", err)
+				assert.Equal(t, test.code, closeErr.Code)
+				assert.Equal(t, test.reason, closeErr.Text)
+				return
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package websocket
+
+import (
+	"net"
+)
+
+// configureBackendConn applies the socket options to a newly dialed backend connection.
+// Options that only apply to TCP are skipped for other kinds of connection.
+func (h *handler) configureBackendConn(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	// Small writes are common for interactive protocols such as SSH, so don't delay them
+	// unless asked to.
+	if err := tcpConn.SetNoDelay(!h.options.DisableBackendNoDelay); err != nil {
+		h.logger.Debugf("Failed to set TCP_NODELAY on backend connection: %s", err)
+	}
+	if h.options.BackendReadBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(h.options.BackendReadBuffer); err != nil {
+			h.logger.Debugf("Failed to set the read buffer size of backend connection: %s", err)
+		}
+	}
+	if h.options.BackendWriteBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(h.options.BackendWriteBuffer); err != nil {
+			h.logger.Debugf("Failed to set the write buffer size of backend connection: %s", err)
+		}
+	}
+	if h.options.BackendUserTimeout > 0 {
+		if err := setUserTimeout(tcpConn, h.options.BackendUserTimeout); err != nil {
+			h.logger.Debugf("Failed to set TCP_USER_TIMEOUT on backend connection: %s", err)
+		}
+	}
+}
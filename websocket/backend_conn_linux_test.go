@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflared/logger"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// tcpSockopt reads an IPPROTO_TCP level socket option from conn.
+func tcpSockopt(t *testing.T, conn net.Conn, opt int) int {
+	return sockopt(t, conn, syscall.IPPROTO_TCP, opt)
+}
+
+// sockopt reads a socket option at the given level from conn.
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	assert.NoError(t, err)
+	var value int
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		value, sockoptErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, sockoptErr)
+	return value
+}
+
+// dialTestBackend dials the echo backend through a handler with the given options, using a
+// fake dialer that hands out plain TCP connections.
+func dialTestBackend(t *testing.T, options ProxyOptions) net.Conn {
+	backend := echoBackend(t)
+	t.Cleanup(func() { backend.Close() })
+
+	options.DialBackend = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*net.TCPConn), nil
+	}
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	h := newHandler(logger, backend.Addr().String(), DefaultStreamHandler, options)
+	conn, err := h.dialBackend(context.Background(), h.logger, backend.Addr().String())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestBackendNoDelay(t *testing.T) {
+	conn := dialTestBackend(t, ProxyOptions{})
+	assert.Equal(t, 1, tcpSockopt(t, conn, syscall.TCP_NODELAY))
+
+	conn = dialTestBackend(t, ProxyOptions{DisableBackendNoDelay: true})
+	assert.Equal(t, 0, tcpSockopt(t, conn, syscall.TCP_NODELAY))
+}
+
+func TestBackendBufferSizes(t *testing.T) {
+	// Small enough to be below the default sizes and the system maximums
+	const size = 16 * 1024
+	conn := dialTestBackend(t, ProxyOptions{})
+	assert.NotEqual(t, 2*size, sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF))
+
+	conn = dialTestBackend(t, ProxyOptions{BackendReadBuffer: size, BackendWriteBuffer: size})
+	// Linux doubles the requested size to allow for bookkeeping overhead
+	assert.Equal(t, 2*size, sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF))
+	assert.Equal(t, 2*size, sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF))
+}
+
+func TestBackendUserTimeout(t *testing.T) {
+	conn := dialTestBackend(t, ProxyOptions{})
+	assert.Equal(t, 0, tcpSockopt(t, conn, unix.TCP_USER_TIMEOUT))
+
+	conn = dialTestBackend(t, ProxyOptions{BackendUserTimeout: 5 * time.Second})
+	assert.Equal(t, 5000, tcpSockopt(t, conn, unix.TCP_USER_TIMEOUT))
+}
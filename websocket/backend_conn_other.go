@@ -0,0 +1,13 @@
+// +build !linux
+
+package websocket
+
+import (
+	"net"
+	"time"
+)
+
+// setUserTimeout does nothing, because TCP_USER_TIMEOUT is only supported on Linux.
+func setUserTimeout(*net.TCPConn, time.Duration) error {
+	return nil
+}
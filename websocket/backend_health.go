@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultUnhealthyThreshold  = 3
+)
+
+// BackendHealthCheck configures probing backends so that requests are refused up front while
+// none of them are healthy, instead of each one failing to dial.
+type BackendHealthCheck struct {
+	// Backends are the addresses to probe. Defaults to the static host. Without either, no
+	// backends are probed and requests are never refused.
+	Backends []string
+	// Interval is the time between probes of each backend. Defaults to
+	// defaultHealthCheckInterval.
+	Interval time.Duration
+	// UnhealthyThreshold is the number of consecutive failed probes after which a backend
+	// is unhealthy. One successful probe makes it healthy again. Defaults to
+	// defaultUnhealthyThreshold.
+	UnhealthyThreshold int
+}
+
+// backendHealthChecker probes backends by dialing them. Backends are healthy until proven
+// otherwise. A nil *backendHealthChecker is always healthy.
+type backendHealthChecker struct {
+	backends  []string
+	interval  time.Duration
+	threshold int
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	network   string
+	timeout   time.Duration
+
+	lock     sync.Mutex
+	failures map[string]int
+}
+
+func newBackendHealthChecker(config BackendHealthCheck, staticHost string, dial func(ctx context.Context, network, address string) (net.Conn, error), network string, timeout time.Duration) *backendHealthChecker {
+	backends := config.Backends
+	if len(backends) == 0 && staticHost != "" {
+		backends = []string{staticHost}
+	}
+	if len(backends) == 0 {
+		return nil
+	}
+	c := &backendHealthChecker{
+		backends:  backends,
+		interval:  config.Interval,
+		threshold: config.UnhealthyThreshold,
+		dial:      dial,
+		network:   network,
+		timeout:   timeout,
+		failures:  make(map[string]int),
+	}
+	if c.interval <= 0 {
+		c.interval = defaultHealthCheckInterval
+	}
+	if c.threshold <= 0 {
+		c.threshold = defaultUnhealthyThreshold
+	}
+	return c
+}
+
+// start probes the backends every interval until shutdownC is closed.
+func (c *backendHealthChecker) start(logger logger.Service, shutdownC <-chan struct{}) {
+	if c == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			for _, backend := range c.backends {
+				c.probe(logger, backend)
+			}
+			select {
+			case <-ticker.C:
+			case <-shutdownC:
+				return
+			}
+		}
+	}()
+}
+
+// probe dials backend, recording whether it succeeded.
+func (c *backendHealthChecker) probe(logger logger.Service, backend string) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	conn, err := c.dial(ctx, c.network, backend)
+	if err == nil {
+		conn.Close()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	wasHealthy := c.failures[backend] < c.threshold
+	if err == nil {
+		if !wasHealthy {
+			logger.Infof("Backend %s is healthy again", backend)
+		}
+		c.failures[backend] = 0
+		return
+	}
+	c.failures[backend]++
+	if wasHealthy && c.failures[backend] >= c.threshold {
+		logger.Errorf("Backend %s is unhealthy after %d failed probes: %s", backend, c.failures[backend], err)
+	}
+}
+
+// healthy reports whether any backend is healthy.
+func (c *backendHealthChecker) healthy() bool {
+	if c == nil {
+		return true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, backend := range c.backends {
+		if c.failures[backend] < c.threshold {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendHealthCheck(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	var down int32
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+		DialBackend: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if atomic.LoadInt32(&down) == 1 {
+				return nil, errors.New("connection refused")
+			}
+			return new(net.Dialer).DialContext(ctx, network, address)
+		},
+		BackendHealthCheck: &BackendHealthCheck{Interval: 10 * time.Millisecond, UnhealthyThreshold: 2},
+		CloseGracePeriod:   10 * time.Millisecond,
+	})
+	upgradeStatus := func() int {
+		conn, resp, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), nil)
+		if err == nil {
+			conn.Close()
+		}
+		if resp == nil {
+			return 0
+		}
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusSwitchingProtocols, upgradeStatus())
+
+	atomic.StoreInt32(&down, 1)
+	assert.Eventually(t, func() bool { return upgradeStatus() == http.StatusServiceUnavailable }, 5*time.Second, 10*time.Millisecond)
+
+	atomic.StoreInt32(&down, 0)
+	assert.Eventually(t, func() bool { return upgradeStatus() == http.StatusSwitchingProtocols }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBackendHealthCheckThreshold(t *testing.T) {
+	var failing int32 = 1
+	checker := newBackendHealthChecker(BackendHealthCheck{Backends: []string{"a:1", "b:1"}, UnhealthyThreshold: 2}, "", func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "a:1" || atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}, "tcp", time.Second)
+	log := &testLogger{}
+
+	// One backend failing is fine, and a backend is only unhealthy once the threshold is reached
+	checker.probe(log, "a:1")
+	checker.probe(log, "a:1")
+	checker.probe(log, "b:1")
+	assert.True(t, checker.healthy())
+	checker.probe(log, "b:1")
+	assert.False(t, checker.healthy())
+
+	atomic.StoreInt32(&failing, 0)
+	checker.probe(log, "b:1")
+	assert.True(t, checker.healthy())
+
+	// Without any backends, nothing is checked
+	assert.Nil(t, newBackendHealthChecker(BackendHealthCheck{}, "", nil, "tcp", time.Second))
+	assert.True(t, (*backendHealthChecker)(nil).healthy())
+}
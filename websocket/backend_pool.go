@@ -0,0 +1,166 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+// defaultBackendPoolIdleTTL is how long pooled backend connections are kept by default.
+const defaultBackendPoolIdleTTL = 30 * time.Second
+
+// BackendPool configures a pool of connections to the static host that are dialed ahead of
+// clients, so clients don't wait for the backend to be dialed, see ProxyOptions.BackendPool.
+type BackendPool struct {
+	// MaxIdle is how many idle connections the pool keeps dialed. It must be positive.
+	MaxIdle int
+	// IdleTTL closes connections that have been idle in the pool for this long, and dials
+	// fresh ones in their place, so that backends that time out idle connections don't
+	// leave the pool holding stale sockets. Defaults to 30 seconds.
+	IdleTTL time.Duration
+}
+
+// backendPool keeps idle connections to the static host. A nil pool is always empty.
+type backendPool struct {
+	maxIdle int
+	idleTTL time.Duration
+	dial    func() (net.Conn, error)
+
+	lock sync.Mutex
+	// idle are the pooled connections, oldest first
+	idle []pooledConn
+	// dialing counts the connections being dialed for the pool
+	dialing int
+	closed  bool
+}
+
+type pooledConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// newBackendPool returns a pool for the static host of h, which must have its options'
+// defaults set.
+func (h *handler) newBackendPool(config BackendPool) *backendPool {
+	idleTTL := config.IdleTTL
+	if idleTTL <= 0 {
+		idleTTL = defaultBackendPoolIdleTTL
+	}
+	return &backendPool{
+		maxIdle: config.MaxIdle,
+		idleTTL: idleTTL,
+		dial: func() (net.Conn, error) {
+			return h.dialBackend(context.Background(), h.logger, h.staticHost)
+		},
+	}
+}
+
+// start fills the pool, then reaps and refills it every half IdleTTL until shutdownC is
+// closed, when the idle connections are closed.
+func (p *backendPool) start(log logger.Service, shutdownC <-chan struct{}) {
+	if p == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(p.idleTTL / 2)
+		defer ticker.Stop()
+		for {
+			p.fill(log)
+			select {
+			case <-ticker.C:
+				if reaped := p.reap(time.Now()); reaped > 0 {
+					log.Debugf("Closed %d pooled backend connections that were idle for %s", reaped, p.idleTTL)
+				}
+			case <-shutdownC:
+				p.close()
+				return
+			}
+		}
+	}()
+}
+
+// get checks out the most recently pooled connection, or returns nil if the pool is empty.
+// A replacement is dialed in the background. The connection belongs to the caller, so it
+// is never reaped.
+func (p *backendPool) get(log logger.Service) net.Conn {
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	if len(p.idle) == 0 {
+		p.lock.Unlock()
+		return nil
+	}
+	last := len(p.idle) - 1
+	conn := p.idle[last].conn
+	p.idle[last] = pooledConn{}
+	p.idle = p.idle[:last]
+	p.lock.Unlock()
+	go p.fill(log)
+	return conn
+}
+
+// fill dials connections until the pool, counting the connections being dialed, holds
+// MaxIdle. It gives up on the first dial that fails, leaving the rest for the next refill.
+func (p *backendPool) fill(log logger.Service) {
+	for {
+		p.lock.Lock()
+		if p.closed || len(p.idle)+p.dialing >= p.maxIdle {
+			p.lock.Unlock()
+			return
+		}
+		p.dialing++
+		p.lock.Unlock()
+
+		conn, err := p.dial()
+
+		p.lock.Lock()
+		p.dialing--
+		if err == nil && !p.closed {
+			p.idle = append(p.idle, pooledConn{conn: conn, since: time.Now()})
+			conn = nil
+		}
+		p.lock.Unlock()
+		if err != nil {
+			log.Debugf("Cannot dial a backend connection for the pool: %s", err)
+			return
+		}
+		if conn != nil {
+			// The pool was closed while dialing
+			conn.Close()
+			return
+		}
+	}
+}
+
+// reap closes the connections that have been idle since before now less IdleTTL, returning
+// how many it closed.
+func (p *backendPool) reap(now time.Time) int {
+	p.lock.Lock()
+	var expired []net.Conn
+	for len(p.idle) > 0 && now.Sub(p.idle[0].since) >= p.idleTTL {
+		expired = append(expired, p.idle[0].conn)
+		p.idle[0] = pooledConn{}
+		p.idle = p.idle[1:]
+	}
+	p.lock.Unlock()
+	for _, conn := range expired {
+		conn.Close()
+	}
+	return len(expired)
+}
+
+// close closes the idle connections and stops the pool being refilled.
+func (p *backendPool) close() {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.lock.Unlock()
+	for _, pooled := range idle {
+		pooled.conn.Close()
+	}
+}
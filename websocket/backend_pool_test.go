@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acceptingBackend returns a backend that hands each connection it accepts to the returned
+// channel.
+func acceptingBackend(t *testing.T) (net.Listener, <-chan net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		for {
+			select {
+			case conn := <-accepted:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return listener, accepted
+}
+
+// startTestPool starts the backend pool of a handler for staticHost with config.
+func startTestPool(t *testing.T, staticHost string, config BackendPool) *backendPool {
+	h := newHandler(&testLogger{}, staticHost, DefaultStreamHandler, ProxyOptions{BackendPool: &config})
+	shutdownC := make(chan struct{})
+	t.Cleanup(func() { close(shutdownC) })
+	h.backendPool.start(h.logger, shutdownC)
+	return h.backendPool
+}
+
+func nextAccepted(t *testing.T, accepted <-chan net.Conn) net.Conn {
+	select {
+	case conn := <-accepted:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pool didn't dial the backend")
+		return nil
+	}
+}
+
+func TestBackendPoolReapsIdle(t *testing.T) {
+	const idleTTL = 100 * time.Millisecond
+	backend, accepted := acceptingBackend(t)
+	startTestPool(t, backend.Addr().String(), BackendPool{MaxIdle: 1, IdleTTL: idleTTL})
+
+	pooled := nextAccepted(t, accepted)
+	start := time.Now()
+	pooled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := pooled.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, time.Since(start) >= idleTTL/2, "closed after %s", time.Since(start))
+
+	// A fresh connection replaces the one that was reaped
+	nextAccepted(t, accepted)
+}
+
+func TestBackendPoolCheckout(t *testing.T) {
+	const idleTTL = 100 * time.Millisecond
+	backend, accepted := acceptingBackend(t)
+	pool := startTestPool(t, backend.Addr().String(), BackendPool{MaxIdle: 1, IdleTTL: idleTTL})
+	pooled := nextAccepted(t, accepted)
+
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		conn = pool.get(&testLogger{})
+		return conn != nil
+	}, 5*time.Second, time.Millisecond)
+	defer conn.Close()
+	// A replacement is dialed straight away
+	nextAccepted(t, accepted)
+
+	// The checked out connection is the caller's, so it outlives the TTL
+	time.Sleep(3 * idleTTL)
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	pooled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, 5)
+	_, err = io.ReadFull(pooled, received)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(received))
+}
+
+func TestBackendPoolProxying(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	server, err := NewProxyServer(&testLogger{}, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{BackendPool: &BackendPool{MaxIdle: 1}})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go server.Serve(listener, shutdownC)
+	pooled := func() int {
+		server.handler.backendPool.lock.Lock()
+		defer server.handler.backendPool.lock.Unlock()
+		return len(server.handler.backendPool.idle)
+	}
+	require.Eventually(t, func() bool { return pooled() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	conn := dialTestProxy(t, listener.Addr().String(), nil)
+	require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("hello")))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(message))
+	require.Eventually(t, func() bool { return pooled() == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBackendPoolValidation(t *testing.T) {
+	_, err := NewProxyServer(&testLogger{}, "localhost:22", DefaultStreamHandler, ProxyOptions{BackendPool: &BackendPool{}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,166 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+const (
+	originalURIHeader    = "X-Original-URI"
+	originalMethodHeader = "X-Original-Method"
+)
+
+// backendDialler is a Dialler that connects to websocket backends using dial and the proxy's
+// write buffer pool.
+type backendDialler struct {
+	dial            func(ctx context.Context, address string) (net.Conn, error)
+	writeBufferPool websocket.BufferPool
+}
+
+// backendDialler returns a Dialler that dials with the proxy's backend dial function and
+// network, for upstream proxies.
+func (h *handler) backendDialler() *backendDialler {
+	dial := func(ctx context.Context, address string) (net.Conn, error) {
+		return h.options.DialBackend(ctx, h.options.DialNetwork, address)
+	}
+	return &backendDialler{dial: dial, writeBufferPool: h.options.WriteBufferPool}
+}
+
+// websocketBackendDialler returns a Dialler that dials websocket backends within the backend
+// dial timeout. The address comes from the backend's URL, so DestinationParser doesn't
+// apply.
+func (h *handler) websocketBackendDialler(log logger.Service) *backendDialler {
+	dial := func(ctx context.Context, address string) (net.Conn, error) {
+		return h.dialBackendAddress(ctx, log, address, h.options.DialNetwork, address)
+	}
+	return &backendDialler{dial: dial, writeBufferPool: h.options.WriteBufferPool}
+}
+
+func (d *backendDialler) Dial(url *url.URL, header http.Header) (*websocket.Conn, *http.Response, error) {
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+			return d.dial(ctx, address)
+		},
+		WriteBufferPool: d.writeBufferPool,
+	}
+	return dialer.Dial(url.String(), header)
+}
+
+// serveWebsocketBackend proxies the client's websocket to a websocket backend at destination.
+// Messages are forwarded with their original type, instead of as a stream of binary frames,
+// so that websocket applications can be proxied transparently. The stream handler is not used.
+func (h *handler) serveWebsocketBackend(w http.ResponseWriter, r *http.Request, destination string, tags map[string]string) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeNonWebSocketResponse(w)
+		return
+	}
+
+	backendReq := r.Clone(r.Context())
+	backendReq.URL = &url.URL{Scheme: "ws", Host: destination, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	if h.options.ForwardOriginalURI {
+		backendReq.Header.Set(originalURIHeader, r.URL.RequestURI())
+		backendReq.Header.Set(originalMethodHeader, r.Method)
+	}
+	h.setBackendUserAgent(backendReq.Header)
+	log := h.connectionLogger(tags)
+	backendConn, _, err := clientConnect(backendReq, h.websocketBackendDialler(log), ClientOptions{}, handshakeBackend)
+	if err != nil {
+		log.Errorf("Cannot connect to websocket backend: %s", err)
+		if errors.Is(err, errBackendDialTimeout) {
+			http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}
+		return
+	}
+	defer backendConn.Close()
+
+	// Agree to the same subprotocol as the backend, since the client and backend are
+	// really talking to each other.
+	responseHeader := h.responseHeader(r)
+	if subprotocol := backendConn.Subprotocol(); subprotocol != "" {
+		responseHeader.Set("Sec-Websocket-Protocol", subprotocol)
+	}
+	conn, handshakeDuration, err := h.upgrade(w, r, responseHeader)
+	if err != nil {
+		log.Errorf("failed to upgrade: %s", err)
+		return
+	}
+	h.configureCompression(log, conn, r)
+	logTLSParameters(log, r)
+	event := ConnectionEvent{ID: uuid.New().String(), RemoteAddr: r.RemoteAddr, Destination: destination, Tags: tags, HandshakeDuration: handshakeDuration, span: spanFromContext(r.Context())}
+	keepAlive := h.startKeepAlive(log, conn, event.ID)
+	stats := newConnStats()
+	h.connectionOpened(event, stats, conn)
+	sessionTimer := h.limitSession(log, conn, backendConn)
+	defer func() {
+		sessionExpired := sessionTimer != nil && !sessionTimer.Stop()
+		keepAlive.stop()
+		conn.Close()
+		backendConn.Close()
+		h.connectionClosed(event, stats, closeReason(keepAlive, sessionExpired, normalClosure))
+	}()
+
+	proxyDone := make(chan struct{}, 2)
+	go func() {
+		proxyMessages(backendConn, conn, h.readPolicy(), stats.addToBackend)
+		proxyDone <- struct{}{}
+	}()
+	go func() {
+		proxyMessages(conn, backendConn, readPolicy{}, stats.addToClient)
+		proxyDone <- struct{}{}
+	}()
+	<-proxyDone
+}
+
+// setBackendUserAgent sets the User-Agent of a handshake with a websocket backend or upstream
+// proxy, which carries the client's User-Agent unless UserAgent overrides or extends it.
+func (h *handler) setBackendUserAgent(header http.Header) {
+	if h.options.UserAgent == "" {
+		return
+	}
+	if clientUserAgent := header.Get("User-Agent"); h.options.AppendUserAgent && clientUserAgent != "" {
+		header.Set("User-Agent", clientUserAgent+" "+h.options.UserAgent)
+		return
+	}
+	header.Set("User-Agent", h.options.UserAgent)
+}
+
+// proxyMessages copies messages from src to dst, preserving their type, until either side
+// fails. If src is closed by its peer, the close code and reason are forwarded to dst.
+// Messages from src are read according to policy, see nextMessage.
+// The size of each message copied is passed to count.
+func proxyMessages(dst, src *websocket.Conn, policy readPolicy, count func(int64)) error {
+	for {
+		messageType, r, err := nextMessage(src, policy)
+		if err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code != websocket.CloseAbnormalClosure {
+				dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeErr.Code, closeErr.Text), time.Now().Add(writeWait))
+			}
+			return err
+		}
+		w, err := dst.NextWriter(messageType)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(w, r)
+		if err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		policy.observeMessage(n)
+		count(n)
+	}
+}
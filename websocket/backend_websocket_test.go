@@ -0,0 +1,185 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoWebsocketBackend starts a websocket server that echoes every message with its type.
+func echoWebsocketBackend(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := gws.Upgrader{Subprotocols: []string{"echo"}}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWebsocketBackendPreservesMessageType(t *testing.T) {
+	backend := echoWebsocketBackend(t)
+	addr := startTestProxy(t, strings.TrimPrefix(backend.URL, "http://"), nil, ProxyOptions{WebsocketBackend: true})
+
+	dialer := gws.Dialer{Subprotocols: []string{"echo"}}
+	conn, resp, err := dialer.Dial("ws://"+addr+"/", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, "echo", resp.Header.Get("Sec-Websocket-Protocol"))
+
+	for _, messageType := range []int{gws.TextMessage, gws.BinaryMessage} {
+		assert.NoError(t, conn.WriteMessage(messageType, []byte("hello")))
+		receivedType, message, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, messageType, receivedType)
+		assert.Equal(t, "hello", string(message))
+	}
+}
+
+func TestWebsocketBackendForwardsClose(t *testing.T) {
+	backend := echoWebsocketBackend(t)
+	addr := startTestProxy(t, strings.TrimPrefix(backend.URL, "http://"), nil, ProxyOptions{WebsocketBackend: true})
+
+	conn := dialTestProxy(t, addr, nil)
+	assert.NoError(t, conn.WriteMessage(gws.CloseMessage, gws.FormatCloseMessage(gws.CloseGoingAway, "bye")))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, gws.IsCloseError(err, gws.CloseGoingAway), "unexpected error: %v", err)
+}
+
+func TestWebsocketBackendForwardOriginalURI(t *testing.T) {
+	for _, forward := range []bool{false, true} {
+		headersC := make(chan http.Header, 1)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			headersC <- r.Header
+			upgrader := gws.Upgrader{}
+			if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+				conn.Close()
+			}
+		}))
+		options := ProxyOptions{WebsocketBackend: true, ForwardOriginalURI: forward}
+		addr := startTestProxy(t, strings.TrimPrefix(backend.URL, "http://"), nil, options)
+
+		conn, _, err := gws.DefaultDialer.Dial("ws://"+addr+"/chat/room?id=42", nil)
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+		headers := <-headersC
+		if forward {
+			assert.Equal(t, "/chat/room?id=42", headers.Get("X-Original-URI"))
+			assert.Equal(t, http.MethodGet, headers.Get("X-Original-Method"))
+		} else {
+			assert.Empty(t, headers.Get("X-Original-URI"))
+			assert.Empty(t, headers.Get("X-Original-Method"))
+		}
+		backend.Close()
+	}
+}
+
+func TestWebsocketBackendUserAgent(t *testing.T) {
+	tests := []struct {
+		name            string
+		options         ProxyOptions
+		clientUserAgent string
+		expected        string
+	}{
+		{name: "forwarded", clientUserAgent: "client/1.0", expected: "client/1.0"},
+		{name: "overridden", options: ProxyOptions{UserAgent: "proxy/2.0"}, clientUserAgent: "client/1.0", expected: "proxy/2.0"},
+		{name: "appended", options: ProxyOptions{UserAgent: "proxy/2.0", AppendUserAgent: true}, clientUserAgent: "client/1.0", expected: "client/1.0 proxy/2.0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userAgents := make(chan string, 1)
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				userAgents <- r.UserAgent()
+				upgrader := gws.Upgrader{}
+				if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+					conn.Close()
+				}
+			}))
+			defer backend.Close()
+			options := test.options
+			options.WebsocketBackend = true
+			addr := startTestProxy(t, strings.TrimPrefix(backend.URL, "http://"), nil, options)
+
+			header := http.Header{}
+			header.Set("User-Agent", test.clientUserAgent)
+			conn, _, err := gws.DefaultDialer.Dial("ws://"+addr+"/", header)
+			if assert.NoError(t, err) {
+				conn.Close()
+			}
+			assert.Equal(t, test.expected, <-userAgents)
+		})
+	}
+}
+
+func TestWebsocketBackendDialTimeout(t *testing.T) {
+	addr := startTestProxy(t, "127.0.0.1:1", nil, ProxyOptions{
+		WebsocketBackend:   true,
+		BackendDialTimeout: 10 * time.Millisecond,
+		DialBackend: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+
+	_, resp, err := gws.DefaultDialer.Dial("ws://"+addr+"/", nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	}
+}
+
+func TestWebsocketBackendHandshakeMetric(t *testing.T) {
+	const metric = "cloudflared_websocket_handshake_duration_seconds"
+	backend := echoWebsocketBackend(t)
+	addr := startTestProxy(t, strings.TrimPrefix(backend.URL, "http://"), nil, ProxyOptions{WebsocketBackend: true})
+
+	clientBefore, _ := labelledHistogramSamples(t, metric, "side", handshakeClient)
+	backendBefore, _ := labelledHistogramSamples(t, metric, "side", handshakeBackend)
+	conn := dialTestProxy(t, addr, nil)
+	defer conn.Close()
+
+	backendAfter, _ := labelledHistogramSamples(t, metric, "side", handshakeBackend)
+	assert.Equal(t, backendBefore+1, backendAfter)
+	clientAfter, _ := labelledHistogramSamples(t, metric, "side", handshakeClient)
+	assert.Equal(t, clientBefore, clientAfter)
+}
+
+func TestWebsocketBackendIgnoresDestinationParser(t *testing.T) {
+	backend := echoWebsocketBackend(t)
+	addr := startTestProxy(t, strings.TrimPrefix(backend.URL, "http://"), nil, ProxyOptions{
+		WebsocketBackend: true,
+		DestinationParser: func(raw string) (string, string, error) {
+			return "", "", fmt.Errorf("unexpected destination %s", raw)
+		},
+	})
+
+	conn := dialTestProxy(t, addr, nil)
+	defer conn.Close()
+	assert.NoError(t, conn.WriteMessage(gws.TextMessage, []byte("hello")))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(message))
+}
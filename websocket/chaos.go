@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// ChaosLatency injects latency into proxied connections, for testing how clients cope with
+// slow or unsteady links. It must never be used in production.
+type ChaosLatency struct {
+	// Delay is added to every chunk of data proxied in either direction.
+	Delay time.Duration
+	// Jitter is the most random extra delay added on top of Delay to each chunk.
+	Jitter time.Duration
+}
+
+// delay returns how long to hold up the next chunk of data.
+func (c *ChaosLatency) delay() time.Duration {
+	d := c.Delay
+	if c.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(c.Jitter)))
+	}
+	return d
+}
+
+// chaosConn is a backend connection that holds up the data written to it, which comes from
+// the client, and the data read from it, which goes to the client, by its ChaosLatency.
+// Since each direction is copied by a single goroutine, the delays also slow the copy down.
+type chaosConn struct {
+	net.Conn
+	latency *ChaosLatency
+}
+
+func (c *chaosConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		time.Sleep(c.latency.delay())
+	}
+	return n, err
+}
+
+func (c *chaosConn) Write(p []byte) (int, error) {
+	time.Sleep(c.latency.delay())
+	return c.Conn.Write(p)
+}
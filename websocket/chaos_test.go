@@ -0,0 +1,38 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaosLatency(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+		ChaosLatency:     &ChaosLatency{Delay: delay, Jitter: 10 * time.Millisecond},
+		CloseGracePeriod: 10 * time.Millisecond,
+	})
+	conn := dialTestProxy(t, addr, nil)
+
+	start := time.Now()
+	require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("slow")))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "slow", string(message))
+	// The data was held up on its way to the backend and again on its way back
+	assert.True(t, time.Since(start) >= 2*delay, time.Since(start))
+}
+
+func TestChaosLatencyDelay(t *testing.T) {
+	latency := &ChaosLatency{Delay: 10 * time.Millisecond, Jitter: 5 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		d := latency.delay()
+		assert.True(t, d >= 10*time.Millisecond && d < 15*time.Millisecond, d)
+	}
+	assert.Equal(t, 10*time.Millisecond, (&ChaosLatency{Delay: 10 * time.Millisecond}).delay())
+}
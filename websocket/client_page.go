@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// serveTestClient answers browsers requesting ProxyOptions.TestClientPath with the test
+// client page, reporting whether it did. Upgrade requests to the path, which is where the
+// page connects, are left to the handler.
+func (h *handler) serveTestClient(w http.ResponseWriter, r *http.Request) bool {
+	if h.options.TestClientPath == "" || r.URL.Path != h.options.TestClientPath || websocket.IsWebSocketUpgrade(r) {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeHTML(w, testClientPage())
+	return true
+}
+
+// testClientPage returns a page that opens a websocket to the URL it was loaded from, sends
+// the messages typed into it and shows the messages received.
+func testClientPage() []byte {
+	return []byte(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="robots" content="noindex">
+	<title>Websocket test client</title>
+	<style>
+		body { font-family: sans-serif; margin: 2em; }
+		#log { border: 1px solid #ccc; height: 20em; overflow-y: auto; padding: 0.5em; font-family: monospace; white-space: pre-wrap; }
+	</style>
+</head>
+<body>
+	<h1>Websocket test client</h1>
+	<p>Status: <span id="status">connecting</span></p>
+	<div id="log"></div>
+	<form id="send">
+		<input id="message" autocomplete="off" size="60" placeholder="Message">
+		<button type="submit">Send</button>
+	</form>
+	<script>
+		var logView = document.getElementById("log");
+		var statusView = document.getElementById("status");
+		function append(line) {
+			logView.textContent += line + "\n";
+			logView.scrollTop = logView.scrollHeight;
+		}
+		var url = (location.protocol === "https:" ? "wss://" : "ws://") + location.host + location.pathname + location.search;
+		var ws = new WebSocket(url);
+		ws.binaryType = "arraybuffer";
+		ws.onopen = function () { statusView.textContent = "connected to " + url; };
+		ws.onclose = function (event) { statusView.textContent = "closed (" + event.code + (event.reason ? ": " + event.reason : "") + ")"; };
+		ws.onerror = function () { append("! error"); };
+		ws.onmessage = function (event) {
+			var data = event.data instanceof ArrayBuffer ? new TextDecoder().decode(event.data) : event.data;
+			append("< " + data);
+		};
+		document.getElementById("send").onsubmit = function (event) {
+			event.preventDefault();
+			var input = document.getElementById("message");
+			if (ws.readyState !== WebSocket.OPEN) {
+				append("! not connected");
+				return;
+			}
+			ws.send(input.value);
+			append("> " + input.value);
+			input.value = "";
+		};
+	</script>
+</body>
+</html>
+`)
+}
@@ -0,0 +1,56 @@
+package websocket
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestClientPage(t *testing.T) {
+	addr := startTestProxy(t, "", DefaultStreamHandler, ProxyOptions{EchoBackend: true, Resolver: StaticResolver(echoDestination), TestClientPath: "/test"})
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		var err error
+		resp, err = http.Get(fmt.Sprintf("http://%s/test", addr))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, testClientPage(), body)
+
+	// The page's websocket to the same path is proxied
+	conn, _, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/test", addr), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteMessage(gws.TextMessage, []byte("hello")))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(message))
+}
+
+func TestTestClientPageDisabled(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{})
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		var err error
+		resp, err = http.Get(fmt.Sprintf("http://%s/test", addr))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.NotEqual(t, testClientPage(), body)
+}
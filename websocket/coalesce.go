@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultCoalesceSize is the default amount of buffered data that is sent immediately
+// as a frame when coalescing writes.
+const defaultCoalesceSize = 16 * 1024
+
+// coalescingWriter batches small writes to a websocket connection, similar to Nagle's
+// algorithm. Buffered data is sent as a single binary frame once maxSize bytes are
+// buffered or maxDelay has passed since the first buffered write, whichever comes first.
+type coalescingWriter struct {
+	conn     *websocket.Conn
+	maxDelay time.Duration
+	maxSize  int
+	stats    *connStats
+	// compression, when set, decides whether each frame sent is compressed
+	compression *frameCompression
+	// tracer, when set, logs each frame sent
+	tracer *frameTracer
+	// maxFrameSize, when set, splits the buffer into frames of at most this size, see
+	// ProxyOptions.MaxClientFrameSize
+	maxFrameSize int
+
+	lock  sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	// err is the error of the last failed flush. It is reported by the next Write, since
+	// delayed flushes happen outside of any call.
+	err error
+}
+
+func newCoalescingWriter(conn *websocket.Conn, maxDelay time.Duration, maxSize int, stats *connStats) *coalescingWriter {
+	if maxSize <= 0 {
+		maxSize = defaultCoalesceSize
+	}
+	return &coalescingWriter{
+		conn:     conn,
+		maxDelay: maxDelay,
+		maxSize:  maxSize,
+		stats:    stats,
+	}
+}
+
+// Write buffers p, sending the buffer as a frame if it has reached maxSize.
+func (w *coalescingWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.maxSize {
+		if err := w.flushLocked(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.maxDelay, func() {
+			w.Flush()
+		})
+	}
+	return len(p), nil
+}
+
+// Flush sends any buffered data as a frame.
+func (w *coalescingWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.flushLocked()
+}
+
+func (w *coalescingWriter) flushLocked() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.buf) == 0 || w.err != nil {
+		return w.err
+	}
+	w.compression.apply(w.conn, w.buf)
+	n, err := writeBinaryFrames(w.conn, w.buf, w.maxFrameSize, w.tracer)
+	w.stats.addToClient(int64(n))
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
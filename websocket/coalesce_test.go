@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesceBackendWrites(t *testing.T) {
+	const writes = 10
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for i := 0; i < writes; i++ {
+			conn.Write([]byte{'a'})
+			time.Sleep(2 * time.Millisecond)
+		}
+		time.Sleep(time.Second)
+	}()
+
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{CoalesceDelay: 200 * time.Millisecond})
+	conn := dialTestProxy(t, addr, nil)
+
+	frames, received := 0, 0
+	for received < writes {
+		_, message, err := conn.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		frames++
+		received += len(message)
+	}
+	assert.Equal(t, writes, received)
+	assert.Less(t, frames, writes)
+}
+
+func TestCoalesceFlushesAtSize(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, 64))
+		time.Sleep(time.Second)
+	}()
+
+	// The delay is far longer than the test, so only the size threshold can send the frame.
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{CoalesceDelay: time.Hour, CoalesceSize: 32})
+	conn := dialTestProxy(t, addr, nil)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Len(t, message, 64)
+}
@@ -0,0 +1,324 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+// Stream compression compresses the data of raw TCP tunnels, independently of websocket
+// permessage-deflate. The client offers it in the handshake request header, and the proxy
+// echoes the header on the upgrade response if it agrees. Either end falls back to an
+// uncompressed stream if the other doesn't support it.
+const (
+	streamCompressionHeader  = "Cf-Stream-Compression"
+	streamCompressionDeflate = "deflate"
+)
+
+// offersStreamCompression reports whether the handshake headers offer stream compression.
+func offersStreamCompression(header http.Header) bool {
+	return strings.EqualFold(header.Get(streamCompressionHeader), streamCompressionDeflate)
+}
+
+// NewClientConn wraps a connection from ClientConnect, enabling stream compression if the
+// proxy accepted it in the handshake response.
+func NewClientConn(conn *websocket.Conn, resp *http.Response) *Conn {
+	c := &Conn{Conn: conn}
+	if resp != nil && offersStreamCompression(resp.Header) {
+		c.enableStreamCompression(messageWriter{conn: conn})
+	}
+	return c
+}
+
+// enableStreamCompression compresses data written to the connection, sending the compressed
+// stream as binary frames through frames, and decompresses data read from it.
+func (c *Conn) enableStreamCompression(frames io.Writer) {
+	// BestSpeed keeps the cost of compressing interactive traffic low. The error is only
+	// for invalid levels.
+	fw, _ := flate.NewWriter(frames, flate.BestSpeed)
+	c.streamWriter = &flushingWriter{fw}
+	c.streamReader = flate.NewReader(&messageStreamReader{conn: c.Conn, policy: c.readPolicy, tracer: c.tracer})
+}
+
+// messageWriter writes each write to the connection as a binary message.
+type messageWriter struct {
+	conn   *websocket.Conn
+	tracer *frameTracer
+	// maxFrameSize, when set, splits larger writes, see ProxyOptions.MaxClientFrameSize
+	maxFrameSize int
+}
+
+func (w messageWriter) Write(p []byte) (int, error) {
+	return writeBinaryFrames(w.conn, p, w.maxFrameSize, w.tracer)
+}
+
+// flushingWriter compresses each write and flushes it straight away, so that interactive
+// traffic isn't held back waiting for more data to compress.
+type flushingWriter struct {
+	fw *flate.Writer
+}
+
+func (w *flushingWriter) Write(p []byte) (int, error) {
+	if _, err := w.fw.Write(p); err != nil {
+		return 0, err
+	}
+	if err := w.fw.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// messageStreamReader reads the payloads of consecutive messages as one continuous stream,
+// regardless of how the stream was split into messages.
+type messageStreamReader struct {
+	conn   *websocket.Conn
+	policy readPolicy
+	tracer *frameTracer
+	r      io.Reader
+	// messageType and size are the type and size so far of the message being read
+	messageType int
+	size        int64
+}
+
+func (s *messageStreamReader) Read(p []byte) (int, error) {
+	for {
+		if s.r == nil {
+			messageType, r, err := nextMessage(s.conn, s.policy)
+			if err != nil {
+				return 0, err
+			}
+			s.r, s.messageType, s.size = r, messageType, 0
+		}
+		n, err := s.r.Read(p)
+		s.size += int64(n)
+		if err == io.EOF {
+			s.tracer.frame(traceFromClient, s.messageType, s.size)
+			s.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// scalableWriteBufferPool shares write buffers between connections using scalable
+// compression, so idle connections don't each hold one.
+var scalableWriteBufferPool = NewWriteBufferPool()
+
+// NewWriteBufferPool returns a pool for sharing write buffers between connections, see
+// ProxyOptions.WriteBufferPool. The buffers of connections with different write buffer
+// sizes shouldn't share a pool.
+func NewWriteBufferPool() websocket.BufferPool {
+	return &sync.Pool{}
+}
+
+// configureScalableCompression enables permessage-deflate on upgrader with settings suited
+// to a proxy fronting tens of thousands of connections.
+//
+// With context takeover, each connection would keep its own flate compressor (several
+// hundred KB) and 32KB decompression window for its lifetime, which dominates memory at
+// scale. gorilla only negotiates server_no_context_takeover and client_no_context_takeover,
+// so the flate state is borrowed from a pool for each message and returned afterwards: an
+// idle connection holds no flate state, and memory grows with the number of messages in
+// flight rather than the number of connections. gorilla can't negotiate a smaller window
+// with max_window_bits, so the pooled state always uses the default 32KB window. The cost
+// is a lower compression ratio, since each message is compressed on its own.
+//
+// Write buffers are also pooled, and messages are compressed at flate.BestSpeed to keep
+// the CPU cost per message down, see configureCompression.
+func configureScalableCompression(upgrader *websocket.Upgrader) {
+	upgrader.EnableCompression = true
+	if upgrader.WriteBufferPool == nil {
+		upgrader.WriteBufferPool = scalableWriteBufferPool
+	}
+}
+
+// configureCompression sets the compression level of a client connection when scalable
+// compression is enabled, or CompressionLevel is set.
+func (h *handler) configureCompression(log logger.Service, conn *websocket.Conn, r *http.Request) {
+	if h.options.ScalableCompression {
+		conn.SetCompressionLevel(flate.BestSpeed)
+	}
+	if h.options.CompressionLevel != nil {
+		level := h.options.CompressionLevel(r)
+		if err := conn.SetCompressionLevel(level); err != nil {
+			log.Errorf("Ignoring compression level %d for %s: must be between %d and %d", level, r.RemoteAddr, flate.HuffmanOnly, flate.BestCompression)
+		}
+	}
+}
+
+// Parameters of permessage-deflate offers, see RFC 7692 section 7.1.
+const (
+	deflateExtension               = "permessage-deflate"
+	deflateServerNoContextTakeover = "server_no_context_takeover"
+	deflateClientNoContextTakeover = "client_no_context_takeover"
+	deflateServerMaxWindowBits     = "server_max_window_bits"
+	deflateClientMaxWindowBits     = "client_max_window_bits"
+	deflateMaxWindowBits           = 15
+)
+
+// withSupportedDeflateOffers returns r with the permessage-deflate offers that gorilla can't
+// honor removed from its Sec-WebSocket-Extensions header, so that the connection falls back
+// to no compression rather than negotiating something the client can't decompress.
+//
+// gorilla accepts the first permessage-deflate offer regardless of its parameters, and
+// always compresses with a 32KB window. An offer limiting server_max_window_bits to less than
+// 15 can't be honored, and RFC 7692 requires offers with malformed or unknown parameters to
+// be declined. client_max_window_bits only permits the server to limit the client's window,
+// which it doesn't, so it's accepted with any valid value.
+func withSupportedDeflateOffers(r *http.Request) *http.Request {
+	values := r.Header.Values("Sec-Websocket-Extensions")
+	if len(values) == 0 {
+		return r
+	}
+	var kept []string
+	changed := false
+	for _, value := range values {
+		for _, offer := range strings.Split(value, ",") {
+			offer = strings.TrimSpace(offer)
+			if offer == "" {
+				continue
+			}
+			if !supportedDeflateOffer(offer) {
+				changed = true
+				continue
+			}
+			kept = append(kept, offer)
+		}
+	}
+	if !changed {
+		return r
+	}
+	supported := r.Clone(r.Context())
+	supported.Header.Del("Sec-Websocket-Extensions")
+	if len(kept) > 0 {
+		supported.Header.Set("Sec-Websocket-Extensions", strings.Join(kept, ", "))
+	}
+	return supported
+}
+
+// supportedDeflateOffer reports whether an extension offer is either some other extension,
+// which gorilla ignores, or a permessage-deflate offer that gorilla can honor.
+func supportedDeflateOffer(offer string) bool {
+	params := strings.Split(offer, ";")
+	if !strings.EqualFold(strings.TrimSpace(params[0]), deflateExtension) {
+		return true
+	}
+	seen := make(map[string]bool)
+	for _, param := range params[1:] {
+		name, value := strings.TrimSpace(param), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+		name = strings.ToLower(name)
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+		switch name {
+		case deflateServerNoContextTakeover, deflateClientNoContextTakeover:
+			if value != "" {
+				return false
+			}
+		case deflateServerMaxWindowBits:
+			if bits, ok := parseWindowBits(value); !ok || bits != deflateMaxWindowBits {
+				return false
+			}
+		case deflateClientMaxWindowBits:
+			if _, ok := parseWindowBits(value); value != "" && !ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseWindowBits parses a max_window_bits value, which must be between 8 and 15.
+func parseWindowBits(value string) (int, bool) {
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < 8 || bits > deflateMaxWindowBits || strconv.Itoa(bits) != value {
+		return 0, false
+	}
+	return bits, true
+}
+
+// frameCompression decides whether each frame written to the client is compressed.
+type frameCompression struct {
+	filter func(p []byte) bool
+	// overridden is set once the stream handler has chosen with Conn.SetWriteCompression,
+	// whose choice then wins over filter
+	overridden int32
+}
+
+// compressFrameFilter returns the frameCompression for the connections of the handler, or
+// nil to compress every frame.
+func (h *handler) compressFrameFilter() *frameCompression {
+	skip, minSize, maxSize := h.options.SkipCompression, h.options.CompressionMinSize, h.options.MaxCompressedFrameSize
+	if skip == nil && minSize <= 0 && maxSize <= 0 {
+		return nil
+	}
+	return &frameCompression{filter: func(p []byte) bool {
+		if len(p) < minSize || (maxSize > 0 && len(p) > maxSize) {
+			return false
+		}
+		return skip == nil || !skip(p)
+	}}
+}
+
+// override stops the filter from deciding, leaving the setting to the stream handler.
+func (f *frameCompression) override() {
+	if f != nil {
+		atomic.StoreInt32(&f.overridden, 1)
+	}
+}
+
+// apply enables compression of the next frame written to conn, containing p, if the filter
+// allows it. Without a filter, or once overridden, the setting is left alone.
+func (f *frameCompression) apply(conn *websocket.Conn, p []byte) {
+	if f != nil && atomic.LoadInt32(&f.overridden) == 0 {
+		conn.EnableWriteCompression(f.filter(p))
+	}
+}
+
+// compressedSignatures are the leading bytes of common compressed formats.
+var compressedSignatures = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'B', 'Z', 'h'},                    // bzip2
+	{'P', 'K', 0x03, 0x04},             // zip
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{'G', 'I', 'F', '8'},               // gif
+	{0x1a, 0x45, 0xdf, 0xa3},           // webm and mkv
+}
+
+// LooksCompressed reports whether p starts like a common compressed file or media format,
+// so that compressing it again would waste CPU for little gain. It only recognises data at
+// the start of a format, so it is most useful for message based protocols.
+func LooksCompressed(p []byte) bool {
+	for _, signature := range compressedSignatures {
+		if bytes.HasPrefix(p, signature) {
+			return true
+		}
+	}
+	// RIFF containers such as webp, and ISO media such as mp4, have a type after the header
+	if len(p) >= 12 && bytes.HasPrefix(p, []byte("RIFF")) && string(p[8:12]) == "WEBP" {
+		return true
+	}
+	return len(p) >= 8 && string(p[4:8]) == "ftyp"
+}
@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// upgrade upgrades the client's connection, declining permessage-deflate offers that can't
+// be honored, see withSupportedDeflateOffers. When OnCompressionStats is set, the bytes
+// written to the upgraded connection are counted, so the data sent to the client can be
+// compared to what it took on the wire. It returns how long the handshake took, which is
+// also recorded in the handshake duration metric.
+func (h *handler) upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, time.Duration, error) {
+	start := time.Now()
+	if h.upgrader.EnableCompression {
+		r = withSupportedDeflateOffers(r)
+	}
+	if h.options.OnCompressionStats != nil {
+		w = &countingResponseWriter{w}
+	}
+	conn, err := h.upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		return nil, 0, err
+	}
+	if counted, ok := conn.UnderlyingConn().(*writeCountingConn); ok {
+		// Don't count the handshake response
+		counted.reset()
+	}
+	duration := time.Since(start)
+	handshakeDuration.WithLabelValues(handshakeServer).Observe(duration.Seconds())
+	return conn, duration, nil
+}
+
+// countingResponseWriter hijacks connections wrapped in a writeCountingConn.
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack error")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &writeCountingConn{Conn: conn}, brw, nil
+}
+
+// writeCountingConn counts the bytes written to a connection. It is safe for concurrent use.
+type writeCountingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *writeCountingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *writeCountingConn) count() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+func (c *writeCountingConn) reset() {
+	atomic.StoreInt64(&c.written, 0)
+}
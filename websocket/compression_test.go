@@ -0,0 +1,345 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingConn counts the bytes read from the underlying connection.
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+// countingDialler is a Dialler that counts the bytes read from the wire.
+type countingDialler struct {
+	read int64
+}
+
+func (d *countingDialler) Dial(url *url.URL, header http.Header) (*gws.Conn, *http.Response, error) {
+	dialer := &gws.Dialer{
+		NetDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := new(net.Dialer).DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: conn, read: &d.read}, nil
+		},
+	}
+	return dialer.Dial(url.String(), header)
+}
+
+// echoThroughProxy sends data through the proxy at addr to an echo backend and returns what
+// came back, along with the number of bytes the client read from the wire.
+func echoThroughProxy(t *testing.T, addr string, data []byte) ([]byte, int64, bool) {
+	dialler := &countingDialler{}
+	req, err := http.NewRequest("GET", fmt.Sprintf("ws://%s/", addr), nil)
+	assert.NoError(t, err)
+	wsConn, resp, err := ClientConnectWithOptions(req, dialler, ClientOptions{StreamCompression: true})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer wsConn.Close()
+	conn := NewClientConn(wsConn, resp)
+
+	go func() {
+		conn.Write(data)
+	}()
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(conn, received)
+	assert.NoError(t, err)
+	return received, atomic.LoadInt64(&dialler.read), conn.streamReader != nil
+}
+
+func TestStreamCompression(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	data := bytes.Repeat([]byte("compressible tunnel data "), 40*1024)
+
+	for _, options := range []ProxyOptions{
+		{StreamCompression: true},
+		{StreamCompression: true, CoalesceDelay: defaultCloseGracePeriod / 100},
+	} {
+		addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, options)
+		received, wire, compressed := echoThroughProxy(t, addr, data)
+		assert.True(t, compressed)
+		assert.Equal(t, data, received)
+		assert.Less(t, wire, int64(len(data)/10))
+	}
+}
+
+func TestStreamCompressionFallback(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	data := bytes.Repeat([]byte("compressible tunnel data "), 1024)
+
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{})
+	received, wire, compressed := echoThroughProxy(t, addr, data)
+	assert.False(t, compressed)
+	assert.Equal(t, data, received)
+	assert.Greater(t, wire, int64(len(data)))
+}
+
+func TestScalableCompression(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	for _, scalable := range []bool{false, true} {
+		addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{ScalableCompression: scalable})
+		dialer := gws.Dialer{EnableCompression: true}
+		conn, resp, err := dialer.Dial(fmt.Sprintf("ws://%s/", addr), nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		extensions := resp.Header.Get("Sec-Websocket-Extensions")
+		if scalable {
+			assert.Contains(t, extensions, "permessage-deflate")
+			assert.Contains(t, extensions, "server_no_context_takeover")
+			assert.Contains(t, extensions, "client_no_context_takeover")
+		} else {
+			assert.Empty(t, extensions)
+		}
+
+		message := bytes.Repeat([]byte("compressed message "), 100)
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, message))
+		_, received, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, message, received)
+		conn.Close()
+	}
+}
+
+func TestSkipCompression(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	text := bytes.Repeat([]byte("a"), 300)
+	small := bytes.Repeat([]byte("a"), 100)
+	gzipped := append([]byte{0x1f, 0x8b, 0x08, 0x00}, bytes.Repeat([]byte{0x5a}, 296)...)
+
+	tests := []struct {
+		name       string
+		options    ProxyOptions
+		payload    []byte
+		compressed bool
+	}{
+		{name: "no detector", payload: gzipped, compressed: true},
+		{name: "detector text", options: ProxyOptions{SkipCompression: LooksCompressed}, payload: text, compressed: true},
+		{name: "detector gzip", options: ProxyOptions{SkipCompression: LooksCompressed}, payload: gzipped, compressed: false},
+		{name: "under max size", options: ProxyOptions{MaxCompressedFrameSize: 300}, payload: text, compressed: true},
+		{name: "over max size", options: ProxyOptions{MaxCompressedFrameSize: 280}, payload: text, compressed: false},
+		{name: "under default min size", payload: small, compressed: false},
+		{name: "under min size", options: ProxyOptions{CompressionMinSize: 301}, payload: text, compressed: false},
+		{name: "at min size", options: ProxyOptions{CompressionMinSize: 300}, payload: text, compressed: true},
+		{name: "no min size", options: ProxyOptions{CompressionMinSize: -1}, payload: small, compressed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := test.options
+			options.Upgrader = &gws.Upgrader{EnableCompression: true}
+			addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, options)
+
+			header := http.Header{}
+			header.Set("Sec-Websocket-Extensions", "permessage-deflate; client_no_context_takeover; server_no_context_takeover")
+			conn, r := dialRawWebsocket(t, addr, header)
+			writeRawFrame(t, conn, 0x80|gws.BinaryMessage, true, test.payload)
+
+			b0, _, err := readRawFrame(r)
+			assert.NoError(t, err)
+			// RSV1 marks a compressed message
+			assert.Equal(t, test.compressed, b0&0x40 != 0)
+		})
+	}
+}
+
+func TestSetWriteCompressionOverridesFilter(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	uncompressed := func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header) {
+		wsConn.SetWriteCompression(false)
+		DefaultStreamHandler(wsConn, remoteConn, requestHeaders)
+	}
+	// The default minimum size installs a filter, which must not turn compression back on
+	addr := startTestProxy(t, backend.Addr().String(), uncompressed, ProxyOptions{Upgrader: &gws.Upgrader{EnableCompression: true}})
+
+	header := http.Header{}
+	header.Set("Sec-Websocket-Extensions", "permessage-deflate; client_no_context_takeover; server_no_context_takeover")
+	conn, r := dialRawWebsocket(t, addr, header)
+	for i := 0; i < 3; i++ {
+		writeRawFrame(t, conn, 0x80|gws.BinaryMessage, true, bytes.Repeat([]byte("a"), 300))
+		b0, _, err := readRawFrame(r)
+		require.NoError(t, err)
+		assert.Zero(t, b0&0x40, "frame %d was compressed", i)
+	}
+}
+
+func TestLooksCompressed(t *testing.T) {
+	assert.True(t, LooksCompressed([]byte{0x1f, 0x8b, 0x08}))
+	assert.True(t, LooksCompressed([]byte("\x89PNG\r\n\x1a\n")))
+	assert.True(t, LooksCompressed([]byte("RIFF\x00\x00\x00\x00WEBPVP8 ")))
+	assert.True(t, LooksCompressed([]byte("\x00\x00\x00\x18ftypmp42")))
+	assert.False(t, LooksCompressed([]byte("plain text")))
+	assert.False(t, LooksCompressed(nil))
+}
+
+func TestCompressionStats(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	type compressionStats struct{ uncompressed, compressed int64 }
+	statsC := make(chan compressionStats, 1)
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+		ScalableCompression: true,
+		OnCompressionStats: func(_ string, uncompressed, compressed int64) {
+			statsC <- compressionStats{uncompressed, compressed}
+		},
+		CloseGracePeriod: 10 * time.Millisecond,
+	})
+	dialer := gws.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial(fmt.Sprintf("ws://%s/", addr), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	message := bytes.Repeat([]byte("compressed message "), 100)
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, message))
+	var received []byte
+	for len(received) < len(message) {
+		_, p, err := conn.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		received = append(received, p...)
+	}
+	conn.Close()
+
+	select {
+	case stats := <-statsC:
+		assert.Equal(t, int64(len(message)), stats.uncompressed)
+		assert.Greater(t, stats.compressed, int64(0))
+		assert.Less(t, float64(stats.compressed)/float64(stats.uncompressed), 1.0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("compression stats were not reported")
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	type compressionStats struct{ uncompressed, compressed int64 }
+	statsC := make(chan compressionStats, 1)
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+		Upgrader: &gws.Upgrader{EnableCompression: true},
+		CompressionLevel: func(r *http.Request) int {
+			level, _ := strconv.Atoi(r.Header.Get("X-Compression-Level"))
+			return level
+		},
+		OnCompressionStats: func(_ string, uncompressed, compressed int64) {
+			statsC <- compressionStats{uncompressed, compressed}
+		},
+		CloseGracePeriod: 10 * time.Millisecond,
+	})
+
+	words := []string{"proxy", "tunnel", "websocket", "backend", "client", "frame", "deflate"}
+	random := rand.New(rand.NewSource(1))
+	var message []byte
+	for len(message) < 8*1024 {
+		message = append(message, words[random.Intn(len(words))]...)
+		message = append(message, ' ')
+	}
+
+	// compressedSize returns how many bytes the echo of message took with the given level
+	compressedSize := func(level int) int64 {
+		header := http.Header{}
+		header.Set("X-Compression-Level", strconv.Itoa(level))
+		dialer := gws.Dialer{EnableCompression: true}
+		conn, _, err := dialer.Dial(fmt.Sprintf("ws://%s/", addr), header)
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(gws.BinaryMessage, message))
+		received := 0
+		for received < len(message) {
+			_, p, err := conn.ReadMessage()
+			require.NoError(t, err)
+			received += len(p)
+		}
+		conn.Close()
+		select {
+		case stats := <-statsC:
+			return stats.compressed
+		case <-time.After(5 * time.Second):
+			t.Fatal("compression stats were not reported")
+			return 0
+		}
+	}
+
+	huffmanOnly := compressedSize(flate.HuffmanOnly)
+	best := compressedSize(flate.BestCompression)
+	assert.Less(t, best, huffmanOnly)
+}
+
+func TestCompressionLevelValidated(t *testing.T) {
+	server, _ := websocketPair(t)
+	log := &testLogger{}
+	h := newHandler(log, "", DefaultStreamHandler, ProxyOptions{CompressionLevel: func(*http.Request) int { return 12 }})
+	h.configureCompression(log, server, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Len(t, log.Lines(), 1)
+}
+
+func TestUnsupportedDeflateOffers(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+		Upgrader:           &gws.Upgrader{EnableCompression: true},
+		CompressionMinSize: -1,
+	})
+
+	tests := []struct {
+		name       string
+		extensions string
+		compressed bool
+	}{
+		{name: "default offer", extensions: "permessage-deflate", compressed: true},
+		{name: "client window bits", extensions: "permessage-deflate; client_max_window_bits", compressed: true},
+		{name: "max server window bits", extensions: "permessage-deflate; server_max_window_bits=15", compressed: true},
+		{name: "small server window bits", extensions: "permessage-deflate; server_max_window_bits=10", compressed: false},
+		{name: "invalid client window bits", extensions: "permessage-deflate; client_max_window_bits=16", compressed: false},
+		{name: "unknown parameter", extensions: "permessage-deflate; x-unknown", compressed: false},
+		{name: "fallback offer", extensions: "permessage-deflate; server_max_window_bits=10, permessage-deflate", compressed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Sec-Websocket-Extensions", test.extensions)
+			conn, r := dialRawWebsocket(t, addr, header)
+			writeRawFrame(t, conn, 0x80|gws.BinaryMessage, true, []byte("hello"))
+
+			b0, payload, err := readRawFrame(r)
+			require.NoError(t, err)
+			// RSV1 marks a compressed message
+			assert.Equal(t, test.compressed, b0&0x40 != 0)
+			if !test.compressed {
+				assert.Equal(t, []byte("hello"), payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnectionInfo is a snapshot of a connection being proxied.
+type ConnectionInfo struct {
+	ID          string            `json:"id"`
+	RemoteAddr  string            `json:"remote_addr"`
+	Destination string            `json:"destination"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	// ToBackend and ToClient are the number of bytes proxied so far in each direction.
+	ToBackend int64         `json:"to_backend"`
+	ToClient  int64         `json:"to_client"`
+	Duration  time.Duration `json:"duration"`
+}
+
+var errConnectionNotFound = errors.New("no connection with that ID")
+
+// connectionRegistry tracks the connections a proxy has open. It is safe for concurrent use.
+type connectionRegistry struct {
+	lock        sync.Mutex
+	connections map[string]*activeConnection
+}
+
+type activeConnection struct {
+	event ConnectionEvent
+	stats *connStats
+	conn  *websocket.Conn
+	// progressBytes is the number of bytes moved when the watchdog last saw progress, at
+	// progressAt, and stallReported is whether it has reported the connection since
+	progressBytes int64
+	progressAt    time.Time
+	stallReported bool
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{connections: make(map[string]*activeConnection)}
+}
+
+func (r *connectionRegistry) add(event ConnectionEvent, stats *connStats, conn *websocket.Conn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.connections[event.ID] = &activeConnection{event: event, stats: stats, conn: conn, progressAt: stats.start}
+}
+
+func (r *connectionRegistry) remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.connections, id)
+}
+
+// count returns the number of open connections.
+func (r *connectionRegistry) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.connections)
+}
+
+// goingAway sends every client a 1001 (going away) close frame, asking it to finish.
+func (r *connectionRegistry) goingAway() {
+	r.lock.Lock()
+	conns := make([]*websocket.Conn, 0, len(r.connections))
+	for _, active := range r.connections {
+		conns = append(conns, active.conn)
+	}
+	r.lock.Unlock()
+
+	// Don't hold the lock while writing, since slow clients can take a while
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+	}
+}
+
+// close sends the client of the connection with the given ID a close frame with code and
+// reason, and closes the connection after gracePeriod if the client hasn't finished it.
+func (r *connectionRegistry) close(id string, code int, reason string, gracePeriod time.Duration) error {
+	r.lock.Lock()
+	active, ok := r.connections[id]
+	r.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", errConnectionNotFound, id)
+	}
+
+	message := websocket.FormatCloseMessage(code, reason)
+	if err := active.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait)); err != nil {
+		active.conn.Close()
+		return err
+	}
+	time.AfterFunc(gracePeriod, func() { active.conn.Close() })
+	return nil
+}
+
+// stalled returns the connections that have moved no data for period, that haven't already
+// been returned since they last made progress.
+func (r *connectionRegistry) stalled(period time.Duration) []ConnectionInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	var stalled []ConnectionInfo
+	for _, active := range r.connections {
+		toBackend, toClient := active.stats.totals()
+		if moved := toBackend + toClient; moved != active.progressBytes {
+			active.progressBytes, active.progressAt, active.stallReported = moved, now, false
+			continue
+		}
+		if !active.stallReported && now.Sub(active.progressAt) >= period {
+			active.stallReported = true
+			stalled = append(stalled, ConnectionInfo{
+				ID:          active.event.ID,
+				RemoteAddr:  active.event.RemoteAddr,
+				Destination: active.event.Destination,
+				Tags:        active.event.Tags,
+				ToBackend:   toBackend,
+				ToClient:    toClient,
+				Duration:    now.Sub(active.stats.start),
+			})
+		}
+	}
+	return stalled
+}
+
+// closeAll closes every client connection, returning how many there were.
+func (r *connectionRegistry) closeAll() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, active := range r.connections {
+		active.conn.Close()
+	}
+	return len(r.connections)
+}
+
+// snapshot returns the open connections, oldest first.
+func (r *connectionRegistry) snapshot() []ConnectionInfo {
+	r.lock.Lock()
+	active := make([]*activeConnection, 0, len(r.connections))
+	for _, conn := range r.connections {
+		active = append(active, conn)
+	}
+	r.lock.Unlock()
+
+	sort.Slice(active, func(i, j int) bool { return active[i].stats.start.Before(active[j].stats.start) })
+	infos := make([]ConnectionInfo, len(active))
+	for i, conn := range active {
+		toBackend, toClient := conn.stats.totals()
+		infos[i] = ConnectionInfo{
+			ID:          conn.event.ID,
+			RemoteAddr:  conn.event.RemoteAddr,
+			Destination: conn.event.Destination,
+			Tags:        conn.event.Tags,
+			ToBackend:   toBackend,
+			ToClient:    toClient,
+			Duration:    time.Since(conn.stats.start),
+		}
+	}
+	return infos
+}
+
+// connectionsHandler serves the snapshot of r as JSON.
+func (r *connectionRegistry) connectionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.snapshot())
+	})
+}
@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+)
+
+func TestConnections(t *testing.T) {
+	backendA := echoBackend(t)
+	defer backendA.Close()
+	backendB := echoBackend(t)
+	defer backendB.Close()
+
+	server, err := NewProxyServer(&testLogger{}, "", DefaultStreamHandler, ProxyOptions{CloseGracePeriod: 10 * time.Millisecond})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go server.Serve(listener, shutdownC)
+
+	dial := func(destination string) *gws.Conn {
+		header := http.Header{}
+		header.Set(h2mux.CFJumpDestinationHeader, destination)
+		conn := dialTestProxy(t, listener.Addr().String(), header)
+		require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("ping")))
+		_, _, err := conn.ReadMessage()
+		require.NoError(t, err)
+		return conn
+	}
+	connA := dial(backendA.Addr().String())
+	dial(backendB.Addr().String())
+
+	connections := server.Connections()
+	require.Len(t, connections, 2)
+	assert.Equal(t, backendA.Addr().String(), connections[0].Destination)
+	assert.Equal(t, backendB.Addr().String(), connections[1].Destination)
+	for _, conn := range connections {
+		assert.NotEmpty(t, conn.ID)
+		assert.Equal(t, int64(4), conn.ToBackend)
+		assert.Equal(t, int64(4), conn.ToClient)
+	}
+
+	w := httptest.NewRecorder()
+	server.ConnectionsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/connections", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var served []ConnectionInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &served))
+	require.Len(t, served, 2)
+	assert.Equal(t, connections[0].ID, served[0].ID)
+
+	// Closed connections are no longer listed
+	connA.Close()
+	assert.Eventually(t, func() bool { return len(server.Connections()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, backendB.Addr().String(), server.Connections()[0].Destination)
+}
+
+func TestCloseConnection(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	server, err := NewProxyServer(&testLogger{}, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{CloseGracePeriod: 10 * time.Millisecond})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go server.Serve(listener, shutdownC)
+
+	conn := dialTestProxy(t, listener.Addr().String(), nil)
+	require.Eventually(t, func() bool { return len(server.Connections()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	assert.Error(t, server.CloseConnection("unknown", gws.ClosePolicyViolation, "terminated"))
+	require.NoError(t, server.CloseConnection(server.Connections()[0].ID, gws.ClosePolicyViolation, "terminated by an administrator"))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*gws.CloseError)
+	require.True(t, ok, err)
+	assert.Equal(t, gws.ClosePolicyViolation, closeErr.Code)
+	assert.Equal(t, "terminated by an administrator", closeErr.Text)
+	require.Eventually(t, func() bool { return len(server.Connections()) == 0 }, 5*time.Second, 10*time.Millisecond)
+}
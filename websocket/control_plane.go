@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+)
+
+const (
+	// defaultControlPlaneTimeout is how long a ControlPlaneResolver waits for its control
+	// plane by default.
+	defaultControlPlaneTimeout = 5 * time.Second
+	// maxControlPlaneResponseSize bounds the control plane response read by a
+	// ControlPlaneResolver.
+	maxControlPlaneResponseSize = 64 * 1024
+)
+
+// ControlPlaneRequest is the JSON body a ControlPlaneResolver POSTs to its control plane to
+// resolve a request.
+type ControlPlaneRequest struct {
+	// Host is the host the request was sent to.
+	Host string `json:"host"`
+	// Path is the path of the request, with its query.
+	Path string `json:"path"`
+	// RemoteAddr is the address of the client.
+	RemoteAddr string `json:"remote_addr"`
+	// JumpDestination is the destination the client asked for in the jump destination
+	// header, if any.
+	JumpDestination string `json:"jump_destination,omitempty"`
+}
+
+// ControlPlaneResponse is the JSON body a control plane responds to a ControlPlaneRequest
+// with, along with 200 OK. A control plane that has no destination for the request responds
+// 404 Not Found instead, with any body.
+type ControlPlaneResponse struct {
+	// Destination is the backend address to proxy the request to.
+	Destination string `json:"destination"`
+}
+
+// ControlPlaneResolver resolves requests by asking a central control plane, so that routing
+// can be changed without restarting the proxy. See ControlPlaneRequest and
+// ControlPlaneResponse for the contract. Requests the control plane has no destination for
+// are refused with 404 Not Found, and those it fails to resolve, or takes longer than
+// Timeout to, with 502 Bad Gateway. Wrap it in NewCachingResolver to avoid asking the
+// control plane for every connection.
+type ControlPlaneResolver struct {
+	// Endpoint is the URL of the control plane.
+	Endpoint string
+	// Client makes the requests to the control plane. Defaults to http.DefaultClient.
+	Client *http.Client
+	// Timeout bounds each request to the control plane. Defaults to defaultControlPlaneTimeout.
+	Timeout time.Duration
+}
+
+func (c *ControlPlaneResolver) Resolve(ctx context.Context, r *http.Request) (string, error) {
+	destination, status, err := c.query(ctx, r)
+	if err != nil {
+		return "", &DestinationError{Status: status, Err: errControlPlane, Cause: err}
+	}
+	return destination, nil
+}
+
+// query asks the control plane for r's destination. It returns the status to refuse the
+// request with on failure.
+func (c *ControlPlaneResolver) query(ctx context.Context, r *http.Request) (string, int, error) {
+	body, err := json.Marshal(ControlPlaneRequest{
+		Host:            r.Host,
+		Path:            r.URL.RequestURI(),
+		RemoteAddr:      r.RemoteAddr,
+		JumpDestination: r.Header.Get(h2mux.CFJumpDestinationHeader),
+	})
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultControlPlaneTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", http.StatusNotFound, fmt.Errorf("control plane has no destination for %s", r.Host)
+	default:
+		return "", http.StatusBadGateway, fmt.Errorf("control plane responded %s", resp.Status)
+	}
+	var response ControlPlaneResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxControlPlaneResponseSize)).Decode(&response); err != nil {
+		return "", http.StatusBadGateway, fmt.Errorf("cannot decode control plane response: %w", err)
+	}
+	if response.Destination == "" {
+		return "", http.StatusBadGateway, errors.New("control plane responded without a destination")
+	}
+	return response.Destination, http.StatusOK, nil
+}
@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlPlaneResolver(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	var queries int32
+	controlPlane := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		var request ControlPlaneRequest
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&request)) {
+			return
+		}
+		if request.JumpDestination != "ssh.example.com" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(ControlPlaneResponse{Destination: backend.Addr().String()})
+	}))
+	defer controlPlane.Close()
+
+	addr := startTestProxy(t, "", DefaultStreamHandler, ProxyOptions{
+		Resolver: NewCachingResolver(&ControlPlaneResolver{Endpoint: controlPlane.URL}, nil, time.Minute, 0),
+	})
+	header := http.Header{}
+	header.Set(h2mux.CFJumpDestinationHeader, "ssh.example.com")
+	for i := 0; i < 2; i++ {
+		conn := dialTestProxy(t, addr, header)
+		require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("resolved")))
+		_, message, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "resolved", string(message))
+	}
+	// The second connection was resolved from the cache
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+
+	header.Set(h2mux.CFJumpDestinationHeader, "unknown.example.com")
+	destination, status, message := resolveStatus(&ControlPlaneResolver{Endpoint: controlPlane.URL}, requestWithHeader(header))
+	assert.Empty(t, destination)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, errControlPlane.Error(), message)
+}
+
+func TestControlPlaneResolverFailures(t *testing.T) {
+	stalled := make(chan struct{})
+	var controlPlanes []*httptest.Server
+	defer func() {
+		// The stalled control plane can only be closed once it is unblocked
+		close(stalled)
+		for _, controlPlane := range controlPlanes {
+			controlPlane.Close()
+		}
+	}()
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{name: "error status", handler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}},
+		{name: "malformed response", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("not json"))
+		}},
+		{name: "no destination", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("{}"))
+		}},
+		{name: "timeout", handler: func(w http.ResponseWriter, r *http.Request) {
+			<-stalled
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			controlPlane := httptest.NewServer(test.handler)
+			controlPlanes = append(controlPlanes, controlPlane)
+			resolver := &ControlPlaneResolver{Endpoint: controlPlane.URL, Timeout: 50 * time.Millisecond}
+			_, status, message := resolveStatus(resolver, requestWithHeader(nil))
+			assert.Equal(t, http.StatusBadGateway, status)
+			assert.Equal(t, errControlPlane.Error(), message)
+		})
+	}
+}
+
+// requestWithHeader returns a request to the proxy with the given header.
+func requestWithHeader(header http.Header) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	return r
+}
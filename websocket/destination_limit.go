@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"sync"
+)
+
+// DestinationLimits caps the number of connections proxied to each destination at once, so
+// that one busy backend can't be overwhelmed while the others are idle.
+type DestinationLimits struct {
+	// Limits are the caps of particular destinations.
+	Limits map[string]int
+	// Default is the cap of destinations that aren't in Limits. Zero means no cap.
+	Default int
+}
+
+// destinationLimiter counts the active connections to each destination against their caps.
+// A nil destinationLimiter allows every connection.
+type destinationLimiter struct {
+	lock   sync.Mutex
+	limits DestinationLimits
+	active map[string]int
+}
+
+func newDestinationLimiter(limits DestinationLimits) *destinationLimiter {
+	return &destinationLimiter{limits: limits, active: make(map[string]int)}
+}
+
+// acquire counts a new connection to destination, reporting false without counting it if
+// the destination's cap has been reached. Each successful acquire must be released.
+func (l *destinationLimiter) acquire(destination string) bool {
+	if l == nil {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limit, ok := l.limits.Limits[destination]
+	if !ok {
+		limit = l.limits.Default
+	}
+	if limit > 0 && l.active[destination] >= limit {
+		return false
+	}
+	l.active[destination]++
+	return true
+}
+
+// setLimits changes the caps. Connections already counted stay open, so a destination over
+// its new cap refuses connections until enough of them have closed.
+func (l *destinationLimiter) setLimits(limits DestinationLimits) {
+	l.lock.Lock()
+	l.limits = limits
+	l.lock.Unlock()
+}
+
+// release stops counting a connection to destination.
+func (l *destinationLimiter) release(destination string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.active[destination] <= 1 {
+		delete(l.active, destination)
+		return
+	}
+	l.active[destination]--
+}
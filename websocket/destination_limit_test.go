@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestinationLimits(t *testing.T) {
+	backendA := echoBackend(t)
+	defer backendA.Close()
+	backendB := echoBackend(t)
+	defer backendB.Close()
+	addr := startTestProxy(t, "", DefaultStreamHandler, ProxyOptions{
+		DestinationLimits: &DestinationLimits{
+			Limits:  map[string]int{backendA.Addr().String(): 1},
+			Default: 2,
+		},
+		CloseGracePeriod: 10 * time.Millisecond,
+	})
+
+	dial := func(destination string) (*gws.Conn, int) {
+		header := http.Header{}
+		header.Set(h2mux.CFJumpDestinationHeader, destination)
+		conn, resp, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), header)
+		if err != nil {
+			require.NotNil(t, resp, err)
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, resp.StatusCode
+	}
+
+	connA, status := dial(backendA.Addr().String())
+	assert.Equal(t, http.StatusSwitchingProtocols, status)
+	_, status = dial(backendA.Addr().String())
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	// The other destination has its own cap
+	for i := 0; i < 2; i++ {
+		_, status = dial(backendB.Addr().String())
+		assert.Equal(t, http.StatusSwitchingProtocols, status)
+	}
+	_, status = dial(backendB.Addr().String())
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	// Closing a connection makes room for another
+	connA.Close()
+	assert.Eventually(t, func() bool {
+		conn, status := dial(backendA.Addr().String())
+		if conn != nil {
+			conn.Close()
+		}
+		return status == http.StatusSwitchingProtocols
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDestinationLimiterRelease(t *testing.T) {
+	limiter := newDestinationLimiter(DestinationLimits{Default: 1})
+	assert.True(t, limiter.acquire("a"))
+	assert.False(t, limiter.acquire("a"))
+	limiter.release("a")
+	assert.Empty(t, limiter.active)
+	assert.True(t, limiter.acquire("a"))
+
+	var unlimited *destinationLimiter
+	assert.True(t, unlimited.acquire("a"))
+	unlimited.release("a")
+}
@@ -0,0 +1,86 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var testTokenKey = []byte("0123456789abcdef0123456789abcdef")
+
+type destinationClaims struct {
+	Destination string `json:"destination"`
+}
+
+func signDestinationToken(t *testing.T, key []byte, destination string) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: key}, nil)
+	assert.NoError(t, err)
+	payload, err := json.Marshal(destinationClaims{Destination: destination})
+	assert.NoError(t, err)
+	jws, err := signer.Sign(payload)
+	assert.NoError(t, err)
+	token, err := jws.CompactSerialize()
+	assert.NoError(t, err)
+	return token
+}
+
+func destinationFromTestToken(token string) (string, error) {
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return "", err
+	}
+	payload, err := jws.Verify(testTokenKey)
+	if err != nil {
+		return "", err
+	}
+	var claims destinationClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", err
+	}
+	return claims.Destination, nil
+}
+
+func TestDestinationFromToken(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, "", DefaultStreamHandler, ProxyOptions{DestinationFromToken: destinationFromTestToken})
+
+	header := http.Header{}
+	header.Set(h2mux.CFAccessTokenHeader, signDestinationToken(t, testTokenKey, backend.Addr().String()))
+	conn := dialTestProxy(t, addr, header)
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("ping")))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(message))
+}
+
+func TestDestinationFromTokenRejected(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, "", DefaultStreamHandler, ProxyOptions{DestinationFromToken: destinationFromTestToken})
+
+	tests := map[string]http.Header{
+		"missing token": {
+			h2mux.CFJumpDestinationHeader: {backend.Addr().String()},
+		},
+		"wrong key": {
+			h2mux.CFAccessTokenHeader: {signDestinationToken(t, []byte("fedcba9876543210fedcba9876543210"), backend.Addr().String())},
+		},
+		"malformed token": {
+			h2mux.CFAccessTokenHeader: {"not-a-token"},
+		},
+	}
+	for name, header := range tests {
+		_, resp, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), header)
+		assert.Error(t, err, name)
+		if assert.NotNil(t, resp, name) {
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, name)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflared/logger"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// dualStackListener listens on all IPv4 and IPv6 addresses, skipping the test if IPv6
+// isn't available.
+func dualStackListener(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	}
+	return listener
+}
+
+func TestDialNetwork(t *testing.T) {
+	backend := dualStackListener(t)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, err := net.SplitHostPort(backend.Addr().String())
+	assert.NoError(t, err)
+	ipv4 := net.JoinHostPort("127.0.0.1", port)
+	ipv6 := net.JoinHostPort("::1", port)
+
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	tests := []struct {
+		network     string
+		destination string
+		ok          bool
+	}{
+		{"tcp", ipv4, true},
+		{"tcp", ipv6, true},
+		{"tcp4", ipv4, true},
+		{"tcp4", ipv6, false},
+		{"tcp6", ipv6, true},
+		{"tcp6", ipv4, false},
+	}
+	for _, test := range tests {
+		h := newHandler(logger, test.destination, DefaultStreamHandler, ProxyOptions{DialNetwork: test.network})
+		conn, err := h.dialBackend(context.Background(), h.logger, test.destination)
+		if !test.ok {
+			assert.Error(t, err, "%s should not dial %s", test.network, test.destination)
+			continue
+		}
+		if assert.NoError(t, err, "%s should dial %s", test.network, test.destination) {
+			assert.Equal(t, test.destination, conn.RemoteAddr().String())
+			conn.Close()
+		}
+	}
+}
+
+func TestDiallerDialNetwork(t *testing.T) {
+	listener := dualStackListener(t)
+	remoteAddrC := make(chan string, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrC <- r.RemoteAddr
+		upgrader := gws.Upgrader{}
+		if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+			conn.Close()
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	assert.NoError(t, err)
+	url := fmt.Sprintf("http://%s/", net.JoinHostPort("::1", port))
+
+	dialler, err := NewDialler(DiallerOptions{DialNetwork: "tcp6"})
+	assert.NoError(t, err)
+	conn, _, err := ClientConnect(testRequest(t, url, nil), dialler)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+	host, _, err := net.SplitHostPort(<-remoteAddrC)
+	assert.NoError(t, err)
+	assert.Equal(t, "::1", host)
+
+	dialler, err = NewDialler(DiallerOptions{DialNetwork: "tcp4"})
+	assert.NoError(t, err)
+	_, _, err = ClientConnect(testRequest(t, url, nil), dialler)
+	assert.Error(t, err)
+}
+
+func TestInvalidDialNetwork(t *testing.T) {
+	_, err := NewDialler(DiallerOptions{DialNetwork: "udp"})
+	assert.Error(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	err = StartProxyServerWithOptions(logger, listener, "localhost:22", nil, DefaultStreamHandler, ProxyOptions{DialNetwork: "udp"})
+	assert.Error(t, err)
+}
+
+func TestDestinationParser(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	parser := func(raw string) (string, string, error) {
+		if !strings.HasPrefix(raw, "svc://") {
+			return "", "", fmt.Errorf("not a service URI: %s", raw)
+		}
+		if name := strings.TrimPrefix(raw, "svc://"); name != "echo" {
+			return "", "", fmt.Errorf("unknown service %s", name)
+		}
+		return "tcp", backend.Addr().String(), nil
+	}
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	h := newHandler(logger, "", DefaultStreamHandler, ProxyOptions{DestinationParser: parser})
+
+	conn, err := h.dialBackend(context.Background(), h.logger, "svc://echo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, backend.Addr().String(), conn.RemoteAddr().String())
+		conn.Close()
+	}
+	_, err = h.dialBackend(context.Background(), h.logger, "svc://unknown")
+	assert.EqualError(t, err, "unknown service unknown")
+	_, err = h.dialBackend(context.Background(), h.logger, backend.Addr().String())
+	assert.Error(t, err)
+
+	// Through the proxy
+	addr := startTestProxy(t, "svc://echo", DefaultStreamHandler, ProxyOptions{DestinationParser: parser})
+	wsConn := dialTestProxy(t, addr, nil)
+	assert.NoError(t, wsConn.WriteMessage(gws.BinaryMessage, []byte("parsed")))
+	_, message, err := wsConn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "parsed", string(message))
+}
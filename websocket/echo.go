@@ -0,0 +1,44 @@
+package websocket
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// echoDestination is the destination served by echoing the client's messages when
+// ProxyOptions.EchoBackend is set.
+const echoDestination = "echo:"
+
+// serveEcho upgrades the client's connection and echoes each message it sends back to it,
+// with the same type, until it closes the connection. A close frame from the client is
+// echoed too.
+func (h *handler) serveEcho(w http.ResponseWriter, r *http.Request, tags map[string]string) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeNonWebSocketResponse(w)
+		return
+	}
+	log := h.connectionLogger(tags)
+	conn, handshakeDuration, err := h.upgrade(w, r, h.responseHeader(r))
+	if err != nil {
+		log.Errorf("failed to upgrade: %s", err)
+		return
+	}
+	log.Debugf("Echoing messages from %s", r.RemoteAddr)
+	h.configureCompression(log, conn, r)
+	event := ConnectionEvent{ID: uuid.New().String(), RemoteAddr: r.RemoteAddr, Destination: echoDestination, Tags: tags, HandshakeDuration: handshakeDuration, span: spanFromContext(r.Context())}
+	keepAlive := h.startKeepAlive(log, conn, event.ID)
+	stats := newConnStats()
+	h.connectionOpened(event, stats, conn)
+	defer func() {
+		keepAlive.stop()
+		conn.Close()
+		h.connectionClosed(event, stats, closeReason(keepAlive, false, normalClosure))
+	}()
+
+	proxyMessages(conn, conn, h.readPolicy(), func(n int64) {
+		stats.addToBackend(n)
+		stats.addToClient(n)
+	})
+}
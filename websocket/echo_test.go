@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEchoBackend(t *testing.T) {
+	header := http.Header{}
+	header.Set(h2mux.CFJumpDestinationHeader, echoDestination)
+
+	addr := startTestProxy(t, "", DefaultStreamHandler, ProxyOptions{EchoBackend: true})
+	conn := dialTestProxy(t, addr, header)
+	messages := []struct {
+		messageType int
+		data        []byte
+	}{
+		{gws.TextMessage, []byte("hello")},
+		{gws.BinaryMessage, bytes.Repeat([]byte{0, 1, 2, 0xff}, 16*1024)},
+		{gws.BinaryMessage, []byte{}},
+	}
+	for _, message := range messages {
+		require.NoError(t, conn.WriteMessage(message.messageType, message.data))
+		messageType, echoed, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, message.messageType, messageType)
+		assert.Equal(t, message.data, echoed)
+	}
+
+	// The close frame is echoed too
+	require.NoError(t, conn.WriteMessage(gws.CloseMessage, gws.FormatCloseMessage(gws.CloseNormalClosure, "bye")))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, gws.IsCloseError(err, gws.CloseNormalClosure), err)
+
+	// Without the option, the echo destination is dialed like any other, and fails
+	addr = startTestProxy(t, "", DefaultStreamHandler, ProxyOptions{})
+	_, _, err = gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), header)
+	assert.Error(t, err)
+}
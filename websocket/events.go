@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnectionEvent describes a proxied connection to an EventHandler.
+type ConnectionEvent struct {
+	// ID uniquely identifies the connection.
+	ID string
+	// RemoteAddr is the address of the client.
+	RemoteAddr string
+	// Destination is the backend the connection is proxied to.
+	Destination string
+	// Tags are the tags the client attached to the connection, see ProxyOptions.TagHeaderPrefix.
+	Tags map[string]string
+	// HandshakeDuration is how long the websocket upgrade took, from when the proxy started
+	// the upgrade until the client's connection was upgraded. It doesn't include resolving
+	// the destination or dialing the backend.
+	HandshakeDuration time.Duration
+
+	// span traces the connection, see ProxyOptions.Tracer. It may be nil.
+	span Span
+}
+
+// EventHandler is notified as connections are opened and closed by the proxy. Its methods
+// are called from each connection's goroutine, so they must be safe for concurrent use and
+// should return quickly.
+type EventHandler interface {
+	// ConnectionOpened is called once the client's connection has been upgraded.
+	ConnectionOpened(event ConnectionEvent)
+	// ConnectionClosed is called when the connection ends with the number of bytes proxied
+	// from the client to the backend and from the backend to the client, and how long the
+	// connection was open.
+	ConnectionClosed(event ConnectionEvent, toBackend, toClient int64, duration time.Duration)
+}
+
+// connectionOpened registers a new connection to the client over conn, counted by stats, and
+// notifies the EventHandler of it.
+func (h *handler) connectionOpened(event ConnectionEvent, stats *connStats, conn *websocket.Conn) {
+	stats.wire, _ = conn.UnderlyingConn().(*writeCountingConn)
+	h.connections.add(event, stats, conn)
+	if event.span != nil {
+		event.span.SetAttribute("connection.id", event.ID)
+		event.span.AddEvent("upgraded", nil)
+	}
+	if h.options.EventHandler != nil {
+		h.options.EventHandler.ConnectionOpened(event)
+	}
+}
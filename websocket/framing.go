@@ -0,0 +1,156 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// defaultMaxFramedMessageSize is the default limit on the size of messages read by a
+// MessageFramer.
+const defaultMaxFramedMessageSize = 1024 * 1024
+
+var errFramedMessageTooLarge = errors.New("backend message is larger than the maximum message size")
+
+// LengthPrefix is the format of the length that precedes each message from the backend.
+type LengthPrefix int
+
+const (
+	// LengthPrefixUint32 is a 4 byte big endian length.
+	LengthPrefixUint32 LengthPrefix = iota
+	// LengthPrefixVarint is an unsigned varint length, as used to delimit protocol buffers.
+	LengthPrefixVarint
+)
+
+func (p LengthPrefix) String() string {
+	switch p {
+	case LengthPrefixUint32:
+		return "uint32"
+	case LengthPrefixVarint:
+		return "varint"
+	default:
+		return fmt.Sprintf("length prefix %d", int(p))
+	}
+}
+
+// MessageFramer reads whole length-delimited messages from backends that speak a length
+// prefixed protocol, so that each message is sent to the client as one frame rather than
+// being split wherever the backend's reads happen to end. Frames hold the message with its
+// length prefix, so the data itself is unchanged. Data from the client is passed on as is.
+type MessageFramer struct {
+	// Prefix is the format of the length prefix. Defaults to LengthPrefixUint32.
+	Prefix LengthPrefix
+	// MaxMessageSize bounds the length of a message, not counting its prefix. A longer
+	// message ends the connection. Defaults to 1MB.
+	MaxMessageSize int
+}
+
+func (f *MessageFramer) validate() error {
+	if f.Prefix != LengthPrefixUint32 && f.Prefix != LengthPrefixVarint {
+		return fmt.Errorf("unknown message framer length prefix: %s", f.Prefix)
+	}
+	return nil
+}
+
+// readMessage reads the next message from r, returning it with its length prefix. It
+// returns io.EOF if r ends between messages, and io.ErrUnexpectedEOF if it ends within one.
+func (f *MessageFramer) readMessage(r *bufio.Reader) ([]byte, error) {
+	var prefix []byte
+	var length uint64
+	switch f.Prefix {
+	case LengthPrefixVarint:
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				if err == io.EOF && len(prefix) > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			prefix = append(prefix, b)
+			if b < 0x80 {
+				break
+			}
+			if len(prefix) == binary.MaxVarintLen64 {
+				return nil, errFramedMessageTooLarge
+			}
+		}
+		length, _ = binary.Uvarint(prefix)
+	default:
+		prefix = make([]byte, 4)
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint32(prefix))
+	}
+
+	maxSize := f.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxFramedMessageSize
+	}
+	if length > uint64(maxSize) {
+		return nil, errFramedMessageTooLarge
+	}
+	message := make([]byte, len(prefix)+int(length))
+	copy(message, prefix)
+	if _, err := io.ReadFull(r, message[len(prefix):]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// framingConn is a backend connection whose reads return whole messages read by a
+// MessageFramer, one per read when the caller's buffer is large enough.
+type framingConn struct {
+	net.Conn
+	framer *MessageFramer
+	reader *bufio.Reader
+	// pending holds the rest of a message that didn't fit in the caller's buffer
+	pending []byte
+}
+
+func newFramingConn(conn net.Conn, framer *MessageFramer) *framingConn {
+	return &framingConn{Conn: conn, framer: framer, reader: bufio.NewReader(conn)}
+}
+
+func (c *framingConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		message, err := c.framer.readMessage(c.reader)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = message
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// WriteTo writes each message to w in a single write, whatever its size, so that io.Copy
+// to a Conn sends each message as one frame.
+func (c *framingConn) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for {
+		message := c.pending
+		c.pending = nil
+		if len(message) == 0 {
+			var err error
+			if message, err = c.framer.readMessage(c.reader); err == io.EOF {
+				return total, nil
+			} else if err != nil {
+				return total, err
+			}
+		}
+		n, err := w.Write(message)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lengthPrefixed returns message with a length prefix in the given format.
+func lengthPrefixed(prefix LengthPrefix, message string) []byte {
+	var buf []byte
+	if prefix == LengthPrefixVarint {
+		buf = make([]byte, binary.MaxVarintLen64)
+		buf = buf[:binary.PutUvarint(buf, uint64(len(message)))]
+	} else {
+		buf = make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(len(message)))
+	}
+	return append(buf, message...)
+}
+
+// sendingBackend starts a TCP server that writes data to each connection in one write and
+// then waits for the client to close it.
+func sendingBackend(t *testing.T, data []byte) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(data)
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func TestMessageFramer(t *testing.T) {
+	messages := []string{"first", "", "a longer third message", string(bytes.Repeat([]byte("x"), 200))}
+	for _, prefix := range []LengthPrefix{LengthPrefixUint32, LengthPrefixVarint} {
+		var data []byte
+		for _, message := range messages {
+			data = append(data, lengthPrefixed(prefix, message)...)
+		}
+		backend := sendingBackend(t, data)
+		addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+			MessageFramer:    &MessageFramer{Prefix: prefix},
+			CloseGracePeriod: 10 * time.Millisecond,
+		})
+
+		conn := dialTestProxy(t, addr, nil)
+		for _, message := range messages {
+			messageType, frame, err := conn.ReadMessage()
+			require.NoError(t, err, prefix)
+			assert.Equal(t, gws.BinaryMessage, messageType)
+			assert.Equal(t, lengthPrefixed(prefix, message), frame, prefix)
+		}
+	}
+}
+
+func TestMessageFramerReadMessage(t *testing.T) {
+	framer := &MessageFramer{MaxMessageSize: 8}
+	read := func(data []byte) ([]byte, error) {
+		return framer.readMessage(bufio.NewReader(bytes.NewReader(data)))
+	}
+
+	message, err := read(lengthPrefixed(LengthPrefixUint32, "12345678"))
+	assert.NoError(t, err)
+	assert.Equal(t, lengthPrefixed(LengthPrefixUint32, "12345678"), message)
+
+	_, err = read(lengthPrefixed(LengthPrefixUint32, "123456789"))
+	assert.Equal(t, errFramedMessageTooLarge, err)
+
+	_, err = read(nil)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = read(lengthPrefixed(LengthPrefixUint32, "trunc")[:6])
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	framer.Prefix = LengthPrefixVarint
+	_, err = read([]byte{0x80})
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	assert.Error(t, (&ProxyOptions{MessageFramer: &MessageFramer{}, CoalesceDelay: time.Millisecond}).validate())
+	assert.Error(t, (&ProxyOptions{MessageFramer: &MessageFramer{Prefix: 7}}).validate())
+}
@@ -0,0 +1,35 @@
+package websocket
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketKeyLength is the length of the decoded Sec-WebSocket-Key nonce, see RFC 6455
+// section 4.1.
+const websocketKeyLength = 16
+
+// validWebsocketKey reports whether the request has exactly one Sec-WebSocket-Key, the
+// base64 encoding of a 16 byte nonce. gorilla only checks that the key is present.
+func validWebsocketKey(r *http.Request) bool {
+	keys := r.Header.Values("Sec-Websocket-Key")
+	if len(keys) != 1 {
+		return false
+	}
+	nonce, err := base64.StdEncoding.DecodeString(keys[0])
+	return err == nil && len(nonce) == websocketKeyLength
+}
+
+// rejectMalformedKey responds with 400 to upgrade requests with a malformed
+// Sec-WebSocket-Key when ProxyOptions.StrictHandshakeValidation is set, reporting whether
+// it did. Requests that aren't upgrades are left to the handler.
+func (h *handler) rejectMalformedKey(w http.ResponseWriter, r *http.Request) bool {
+	if !h.options.StrictHandshakeValidation || !websocket.IsWebSocketUpgrade(r) || validWebsocketKey(r) {
+		return false
+	}
+	h.logger.Debugf("Rejecting upgrade from %s: malformed Sec-WebSocket-Key", r.RemoteAddr)
+	http.Error(w, "malformed Sec-WebSocket-Key", http.StatusBadRequest)
+	return true
+}
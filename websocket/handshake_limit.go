@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrResponseHeaderTooLarge is returned when dialing an origin whose handshake response is
+// larger than the dialler's MaxResponseHeaderBytes.
+var ErrResponseHeaderTooLarge = errors.New("websocket handshake response headers are too large")
+
+// handshakeLimitConn fails reads once more than limit bytes have been read, until the
+// handshake is finished.
+type handshakeLimitConn struct {
+	net.Conn
+	remaining int64
+	finished  int32
+}
+
+func (c *handshakeLimitConn) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.finished) == 1 {
+		return c.Conn.Read(p)
+	}
+	if c.remaining <= 0 {
+		return 0, ErrResponseHeaderTooLarge
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.Conn.Read(p)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// finishHandshake lifts the read limit.
+func (c *handshakeLimitConn) finishHandshake() {
+	atomic.StoreInt32(&c.finished, 1)
+}
+
+// dialWrapped dials the origin over a connection wrapped to limit how much of the handshake
+// response is read and to supply masking keys, as configured. gorilla would count the TLS
+// handshake towards the limit, and have its frames encrypted before they could be re-masked,
+// if it set up TLS over the wrapped connection, so for wss origins the TLS handshake is done
+// here and gorilla is asked to speak plain ws over the TLS connection.
+func (dd *defaultDialler) dialWrapped(d *websocket.Dialer, originURL *url.URL, header http.Header) (*websocket.Conn, *http.Response, error) {
+	dialURL := *originURL
+	addr := originURL.Host
+	useTLS := originURL.Scheme == "wss"
+	if originURL.Port() == "" {
+		port := "80"
+		if useTLS {
+			port = "443"
+		}
+		addr = net.JoinHostPort(originURL.Hostname(), port)
+	}
+	if useTLS {
+		dialURL.Scheme = "ws"
+		// Keep the Host gorilla would have sent for the wss URL
+		if header.Get("Host") == "" {
+			header = header.Clone()
+			header.Set("Host", originURL.Host)
+		}
+	}
+
+	var (
+		limited *handshakeLimitConn
+		masking *maskingConn
+	)
+	d.NetDialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		conn, err := dd.dialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if useTLS {
+			tlsConfig := &tls.Config{}
+			if dd.tlsConfig != nil {
+				tlsConfig = dd.tlsConfig.Clone()
+			}
+			if tlsConfig.ServerName == "" {
+				tlsConfig.ServerName = originURL.Hostname()
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		if dd.maxResponseHeaderBytes > 0 {
+			limited = &handshakeLimitConn{Conn: conn, remaining: dd.maxResponseHeaderBytes}
+			conn = limited
+		}
+		if dd.maskingKeys != nil {
+			masking = &maskingConn{Conn: conn, keys: dd.maskingKeys}
+			conn = masking
+		}
+		return conn, nil
+	}
+
+	wsConn, resp, err := d.Dial(dialURL.String(), header)
+	if err != nil {
+		return nil, resp, err
+	}
+	if limited != nil {
+		limited.finishHandshake()
+	}
+	if masking != nil {
+		masking.finishHandshake()
+	}
+	return wsConn, resp, nil
+}
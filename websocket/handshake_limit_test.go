@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflared/hello"
+	"github.com/cloudflare/cloudflared/logger"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// oversizedHeaderOrigin accepts one handshake and replies with a response carrying a header
+// of headerSize bytes.
+func oversizedHeaderOrigin(t *testing.T, headerSize int) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\nX-Padding: %s\r\n\r\n", generateAcceptKey(req), strings.Repeat("a", headerSize))
+	}()
+	return listener
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	origin := oversizedHeaderOrigin(t, 64*1024)
+	defer origin.Close()
+
+	dialler, err := NewDialler(DiallerOptions{MaxResponseHeaderBytes: 4096})
+	assert.NoError(t, err)
+	req := testRequest(t, fmt.Sprintf("http://%s/", origin.Addr()), nil)
+	_, _, err = ClientConnect(req, dialler)
+	assert.Equal(t, ErrResponseHeaderTooLarge, err)
+}
+
+func TestMaxResponseHeaderBytesWithinLimit(t *testing.T) {
+	origin := oversizedHeaderOrigin(t, 1024)
+	defer origin.Close()
+
+	dialler, err := NewDialler(DiallerOptions{MaxResponseHeaderBytes: 4096})
+	assert.NoError(t, err)
+	req := testRequest(t, fmt.Sprintf("http://%s/", origin.Addr()), nil)
+	conn, resp, err := ClientConnect(req, dialler)
+	if assert.NoError(t, err) {
+		conn.Close()
+		assert.Len(t, resp.Header.Get("X-Padding"), 1024)
+	}
+}
+
+func TestMaxResponseHeaderBytesTLS(t *testing.T) {
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	listener, err := hello.CreateTLSListener("localhost:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go hello.StartHelloWorldServer(logger, listener, shutdownC)
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	assert.NoError(t, err)
+	dialler, err := NewDialler(DiallerOptions{
+		TLSConfig:              websocketClientTLSConfig(t),
+		MaxResponseHeaderBytes: 4096,
+	})
+	assert.NoError(t, err)
+	req := testRequest(t, fmt.Sprintf("https://localhost:%s/ws", port), nil)
+	conn, _, err := ClientConnect(req, dialler)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// Data after the handshake isn't limited
+	message := make([]byte, 16*1024)
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, message))
+	_, echoed, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, message, echoed)
+}
@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+// keepAlive pings the client and expects its pongs within the pong wait, failing reads from
+// the connection if they stop.
+type keepAlive struct {
+	pongWait time.Duration
+	// lastPong is when the client last answered a ping, or when the connection was upgraded,
+	// in Unix nanoseconds
+	lastPong int64
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// startKeepAlive starts pinging the client on conn, whose connection ID is logged if a ping
+// fails. The returned keepAlive must be stopped when the connection ends.
+func (h *handler) startKeepAlive(log logger.Service, conn *websocket.Conn, connectionID string) *keepAlive {
+	k := &keepAlive{
+		pongWait: h.options.PongWait,
+		lastPong: time.Now().UnixNano(),
+		done:     make(chan struct{}),
+	}
+	conn.SetReadDeadline(time.Now().Add(k.pongWait))
+	conn.SetPongHandler(func(payload string) error {
+		now := time.Now()
+		atomic.StoreInt64(&k.lastPong, now.UnixNano())
+		if rtt, ok := pongRTT(payload, now, k.pongWait); ok {
+			pingRTT.Observe(rtt.Seconds())
+		}
+		conn.SetReadDeadline(time.Now().Add(k.pongWait))
+		return nil
+	})
+	go pinger(log, conn, connectionID, k.done, k.pongWait*9/10)
+	return k
+}
+
+// stop stops pinging the client. It doesn't block, as the pinger may already have returned
+// on its own once the connection closed.
+func (k *keepAlive) stop() {
+	k.stopOnce.Do(func() { close(k.done) })
+}
+
+// idle reports whether the client has gone the pong wait without answering a ping.
+func (k *keepAlive) idle() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&k.lastPong))) >= k.pongWait
+}
+
+// pingPayloadSize is the size of the timestamp sent in each ping.
+const pingPayloadSize = 8
+
+// pingPayload returns the payload of a ping sent at now: its time in Unix nanoseconds, big
+// endian, which clients echo in their pong so the round trip can be measured.
+func pingPayload(now time.Time) []byte {
+	payload := make([]byte, pingPayloadSize)
+	binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+	return payload
+}
+
+// pongRTT returns the round trip time of the ping answered by a pong with payload, received
+// at now. ok is false for pongs that don't echo a ping's timestamp, such as unsolicited
+// pongs, and for timestamps in the future or older than maxRTT, which no ping that was
+// answered in time could have.
+func pongRTT(payload string, now time.Time, maxRTT time.Duration) (rtt time.Duration, ok bool) {
+	if len(payload) != pingPayloadSize {
+		return 0, false
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(payload))))
+	rtt = now.Sub(sent)
+	if rtt < 0 || rtt > maxRTT {
+		return 0, false
+	}
+	return rtt, true
+}
@@ -0,0 +1,185 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var errBackendConnClosed = errors.New("backend connection closed before it was dialed")
+
+// lazyBackendConn is a backend connection that isn't dialed until the first write to it,
+// which is when the client first sends data. Reads block until then. If the connection is
+// closed before it is dialed, the backend is never dialed and reads return io.EOF. Deadlines
+// set before the dial apply to the reads and writes waiting for it, and to the connection
+// once it is dialed.
+type lazyBackendConn struct {
+	dial        func() (net.Conn, error)
+	destination string
+	dialOnce    sync.Once
+	dialed      chan struct{}
+	closeOnce   sync.Once
+	closed      chan struct{}
+
+	lock          sync.Mutex
+	isClosed      bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// readDeadlineSet is closed and replaced whenever the read deadline changes, waking up
+	// reads waiting for the dial
+	readDeadlineSet chan struct{}
+	// conn and err are set by the dial, before dialed is closed
+	conn net.Conn
+	err  error
+}
+
+func newLazyBackendConn(destination string, dial func() (net.Conn, error)) *lazyBackendConn {
+	return &lazyBackendConn{
+		dial:        dial,
+		destination: destination,
+		dialed:      make(chan struct{}),
+		closed:      make(chan struct{}),
+
+		readDeadlineSet: make(chan struct{}),
+	}
+}
+
+// connect dials the backend the first time it is called, and returns the result of that dial.
+func (c *lazyBackendConn) connect() (net.Conn, error) {
+	c.dialOnce.Do(func() {
+		defer close(c.dialed)
+		conn, err := c.dial()
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if err == nil && c.isClosed {
+			conn.Close()
+			conn, err = nil, errBackendConnClosed
+		}
+		if err == nil {
+			conn.SetReadDeadline(c.readDeadline)
+			conn.SetWriteDeadline(c.writeDeadline)
+		}
+		c.conn, c.err = conn, err
+	})
+	return c.conn, c.err
+}
+
+// connected returns the backend connection if it has been dialed successfully.
+func (c *lazyBackendConn) connected() net.Conn {
+	select {
+	case <-c.dialed:
+		return c.conn
+	default:
+		return nil
+	}
+}
+
+func (c *lazyBackendConn) Read(p []byte) (int, error) {
+	for {
+		c.lock.Lock()
+		deadline, deadlineSet := c.readDeadline, c.readDeadlineSet
+		c.lock.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case <-c.dialed:
+		case <-c.closed:
+		case <-timeout:
+		case <-deadlineSet:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		// Once dialed, the connection applies the deadline itself
+		select {
+		case <-c.dialed:
+			if c.err != nil {
+				return 0, c.err
+			}
+			return c.conn.Read(p)
+		case <-c.closed:
+			return 0, io.EOF
+		default:
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *lazyBackendConn) Write(p []byte) (int, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Write(p)
+}
+
+func (c *lazyBackendConn) Close() error {
+	c.lock.Lock()
+	c.isClosed = true
+	c.lock.Unlock()
+	c.closeOnce.Do(func() { close(c.closed) })
+	if conn := c.connected(); conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+func (c *lazyBackendConn) LocalAddr() net.Addr {
+	if conn := c.connected(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return backendAddr("")
+}
+
+func (c *lazyBackendConn) RemoteAddr() net.Addr {
+	if conn := c.connected(); conn != nil {
+		return conn.RemoteAddr()
+	}
+	return backendAddr(c.destination)
+}
+
+func (c *lazyBackendConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline and SetWriteDeadline apply the deadline under the lock, so that it can't
+// race with the dial applying the deadlines set before it.
+func (c *lazyBackendConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	close(c.readDeadlineSet)
+	c.readDeadlineSet = make(chan struct{})
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *lazyBackendConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeDeadline = t
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// backendAddr is the address of a backend that hasn't been dialed yet.
+type backendAddr string
+
+func (a backendAddr) Network() string { return "tcp" }
+func (a backendAddr) String() string  { return string(a) }
@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lazyDialOptions returns proxy options with lazy dialing that count the backend dials.
+func lazyDialOptions(dials *int32, events EventHandler) ProxyOptions {
+	return ProxyOptions{
+		LazyBackendDial: true,
+		DialBackend: func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(dials, 1)
+			return new(net.Dialer).DialContext(ctx, network, address)
+		},
+		EventHandler:     events,
+		CloseGracePeriod: 10 * time.Millisecond,
+	}
+}
+
+func TestLazyBackendDial(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	var dials int32
+	events := newRecordingEventHandler()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, lazyDialOptions(&dials, events))
+
+	conn := dialTestProxy(t, addr, nil)
+	<-events.opened
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials))
+
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("client speaks first")))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "client speaks first", string(message))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+}
+
+func TestLazyBackendDialClientOnlyReads(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	var dials int32
+	events := newRecordingEventHandler()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, lazyDialOptions(&dials, events))
+
+	conn := dialTestProxy(t, addr, nil)
+	<-events.opened
+	conn.Close()
+
+	select {
+	case <-events.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials))
+}
+
+func TestLazyBackendReadDeadline(t *testing.T) {
+	release := make(chan struct{})
+	backend, other := net.Pipe()
+	defer other.Close()
+	conn := newLazyBackendConn("backend", func() (net.Conn, error) {
+		<-release
+		return backend, nil
+	})
+	defer conn.Close()
+	go conn.Write([]byte("dial"))
+
+	// A deadline set while the dial is pending ends the read waiting for it
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, err := conn.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+
+	// as does one set while the read is waiting, which is how reads are interrupted
+	assert.NoError(t, conn.SetReadDeadline(time.Time{}))
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, conn.SetReadDeadline(time.Now()))
+	select {
+	case err := <-readErr:
+		assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read wasn't interrupted by the deadline")
+	}
+
+	// The deadline applies to the connection once it is dialed
+	close(release)
+	go io.Copy(ioutil.Discard, other)
+	require.Eventually(t, func() bool { return conn.connected() != nil }, 5*time.Second, time.Millisecond)
+	_, err = conn.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+}
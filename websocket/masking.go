@@ -0,0 +1,80 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+var errUnexpectedFrameWrite = errors.New("write is not a single masked websocket frame")
+
+// maskingConn re-masks the frames a client writes with keys read from keys, once the
+// handshake is finished. gorilla masks client frames with keys from crypto/rand and has no
+// way to replace them, but writes each client frame whole in a single Write, so the frame can
+// be unmasked and masked again here.
+type maskingConn struct {
+	net.Conn
+	keys     io.Reader
+	finished int32
+}
+
+func (c *maskingConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.finished) == 0 {
+		return c.Conn.Write(p)
+	}
+	keyOffset, err := maskingKeyOffset(p)
+	if err != nil {
+		return 0, err
+	}
+	var key [4]byte
+	if _, err := io.ReadFull(c.keys, key[:]); err != nil {
+		return 0, err
+	}
+	frame := make([]byte, len(p))
+	copy(frame, p)
+	oldKey := p[keyOffset : keyOffset+4]
+	copy(frame[keyOffset:], key[:])
+	payload := frame[keyOffset+4:]
+	for i := range payload {
+		payload[i] ^= oldKey[i%4] ^ key[i%4]
+	}
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// finishHandshake starts re-masking writes.
+func (c *maskingConn) finishHandshake() {
+	atomic.StoreInt32(&c.finished, 1)
+}
+
+// maskingKeyOffset returns the offset of the masking key in frame, checking that frame is
+// exactly one masked frame.
+func maskingKeyOffset(frame []byte) (int, error) {
+	if len(frame) < 2 || frame[1]&0x80 == 0 {
+		return 0, errUnexpectedFrameWrite
+	}
+	offset := 2
+	length := uint64(frame[1] & 0x7f)
+	switch length {
+	case 126:
+		if len(frame) < offset+2 {
+			return 0, errUnexpectedFrameWrite
+		}
+		length = uint64(binary.BigEndian.Uint16(frame[offset:]))
+		offset += 2
+	case 127:
+		if len(frame) < offset+8 {
+			return 0, errUnexpectedFrameWrite
+		}
+		length = binary.BigEndian.Uint64(frame[offset:])
+		offset += 8
+	}
+	if uint64(len(frame)) != uint64(offset)+4+length {
+		return 0, errUnexpectedFrameWrite
+	}
+	return offset, nil
+}
@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureFirstFrame accepts one websocket handshake on listener and returns the raw bytes of
+// the first frame the client sends.
+func captureFirstFrame(listener net.Listener, frameLen int) <-chan []byte {
+	frames := make(chan []byte, 1)
+	go func() {
+		defer close(frames)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", generateAcceptKey(req))
+		frame := make([]byte, frameLen)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return
+		}
+		frames <- frame
+	}()
+	return frames
+}
+
+func TestMaskingKeys(t *testing.T) {
+	message := []byte("hello")
+	send := func() []byte {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		frames := captureFirstFrame(listener, 2+4+len(message))
+
+		dialler, err := NewDialler(DiallerOptions{MaskingKeys: bytes.NewReader([]byte{1, 2, 3, 4})})
+		require.NoError(t, err)
+		conn, _, err := dialler.Dial(&url.URL{Scheme: "ws", Host: listener.Addr().String()}, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, message))
+		return <-frames
+	}
+
+	expected := []byte{0x81, 0x80 | byte(len(message)), 1, 2, 3, 4}
+	for i, b := range message {
+		expected = append(expected, b^byte(i%4+1))
+	}
+	assert.Equal(t, expected, send())
+	assert.Equal(t, expected, send())
+}
+
+func TestMaskingKeysExhausted(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	captureFirstFrame(listener, 1)
+
+	dialler, err := NewDialler(DiallerOptions{MaskingKeys: bytes.NewReader(nil)})
+	require.NoError(t, err)
+	conn, _, err := dialler.Dial(&url.URL{Scheme: "ws", Host: listener.Addr().String()}, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Error(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+}
@@ -0,0 +1,196 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errMemoryBudgetExceeded refuses messages that don't fit in ProxyOptions.MemoryBudget.
+var errMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+// memoryBudget accounts for the memory buffered by every connection, see
+// ProxyOptions.MemoryBudget. A nil budget is unlimited.
+type memoryBudget struct {
+	limit int64
+
+	lock     sync.Mutex
+	used     int64
+	accounts map[*memoryAccount]struct{}
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit, accounts: make(map[*memoryAccount]struct{})}
+}
+
+// admit reserves cost for a new connection, returning the connection's account, or false if
+// the connection doesn't fit in the budget.
+func (b *memoryBudget) admit(cost int64) (*memoryAccount, bool) {
+	if b == nil {
+		return nil, true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.used+cost > b.limit {
+		return nil, false
+	}
+	a := &memoryAccount{budget: b, used: cost}
+	b.used += cost
+	b.accounts[a] = struct{}{}
+	return a, true
+}
+
+// setLimit changes the budget's limit. Connections already admitted keep their reservations,
+// so lowering it only refuses what is admitted or buffered from then on.
+func (b *memoryBudget) setLimit(limit int64) {
+	b.lock.Lock()
+	b.limit = limit
+	b.lock.Unlock()
+}
+
+// memoryAccount is the memory a connection has buffered. A nil account is unlimited.
+type memoryAccount struct {
+	budget *memoryBudget
+	// used, shed and shedding are guarded by the budget's lock
+	used int64
+	// shed closes the connection to make room for others, once it has been upgraded
+	shed     func()
+	shedding bool
+}
+
+// onShed sets how to close the connection when it is the heaviest in an exhausted budget.
+func (a *memoryAccount) onShed(shed func()) {
+	if a == nil {
+		return
+	}
+	a.budget.lock.Lock()
+	a.shed = shed
+	a.budget.lock.Unlock()
+}
+
+// reserve charges n buffered bytes to the account. When they don't fit in the budget, the
+// connection that has buffered the most is closed to make room. If that is this connection,
+// reserve returns false and the bytes must not be buffered. Otherwise they are charged
+// straight away, so the budget is exceeded until the other connection has closed.
+func (a *memoryAccount) reserve(n int64) bool {
+	if a == nil {
+		return true
+	}
+	b := a.budget
+	b.lock.Lock()
+	if b.used+n > b.limit {
+		heaviest := a
+		for other := range b.accounts {
+			if other.shed != nil && !other.shedding && other.used > heaviest.used {
+				heaviest = other
+			}
+		}
+		if heaviest == a {
+			b.lock.Unlock()
+			return false
+		}
+		heaviest.shedding = true
+		defer heaviest.shed()
+	}
+	a.used += n
+	b.used += n
+	b.lock.Unlock()
+	return true
+}
+
+// release returns n bytes charged with reserve to the budget.
+func (a *memoryAccount) release(n int64) {
+	if a == nil {
+		return
+	}
+	a.budget.lock.Lock()
+	a.used -= n
+	a.budget.used -= n
+	a.budget.lock.Unlock()
+}
+
+// close returns everything the connection holds to the budget.
+func (a *memoryAccount) close() {
+	if a == nil {
+		return
+	}
+	b := a.budget
+	b.lock.Lock()
+	b.used -= a.used
+	a.used = 0
+	delete(b.accounts, a)
+	b.lock.Unlock()
+}
+
+// connectionMemory estimates the memory each connection holds for its lifetime: the
+// websocket read and write buffers, the buffers streaming data in each direction, and the
+// write coalescing buffer.
+func (h *handler) connectionMemory() int64 {
+	readBuffer, writeBuffer := h.upgrader.ReadBufferSize, h.upgrader.WriteBufferSize
+	if readBuffer <= 0 {
+		readBuffer = defaultGorillaBufferSize
+	}
+	if writeBuffer <= 0 {
+		writeBuffer = defaultGorillaBufferSize
+	}
+	cost := int64(readBuffer + writeBuffer + 2*streamBufferSize)
+	if h.options.CoalesceDelay > 0 {
+		coalesceSize := h.options.CoalesceSize
+		if coalesceSize <= 0 {
+			coalesceSize = defaultCoalesceSize
+		}
+		cost += int64(coalesceSize)
+	}
+	return cost
+}
+
+// shedConnection returns a function that closes the connection with id with 1013 (try again
+// later), for memoryAccount.onShed.
+func (h *handler) shedConnection(id string) func() {
+	return func() {
+		h.logger.Infof("Closing websocket connection %s to stay within the memory budget", id)
+		h.connections.close(id, websocket.CloseTryAgainLater, errMemoryBudgetExceeded.Error(), h.options.CloseGracePeriod)
+	}
+}
+
+// accountedReader charges the bytes read from a message to a memory account.
+type accountedReader struct {
+	io.Reader
+	account *memoryAccount
+	charged int64
+}
+
+func (r *accountedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if !r.account.reserve(int64(n)) {
+			return 0, errMemoryBudgetExceeded
+		}
+		r.charged += int64(n)
+	}
+	return n, err
+}
+
+// readMessage reads a message from conn in full, charging it to the policy's memory account.
+// The caller must release the message's length from the account once it is done with it.
+// Messages that don't fit in the memory budget close conn with 1013 (try again later).
+func (p readPolicy) readMessage(conn *websocket.Conn, r io.Reader) ([]byte, error) {
+	if p.memory == nil {
+		return ioutil.ReadAll(r)
+	}
+	accounted := &accountedReader{Reader: r, account: p.memory}
+	message, err := ioutil.ReadAll(accounted)
+	if err != nil {
+		p.memory.release(accounted.charged)
+		if err == errMemoryBudgetExceeded {
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+			conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait))
+		}
+		return nil, err
+	}
+	return message, nil
+}
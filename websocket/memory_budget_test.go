@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBudgetAdmission(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	cost := newHandler(&testLogger{}, "", DefaultStreamHandler, ProxyOptions{}).connectionMemory()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{MemoryBudget: cost})
+
+	first := dialTestProxy(t, addr, nil)
+	_, resp, err := gws.DefaultDialer.Dial("ws://"+addr, nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	// Closing the first connection makes room for another
+	first.Close()
+	require.Eventually(t, func() bool {
+		conn, _, err := gws.DefaultDialer.Dial("ws://"+addr, nil)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryBudgetMessages(t *testing.T) {
+	// The stream handler reads each message in full with Read, and sends it back
+	echoMessages := func(wsConn *Conn, _ net.Conn, _ http.Header) {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := wsConn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := wsConn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+	backend := echoBackend(t)
+	defer backend.Close()
+	cost := newHandler(&testLogger{}, "", DefaultStreamHandler, ProxyOptions{}).connectionMemory()
+	addr := startTestProxy(t, backend.Addr().String(), echoMessages, ProxyOptions{MemoryBudget: cost + 1024})
+	conn := dialTestProxy(t, addr, nil)
+
+	small := []byte("fits in the budget")
+	require.NoError(t, conn.WriteMessage(gws.BinaryMessage, small))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, small, message)
+
+	require.NoError(t, conn.WriteMessage(gws.BinaryMessage, bytes.Repeat([]byte("x"), 4096)))
+	_, _, err = conn.ReadMessage()
+	code, ok := CloseCode(err)
+	require.True(t, ok, err)
+	assert.Equal(t, gws.CloseTryAgainLater, code)
+}
+
+func TestMemoryBudgetShedsHeaviest(t *testing.T) {
+	budget := newMemoryBudget(100)
+	light, ok := budget.admit(10)
+	require.True(t, ok)
+	heavy, ok := budget.admit(10)
+	require.True(t, ok)
+	var shed []string
+	light.onShed(func() { shed = append(shed, "light") })
+	heavy.onShed(func() { shed = append(shed, "heavy") })
+
+	assert.True(t, heavy.reserve(50))
+	assert.Empty(t, shed)
+	// The heavy connection is closed to make room for the light one's message
+	assert.True(t, light.reserve(40))
+	assert.Equal(t, []string{"heavy"}, shed)
+	// The light connection is now the heaviest, so its own message is refused
+	assert.False(t, light.reserve(40))
+	assert.Equal(t, []string{"heavy"}, shed)
+
+	heavy.close()
+	assert.True(t, light.reserve(40))
+	light.close()
+	assert.Zero(t, budget.used)
+}
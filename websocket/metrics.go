@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The connection package imports this one, so its metrics namespace can't be used here.
+const (
+	metricsNamespace = "cloudflared"
+	metricsSubsystem = "websocket"
+)
+
+// Values of the side label of the handshake duration metric.
+const (
+	handshakeServer  = "server"
+	handshakeClient  = "client"
+	handshakeBackend = "backend"
+)
+
+var (
+	oversizedMessages = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "oversized_messages",
+			Help:      "Count of messages read from clients that were larger than the read buffer, which can guide tuning the read buffer size",
+		},
+	)
+	connectionsClosed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "connections_closed_total",
+			Help:      "Count of proxied connections that ended, by why they ended: normal, backend_error, timeout (the backend timed out), idle (the client stopped answering pings) or session_expired",
+		},
+		[]string{"reason"},
+	)
+	handshakeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "handshake_duration_seconds",
+			Help:      "How long websocket handshakes took, by side: server (upgrading a client's connection), client (dialing and handshaking with ClientConnect) or backend (the proxy handshaking with a websocket backend or upstream proxy)",
+			Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+		},
+		[]string{"side"},
+	)
+	pingRTT = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "ping_rtt_seconds",
+			Help:      "Round trip time of keepalive pings to clients, measured from the timestamp each ping carries, which clients echo in their pong",
+			Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		oversizedMessages,
+		connectionsClosed,
+		handshakeDuration,
+		pingRTT,
+	)
+}
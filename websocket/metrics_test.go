@@ -0,0 +1,185 @@
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// counterValue returns the value of the registered counter with the given full name.
+func counterValue(t *testing.T, name string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	t.Fatalf("counter %s isn't registered", name)
+	return 0
+}
+
+// labelledCounterValue returns the value of the registered counter with the given full name
+// and label value, or zero if it hasn't been incremented.
+func labelledCounterValue(t *testing.T, name, label, value string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == label && pair.GetValue() == value {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestOversizedMessagesCounter(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{ReadBufferSize: 1024})
+	conn := dialTestProxy(t, addr, nil)
+
+	send := func(size int) {
+		message := bytes.Repeat([]byte("x"), size)
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, message))
+		received := 0
+		for received < size {
+			_, echoed, err := conn.ReadMessage()
+			if !assert.NoError(t, err) {
+				return
+			}
+			received += len(echoed)
+		}
+	}
+
+	before := counterValue(t, "cloudflared_websocket_oversized_messages")
+	send(100)
+	assert.Equal(t, before, counterValue(t, "cloudflared_websocket_oversized_messages"))
+	send(4000)
+	assert.Equal(t, before+1, counterValue(t, "cloudflared_websocket_oversized_messages"))
+}
+
+func TestConnectionsClosedCounter(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{PongWait: 100 * time.Millisecond, CloseGracePeriod: 10 * time.Millisecond})
+	idle := func() float64 {
+		return labelledCounterValue(t, "cloudflared_websocket_connections_closed_total", "reason", closeReasonIdle)
+	}
+	before := idle()
+
+	// The client never reads, so it never answers the proxy's pings
+	dialTestProxy(t, addr, nil)
+	assert.Eventually(t, func() bool { return idle() == before+1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+// labelledHistogramSamples returns the sample count and sum of the registered histogram with
+// the given full name and label value, or zeros if it hasn't observed anything.
+func labelledHistogramSamples(t *testing.T, name, label, value string) (uint64, float64) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == label && pair.GetValue() == value {
+					return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+				}
+			}
+		}
+	}
+	return 0, 0
+}
+
+// histogramSamples returns the sample count and sum of the registered histogram with the
+// given full name.
+func histogramSamples(t *testing.T, name string) (uint64, float64) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetHistogram().GetSampleCount(), family.GetMetric()[0].GetHistogram().GetSampleSum()
+		}
+	}
+	t.Fatalf("histogram %s isn't registered", name)
+	return 0, 0
+}
+
+func TestHandshakeDuration(t *testing.T) {
+	const metric = "cloudflared_websocket_handshake_duration_seconds"
+	backend := echoBackend(t)
+	defer backend.Close()
+	events := newRecordingEventHandler()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{EventHandler: events, CloseGracePeriod: 10 * time.Millisecond})
+
+	serverBefore, _ := labelledHistogramSamples(t, metric, "side", handshakeServer)
+	clientBefore, _ := labelledHistogramSamples(t, metric, "side", handshakeClient)
+	req := testRequest(t, fmt.Sprintf("http://%s/", addr), nil)
+	conn, _, err := ClientConnect(req, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	opened := <-events.opened
+	assert.True(t, opened.HandshakeDuration >= 0)
+	serverAfter, serverSum := labelledHistogramSamples(t, metric, "side", handshakeServer)
+	assert.Equal(t, serverBefore+1, serverAfter)
+	assert.True(t, serverSum >= 0)
+	clientAfter, clientSum := labelledHistogramSamples(t, metric, "side", handshakeClient)
+	assert.Equal(t, clientBefore+1, clientAfter)
+	assert.True(t, clientSum >= 0)
+}
+
+func TestPingRTT(t *testing.T) {
+	const metric = "cloudflared_websocket_ping_rtt_seconds"
+	server, client := websocketPair(t)
+	// Reading lets gorilla answer pings, and the server's pong handler run
+	for _, conn := range []*gws.Conn{server, client} {
+		go func(conn *gws.Conn) {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+
+	before, _ := histogramSamples(t, metric)
+	h := newHandler(&testLogger{}, "", DefaultStreamHandler, ProxyOptions{PongWait: 100 * time.Millisecond})
+	keepAlive := h.startKeepAlive(&testLogger{}, server, "test")
+	defer keepAlive.stop()
+	require.Eventually(t, func() bool {
+		count, _ := histogramSamples(t, metric)
+		return count > before
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPongRTT(t *testing.T) {
+	now := time.Now()
+	rtt, ok := pongRTT(string(pingPayload(now.Add(-20*time.Millisecond))), now, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 20*time.Millisecond, rtt)
+
+	for name, payload := range map[string]string{
+		"empty":           "",
+		"not a timestamp": "hello",
+		"future":          string(pingPayload(now.Add(time.Second))),
+		"too old":         string(pingPayload(now.Add(-time.Minute))),
+	} {
+		_, ok := pongRTT(payload, now, time.Second)
+		assert.False(t, ok, name)
+	}
+}
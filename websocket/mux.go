@@ -0,0 +1,377 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+// Mux frame types. Each binary message on a multiplexed websocket is one mux frame: a 4 byte
+// big endian stream ID, a 1 byte frame type, then the frame's payload.
+const (
+	// MuxFrameData carries stream data in its payload.
+	MuxFrameData byte = iota
+	// MuxFrameOpen opens a stream to the destination in its payload, if the proxy's resolver
+	// allows it, see StreamResolver. An empty payload uses the destination the resolver
+	// resolves the websocket's request to.
+	MuxFrameOpen
+	// MuxFrameClose closes a stream. It has no payload.
+	MuxFrameClose
+)
+
+const (
+	muxHeaderSize = 5
+	muxReadSize   = 32 * 1024
+	// muxStreamQueue is the number of frames of the client's data queued for each stream.
+	muxStreamQueue = 16
+
+	// Default number of streams that can be open at once on each multiplexed connection.
+	defaultMaxMuxStreams = 128
+)
+
+var (
+	// errStreamDestinationNotAllowed refuses streams opened to a destination of the client's
+	// choosing when the resolver isn't a StreamResolver.
+	errStreamDestinationNotAllowed = errors.New("the resolver doesn't allow choosing the destination of streams")
+	// errStreamDestinationLimit refuses streams to a destination at its DestinationLimits cap.
+	errStreamDestinationLimit = errors.New("too many connections to the destination")
+)
+
+// EncodeMuxFrame returns the mux frame for streamID, to send as a binary message.
+func EncodeMuxFrame(streamID uint32, frameType byte, payload []byte) []byte {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, streamID)
+	frame[4] = frameType
+	copy(frame[muxHeaderSize:], payload)
+	return frame
+}
+
+// DecodeMuxFrame splits a binary message into its mux frame's stream ID, type and payload.
+// ok is false if the message is too short to be a mux frame.
+func DecodeMuxFrame(message []byte) (streamID uint32, frameType byte, payload []byte, ok bool) {
+	if len(message) < muxHeaderSize {
+		return 0, 0, nil, false
+	}
+	return binary.BigEndian.Uint32(message), message[4], message[muxHeaderSize:], true
+}
+
+// StartMuxProxyServer starts a websocket proxy that multiplexes many backend connections over
+// each client websocket, similar in spirit to h2mux but without flow control. The client opens
+// streams with MuxFrameOpen, sends data with MuxFrameData and closes them with MuxFrameClose,
+// and the proxy sends the backends' data and closes back with the same stream IDs.
+// Each stream's destination is resolved like the destination of a connection to the proxy:
+// streams opened without a destination are proxied to the one the resolver returns for the
+// websocket's request, and streams to a destination of the client's choosing are refused
+// unless the resolver is a StreamResolver that allows it. MaxMuxStreams caps the streams on
+// each websocket, and DestinationLimits applies to each stream. Each stream queues up to
+// muxStreamQueue frames of the client's data while its backend is dialed or written to, and
+// a backend that falls further behind holds up every stream on the websocket. Options that
+// configure stream handling, rather than the websocket or backend connections, don't apply.
+func StartMuxProxyServer(logger logger.Service, listener net.Listener, staticHost string, shutdownC <-chan struct{}, options ProxyOptions) error {
+	if err := options.validate(); err != nil {
+		return err
+	}
+	h := newHandler(logger, staticHost, DefaultStreamHandler, options)
+	h.backendHealth.start(logger, shutdownC)
+	h.backendPool.start(logger, shutdownC)
+	h.watchConnections(shutdownC)
+	return serveProxy(logger, newHTTPServer(&muxHandler{h}, h), listener, shutdownC)
+}
+
+// muxHandler is the HTTP handler for the multiplexing websocket proxy.
+type muxHandler struct {
+	*handler
+}
+
+func (h *muxHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.handshakes.handshakeRead(r) {
+		h.logger.Debugf("Rejecting request from %s: too many pending handshakes", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if h.options.HealthCheckPath != "" && r.URL.Path == h.options.HealthCheckPath {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if h.ipLimiter != nil && !h.ipLimiter.allow(clientIP(r)) {
+		h.logger.Debugf("Rejecting upgrade from %s: rate limit exceeded", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	if h.globalLimiter != nil && !h.globalLimiter.allow() {
+		h.logger.Debugf("Rejecting upgrade from %s: global rate limit exceeded", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if !h.backendHealth.healthy() {
+		h.logger.Debugf("Rejecting request from %s: no healthy backends", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if h.rejectMalformedKey(w, r) {
+		return
+	}
+
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeNonWebSocketResponse(w)
+		return
+	}
+	memory, ok := h.memory.admit(h.connectionMemory())
+	if !ok {
+		h.logger.Debugf("Rejecting request from %s: memory budget exceeded", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer memory.close()
+	tags := h.connectionTags(r)
+	log := h.connectionLogger(tags)
+	h.logRequestHeaders(log, r)
+	conn, handshakeDuration, err := h.upgrade(w, r, h.responseHeader(r))
+	if err != nil {
+		log.Errorf("failed to upgrade: %s", err)
+		return
+	}
+	h.configureCompression(log, conn, r)
+	logTLSParameters(log, r)
+
+	session := &muxSession{
+		handler: h.handler,
+		log:     log,
+		request: r,
+		conn:    conn,
+		stats:   newConnStats(),
+		memory:  memory,
+		streams: make(map[uint32]*muxStream),
+	}
+	event := ConnectionEvent{ID: uuid.New().String(), RemoteAddr: r.RemoteAddr, Destination: h.staticHost, Tags: tags, HandshakeDuration: handshakeDuration}
+	keepAlive := h.startKeepAlive(log, conn, event.ID)
+	closeReceived := notifyClose(conn)
+	h.connectionOpened(event, session.stats, conn)
+	memory.onShed(h.shedConnection(event.ID))
+	defer func() {
+		keepAlive.stop()
+		h.closeGracefully(log, conn, closeReceived, normalClosure)
+		h.connectionClosed(event, session.stats, closeReason(keepAlive, false, normalClosure))
+	}()
+
+	session.serve()
+}
+
+// muxSession proxies the streams multiplexed over one client websocket.
+type muxSession struct {
+	*handler
+	log     logger.Service
+	request *http.Request
+	conn    *websocket.Conn
+	stats   *connStats
+	// memory is charged for the mux frames being read, see ProxyOptions.MemoryBudget
+	memory *memoryAccount
+
+	writeLock   sync.Mutex
+	streamsLock sync.Mutex
+	streams     map[uint32]*muxStream
+	wg          sync.WaitGroup
+}
+
+// serve reads mux frames from the client until the websocket fails, then closes every stream.
+func (s *muxSession) serve() {
+	defer func() {
+		s.streamsLock.Lock()
+		for id, stream := range s.streams {
+			delete(s.streams, id)
+			stream.backend.Close()
+		}
+		s.streamsLock.Unlock()
+		s.wg.Wait()
+	}()
+
+	policy := s.readPolicy()
+	policy.memory = s.memory
+	for {
+		messageType, message, err := nextMessage(s.conn, policy)
+		if err != nil {
+			return
+		}
+		p, err := policy.readMessage(s.conn, message)
+		if err != nil {
+			return
+		}
+		policy.observeMessage(int64(len(p)))
+		s.handleFrame(messageType, p)
+		s.memory.release(int64(len(p)))
+	}
+}
+
+// handleFrame acts on a mux frame read from the client.
+func (s *muxSession) handleFrame(messageType int, p []byte) {
+	streamID, frameType, payload, ok := DecodeMuxFrame(p)
+	if messageType != websocket.BinaryMessage || !ok {
+		s.log.Debugf("Ignoring message that isn't a mux frame from %s", s.conn.RemoteAddr())
+		return
+	}
+	switch frameType {
+	case MuxFrameOpen:
+		s.open(streamID, string(payload))
+	case MuxFrameData:
+		s.forward(streamID, payload)
+	case MuxFrameClose:
+		if stream := s.remove(streamID); stream != nil {
+			stream.backend.Close()
+		}
+	default:
+		s.log.Debugf("Ignoring mux frame with unknown type %d from %s", frameType, s.conn.RemoteAddr())
+	}
+}
+
+// open starts proxying a new stream to destination. The destination is resolved and the
+// backend is dialed in the background, and data for the stream is queued until then.
+func (s *muxSession) open(streamID uint32, destination string) {
+	// dialed is the destination counted against DestinationLimits, set by a successful dial
+	var dialed string
+	backend := newLazyBackendConn(destination, func() (net.Conn, error) {
+		resolved, err := s.resolveStream(destination)
+		if err != nil {
+			s.log.Errorf("Cannot resolve the destination of stream %d from %s: %s", streamID, s.conn.RemoteAddr(), err)
+			return nil, err
+		}
+		if !s.destinationLimiter.acquire(resolved) {
+			s.log.Debugf("Refusing stream %d from %s: too many connections to %s", streamID, s.conn.RemoteAddr(), resolved)
+			return nil, errStreamDestinationLimit
+		}
+		conn, err := s.connectBackend(s.request, s.log, resolved)
+		if err != nil {
+			s.destinationLimiter.release(resolved)
+			s.log.Errorf("Cannot connect to remote: %s", err)
+			return nil, err
+		}
+		dialed = resolved
+		return conn, nil
+	})
+	s.streamsLock.Lock()
+	if _, ok := s.streams[streamID]; ok {
+		s.streamsLock.Unlock()
+		s.log.Debugf("Ignoring open of stream %d from %s, it is already open", streamID, s.conn.RemoteAddr())
+		return
+	}
+	if max := s.options.MaxMuxStreams; max > 0 && len(s.streams) >= max {
+		s.streamsLock.Unlock()
+		s.log.Debugf("Refusing stream %d from %s: too many open streams", streamID, s.conn.RemoteAddr())
+		s.send(streamID, MuxFrameClose, nil)
+		return
+	}
+	stream := &muxStream{backend: backend, writes: make(chan []byte, muxStreamQueue)}
+	s.streams[streamID] = stream
+	s.streamsLock.Unlock()
+
+	s.wg.Add(2)
+	go s.writeStream(stream)
+	go func() {
+		defer s.wg.Done()
+		defer backend.Close()
+		if _, err := backend.connect(); err == nil {
+			defer s.destinationLimiter.release(dialed)
+			buf := make([]byte, muxReadSize)
+			for {
+				n, err := backend.Read(buf)
+				if n > 0 {
+					if s.send(streamID, MuxFrameData, buf[:n]) != nil {
+						return
+					}
+					s.stats.addToClient(int64(n))
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		// Tell the client the backend has gone, unless the client closed the stream
+		if s.remove(streamID) != nil {
+			s.send(streamID, MuxFrameClose, nil)
+		}
+	}()
+}
+
+// resolveStream resolves the destination of a stream the client opened to destination, or
+// to the websocket's own destination if it is empty.
+func (s *muxSession) resolveStream(destination string) (string, error) {
+	if destination == "" {
+		return s.resolver.Resolve(s.request.Context(), s.request)
+	}
+	streamResolver, ok := s.resolver.(StreamResolver)
+	if !ok {
+		return "", errStreamDestinationNotAllowed
+	}
+	return streamResolver.ResolveStream(s.request.Context(), s.request, destination)
+}
+
+// muxStream is a stream's backend and the client's data waiting to be written to it.
+type muxStream struct {
+	backend *lazyBackendConn
+	// writes queues the client's data for writeStream, so that reading from the websocket
+	// doesn't wait for the stream's backend to be dialed
+	writes chan []byte
+}
+
+// forward queues the client's data for the stream's backend.
+func (s *muxSession) forward(streamID uint32, data []byte) {
+	s.streamsLock.Lock()
+	stream := s.streams[streamID]
+	s.streamsLock.Unlock()
+	if stream == nil {
+		s.log.Debugf("Ignoring data for unknown stream %d from %s", streamID, s.conn.RemoteAddr())
+		return
+	}
+	select {
+	case stream.writes <- append([]byte(nil), data...):
+	case <-stream.backend.closed:
+	}
+}
+
+// writeStream writes the client's data for a stream to its backend, dialing it with the
+// first write, until the backend is closed.
+func (s *muxSession) writeStream(stream *muxStream) {
+	defer s.wg.Done()
+	for {
+		select {
+		case data := <-stream.writes:
+			if _, err := stream.backend.Write(data); err != nil {
+				// The stream's reader tells the client when the backend read fails
+				stream.backend.Close()
+				return
+			}
+			s.stats.addToBackend(int64(len(data)))
+		case <-stream.backend.closed:
+			return
+		}
+	}
+}
+
+// remove forgets the stream, returning it if it was still open.
+func (s *muxSession) remove(streamID uint32) *muxStream {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	stream := s.streams[streamID]
+	delete(s.streams, streamID)
+	return stream
+}
+
+// send writes a mux frame to the client.
+func (s *muxSession) send(streamID uint32, frameType byte, payload []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.conn.WriteMessage(websocket.BinaryMessage, EncodeMuxFrame(streamID, frameType, payload))
+}
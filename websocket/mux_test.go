@@ -0,0 +1,233 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+// greetingBackend starts a TCP server that sends greeting on each connection, then echoes.
+func greetingBackend(t *testing.T, greeting string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, greeting)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func startTestMuxProxy(t *testing.T, staticHost string, options ProxyOptions) string {
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	shutdownC := make(chan struct{})
+	t.Cleanup(func() { close(shutdownC) })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	options.CloseGracePeriod = 10 * time.Millisecond
+	go StartMuxProxyServer(logger, listener, staticHost, shutdownC, options)
+	return listener.Addr().String()
+}
+
+// muxClient reads mux frames from a multiplexed websocket, collecting each stream's data.
+type muxClient struct {
+	t      *testing.T
+	conn   *gws.Conn
+	data   map[uint32]string
+	closed map[uint32]bool
+}
+
+func (c *muxClient) send(streamID uint32, frameType byte, payload string) {
+	require.NoError(c.t, c.conn.WriteMessage(gws.BinaryMessage, EncodeMuxFrame(streamID, frameType, []byte(payload))))
+}
+
+// readUntil reads frames until done is true.
+func (c *muxClient) readUntil(done func() bool) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !done() {
+		_, message, err := c.conn.ReadMessage()
+		require.NoError(c.t, err)
+		streamID, frameType, payload, ok := DecodeMuxFrame(message)
+		require.True(c.t, ok)
+		switch frameType {
+		case MuxFrameData:
+			c.data[streamID] += string(payload)
+		case MuxFrameClose:
+			c.closed[streamID] = true
+		}
+	}
+}
+
+func TestMuxProxy(t *testing.T) {
+	backendA := greetingBackend(t, "A:")
+	backendB := greetingBackend(t, "B:")
+	addr := startTestMuxProxy(t, "", ProxyOptions{})
+	client := &muxClient{t: t, conn: dialTestProxy(t, addr, nil), data: map[uint32]string{}, closed: map[uint32]bool{}}
+
+	client.send(1, MuxFrameOpen, backendA.Addr().String())
+	client.send(2, MuxFrameOpen, backendB.Addr().String())
+	for i := 0; i < 3; i++ {
+		client.send(1, MuxFrameData, fmt.Sprintf("one%d", i))
+		client.send(2, MuxFrameData, fmt.Sprintf("two%d", i))
+	}
+	client.readUntil(func() bool { return len(client.data[1]) == 14 && len(client.data[2]) == 14 })
+	assert.Equal(t, "A:one0one1one2", client.data[1])
+	assert.Equal(t, "B:two0two1two2", client.data[2])
+
+	// Closing one stream doesn't affect the other
+	client.send(1, MuxFrameClose, "")
+	client.send(2, MuxFrameData, "more")
+	client.readUntil(func() bool { return len(client.data[2]) == 18 })
+	assert.Equal(t, "B:two0two1two2more", client.data[2])
+	assert.False(t, client.closed[1])
+	assert.False(t, client.closed[2])
+}
+
+func TestMuxProxyStaticHost(t *testing.T) {
+	backend := greetingBackend(t, "static:")
+	addr := startTestMuxProxy(t, backend.Addr().String(), ProxyOptions{})
+	client := &muxClient{t: t, conn: dialTestProxy(t, addr, nil), data: map[uint32]string{}, closed: map[uint32]bool{}}
+
+	client.send(7, MuxFrameOpen, "")
+	client.readUntil(func() bool { return len(client.data[7]) == 7 })
+	assert.Equal(t, "static:", client.data[7])
+}
+
+func TestMuxProxyBackendClosed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			io.WriteString(conn, "bye")
+			conn.Close()
+		}
+	}()
+	addr := startTestMuxProxy(t, "", ProxyOptions{})
+	client := &muxClient{t: t, conn: dialTestProxy(t, addr, nil), data: map[uint32]string{}, closed: map[uint32]bool{}}
+
+	client.send(3, MuxFrameOpen, listener.Addr().String())
+	client.readUntil(func() bool { return client.closed[3] })
+	assert.Equal(t, "bye", client.data[3])
+
+	// Streams to unreachable backends are closed too
+	client.send(4, MuxFrameOpen, "127.0.0.1:1")
+	client.readUntil(func() bool { return client.closed[4] })
+}
+
+func TestMuxProxyStreamDestinations(t *testing.T) {
+	allowed := greetingBackend(t, "allowed:")
+	other := greetingBackend(t, "other:")
+	tests := []struct {
+		name       string
+		staticHost string
+		options    ProxyOptions
+		open       string
+		allowed    bool
+	}{
+		{name: "static host", staticHost: allowed.Addr().String(), open: other.Addr().String()},
+		{name: "resolver without streams", options: ProxyOptions{Resolver: StaticResolver(allowed.Addr().String())}, open: other.Addr().String()},
+		{name: "token", options: ProxyOptions{DestinationFromToken: func(string) (string, error) { return allowed.Addr().String(), nil }}, open: other.Addr().String()},
+		{name: "token granted", options: ProxyOptions{DestinationFromToken: func(string) (string, error) { return allowed.Addr().String(), nil }}, open: allowed.Addr().String(), allowed: true},
+		{name: "target host", options: ProxyOptions{Resolver: &TargetHostResolver{Targets: map[string]string{"allowed.example.com": allowed.Addr().String()}}}, open: other.Addr().String()},
+		{name: "target host allowed", options: ProxyOptions{Resolver: &TargetHostResolver{Targets: map[string]string{"allowed.example.com": allowed.Addr().String()}}}, open: "allowed.example.com", allowed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := startTestMuxProxy(t, test.staticHost, test.options)
+			header := http.Header{h2mux.CFAccessTokenHeader: {"token"}}
+			client := &muxClient{t: t, conn: dialTestProxy(t, addr, header), data: map[uint32]string{}, closed: map[uint32]bool{}}
+
+			client.send(1, MuxFrameOpen, test.open)
+			if test.allowed {
+				client.readUntil(func() bool { return len(client.data[1]) == len("allowed:") })
+				assert.Equal(t, "allowed:", client.data[1])
+				return
+			}
+			client.readUntil(func() bool { return client.closed[1] })
+			assert.Empty(t, client.data[1])
+		})
+	}
+}
+
+func TestMuxProxyStreamLimits(t *testing.T) {
+	backend := greetingBackend(t, "hi")
+	tests := map[string]ProxyOptions{
+		"max streams":        {MaxMuxStreams: 1},
+		"destination limits": {DestinationLimits: &DestinationLimits{Default: 1}},
+	}
+	for name, options := range tests {
+		t.Run(name, func(t *testing.T) {
+			addr := startTestMuxProxy(t, "", options)
+			client := &muxClient{t: t, conn: dialTestProxy(t, addr, nil), data: map[uint32]string{}, closed: map[uint32]bool{}}
+
+			client.send(1, MuxFrameOpen, backend.Addr().String())
+			client.readUntil(func() bool { return client.data[1] == "hi" })
+			client.send(2, MuxFrameOpen, backend.Addr().String())
+			client.readUntil(func() bool { return client.closed[2] })
+			assert.Empty(t, client.data[2])
+
+			// Closing the first stream makes room for another, once the proxy has closed it
+			client.send(1, MuxFrameClose, "")
+			for deadline := time.Now().Add(5 * time.Second); client.data[3] != "hi"; {
+				require.True(t, time.Now().Before(deadline), "no room was made for another stream")
+				delete(client.closed, 3)
+				client.send(3, MuxFrameOpen, backend.Addr().String())
+				client.readUntil(func() bool { return client.closed[3] || client.data[3] == "hi" })
+			}
+		})
+	}
+}
+
+func TestMuxProxyPendingDialDoesNotBlock(t *testing.T) {
+	backend := greetingBackend(t, "B:")
+	const hangingBackend = "hanging.example.com:22"
+	release := make(chan struct{})
+	defer close(release)
+	addr := startTestMuxProxy(t, "", ProxyOptions{
+		DialBackend: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if address == hangingBackend {
+				select {
+				case <-release:
+				case <-ctx.Done():
+				}
+				return nil, errors.New("backend never answered")
+			}
+			return new(net.Dialer).DialContext(ctx, network, address)
+		},
+	})
+	client := &muxClient{t: t, conn: dialTestProxy(t, addr, nil), data: map[uint32]string{}, closed: map[uint32]bool{}}
+
+	client.send(1, MuxFrameOpen, hangingBackend)
+	client.send(1, MuxFrameData, "waiting for the dial")
+	client.send(2, MuxFrameOpen, backend.Addr().String())
+	client.send(2, MuxFrameData, "hello")
+	client.readUntil(func() bool { return client.data[2] == "B:hello" })
+	client.send(2, MuxFrameClose, "")
+	client.send(2, MuxFrameOpen, backend.Addr().String())
+	client.readUntil(func() bool { return client.data[2] == "B:helloB:" })
+	assert.False(t, client.closed[1])
+}
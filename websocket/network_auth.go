@@ -0,0 +1,58 @@
+package websocket
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+)
+
+// NetworkAuthenticationError is returned by a Resolver to refuse a request with 511
+// Network Authentication Required, for clients that must authenticate elsewhere, such as at
+// an Access login page, before they can connect.
+type NetworkAuthenticationError struct {
+	// LoginURL is where the client should authenticate. It is sent in the Location header
+	// and linked from the default body.
+	LoginURL string
+	// Body replaces the default HTML body when set.
+	Body []byte
+	// Cause, which may not be safe to show the client, is only logged.
+	Cause error
+}
+
+func (e *NetworkAuthenticationError) Error() string {
+	message := "network authentication required"
+	if e.LoginURL != "" {
+		message += " at " + e.LoginURL
+	}
+	if e.Cause != nil {
+		message += ": " + e.Cause.Error()
+	}
+	return message
+}
+
+// write refuses the request with 511 and the configured body.
+func (e *NetworkAuthenticationError) write(w http.ResponseWriter) {
+	body := e.Body
+	if body == nil {
+		body = networkAuthenticationPage(e.LoginURL)
+	}
+	if e.LoginURL != "" {
+		w.Header().Set("Location", e.LoginURL)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNetworkAuthenticationRequired)
+	w.Write(body)
+}
+
+// networkAuthenticationPage returns a page that sends browsers on to loginURL, as RFC 6585
+// suggests for 511 responses.
+func networkAuthenticationPage(loginURL string) []byte {
+	if loginURL == "" {
+		return []byte("<!DOCTYPE html>\n<html><head><title>Network Authentication Required</title></head>" +
+			"<body><p>You need to authenticate before connecting.</p></body></html>\n")
+	}
+	escaped := html.EscapeString(loginURL)
+	return []byte(fmt.Sprintf("<!DOCTYPE html>\n<html><head><title>Network Authentication Required</title>"+
+		"<meta http-equiv=\"refresh\" content=\"0; url=%s\"></head>"+
+		"<body><p>You need to <a href=\"%s\">authenticate</a> before connecting.</p></body></html>\n", escaped, escaped))
+}
@@ -1,5 +1,26 @@
 package websocket
 
+import "net/http"
+
+// maxNonWebSocketResponseSize bounds the body written to requests that aren't websocket
+// upgrades.
+const maxNonWebSocketResponseSize = 64 * 1024
+
+// writeNonWebSocketResponse answers a request that isn't a websocket upgrade with the notice
+// page.
+func writeNonWebSocketResponse(w http.ResponseWriter) {
+	writeHTML(w, nonWebSocketRequestPage())
+}
+
+// writeHTML writes page as an HTML response, truncated to maxNonWebSocketResponseSize.
+func writeHTML(w http.ResponseWriter, page []byte) {
+	if len(page) > maxNonWebSocketResponseSize {
+		page = page[:maxNonWebSocketResponseSize]
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
 func nonWebSocketRequestPage() []byte {
 	return []byte(`<!DOCTYPE html>
 		<html lang="en">
@@ -0,0 +1,41 @@
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNonWebSocketResponse(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{})
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		var err error
+		resp, err = http.Get(fmt.Sprintf("http://%s/", addr))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, nonWebSocketRequestPage(), body)
+	assert.LessOrEqual(t, len(body), maxNonWebSocketResponseSize)
+}
+
+func TestWriteHTMLTruncates(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeHTML(w, bytes.Repeat([]byte("a"), maxNonWebSocketResponseSize+1))
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, maxNonWebSocketResponseSize, w.Body.Len())
+}
@@ -0,0 +1,71 @@
+package websocket
+
+import "sync"
+
+// pauseGate blocks callers of wait while it is paused. The zero value is not paused.
+type pauseGate struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	closed bool
+}
+
+func (g *pauseGate) pause() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.paused = true
+}
+
+// resume wakes every caller blocked in wait.
+func (g *pauseGate) resume() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.paused = false
+	if g.cond != nil {
+		g.cond.Broadcast()
+	}
+}
+
+// close permanently opens the gate, so that callers aren't blocked once the connection
+// has been closed.
+func (g *pauseGate) close() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.closed = true
+	if g.cond != nil {
+		g.cond.Broadcast()
+	}
+}
+
+// wait blocks while the gate is paused.
+func (g *pauseGate) wait() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for g.paused && !g.closed {
+		if g.cond == nil {
+			g.cond = sync.NewCond(&g.lock)
+		}
+		g.cond.Wait()
+	}
+}
+
+// Pause stops data being proxied over the connection in either direction, without closing
+// it. Nothing is buffered: the connection holds on to the message or chunk it has just
+// read and stops reading from the client and the backend, so both are pushed back on by
+// flow control. While paused, the connection doesn't notice the client
+// disconnecting until it is resumed or closed. Pause and Resume may be called from any
+// goroutine.
+func (c *Conn) Pause() {
+	c.gate.pause()
+}
+
+// Resume continues proxying data in both directions after Pause.
+func (c *Conn) Resume() {
+	c.gate.resume()
+}
+
+// Close closes the connection, releasing any reads or writes blocked by Pause.
+func (c *Conn) Close() error {
+	c.gate.close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPauseResume(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	connC := make(chan *Conn, 1)
+	streamHandler := func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header) {
+		connC <- wsConn
+		Stream(wsConn, remoteConn)
+	}
+	addr := startTestProxy(t, backend.Addr().String(), streamHandler, ProxyOptions{})
+
+	client := dialTestProxy(t, addr, nil)
+	proxied := <-connC
+	receivedC := make(chan string)
+	go func() {
+		for {
+			_, message, err := client.ReadMessage()
+			if err != nil {
+				return
+			}
+			receivedC <- string(message)
+		}
+	}()
+
+	assert.NoError(t, client.WriteMessage(gws.BinaryMessage, []byte("before")))
+	assert.Equal(t, "before", <-receivedC)
+
+	proxied.Pause()
+	assert.NoError(t, client.WriteMessage(gws.BinaryMessage, []byte("while paused")))
+	select {
+	case message := <-receivedC:
+		t.Fatalf("received %q while paused", message)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	proxied.Resume()
+	select {
+	case message := <-receivedC:
+		assert.Equal(t, "while paused", message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("data didn't flow after resuming")
+	}
+}
+
+func TestPauseGateClose(t *testing.T) {
+	var gate pauseGate
+	gate.pause()
+	done := make(chan struct{})
+	go func() {
+		gate.wait()
+		close(done)
+	}()
+	gate.close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing didn't release the gate")
+	}
+}
@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// handshakeConnKey is the context key of a request's handshakeConn.
+type handshakeConnKey struct{}
+
+// handshakeConn is the connection a request arrived on, and whether it was admitted when it
+// was accepted.
+type handshakeConn struct {
+	conn     net.Conn
+	admitted bool
+}
+
+// handshakeTracker limits the connections that have been accepted but haven't finished
+// sending their handshake request, so that clients that send their requests slowly, on
+// purpose or not, can't tie up the server. Connections accepted over the limit are refused
+// with 503 Service Unavailable once their request arrives. A nil handshakeTracker admits
+// every connection.
+type handshakeTracker struct {
+	limit int
+
+	lock    sync.Mutex
+	pending map[net.Conn]struct{}
+}
+
+func newHandshakeTracker(limit int) *handshakeTracker {
+	return &handshakeTracker{limit: limit, pending: make(map[net.Conn]struct{})}
+}
+
+// connContext is the http.Server ConnContext hook. It counts each new connection as pending
+// if there's room, and records whether there was in its context.
+func (t *handshakeTracker) connContext(ctx context.Context, conn net.Conn) context.Context {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	admitted := len(t.pending) < t.limit
+	if admitted {
+		t.pending[conn] = struct{}{}
+	}
+	return context.WithValue(ctx, handshakeConnKey{}, handshakeConn{conn: conn, admitted: admitted})
+}
+
+// connState is the http.Server ConnState hook. It stops counting connections that close
+// before sending a request.
+func (t *handshakeTracker) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		t.finish(conn)
+	}
+}
+
+// handshakeRead stops counting r's connection as pending, now its request has been read,
+// and reports whether the connection was admitted.
+func (t *handshakeTracker) handshakeRead(r *http.Request) bool {
+	if t == nil {
+		return true
+	}
+	hc, ok := r.Context().Value(handshakeConnKey{}).(handshakeConn)
+	if !ok {
+		return true
+	}
+	t.finish(hc.conn)
+	return hc.admitted
+}
+
+func (t *handshakeTracker) finish(conn net.Conn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.pending, conn)
+}
+
+// count returns the number of pending connections.
+func (t *handshakeTracker) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.pending)
+}
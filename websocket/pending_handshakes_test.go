@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxPendingHandshakes(t *testing.T) {
+	const limit = 3
+	backend := echoBackend(t)
+	defer backend.Close()
+	server, err := NewProxyServer(&testLogger{}, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{MaxPendingHandshakes: limit, CloseGracePeriod: 10 * time.Millisecond})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go server.Serve(listener, shutdownC)
+	addr := listener.Addr().String()
+
+	// Established connections don't count towards the limit
+	dialTestProxy(t, addr, nil)
+
+	// Slow clients that never finish their handshake requests
+	var slow []net.Conn
+	for i := 0; i < limit; i++ {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n"))
+		require.NoError(t, err)
+		slow = append(slow, conn)
+	}
+	require.Eventually(t, func() bool { return server.handler.handshakes.count() == limit }, 5*time.Second, 10*time.Millisecond)
+
+	_, resp, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), nil)
+	assert.Equal(t, gws.ErrBadHandshake, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	// Once the slow clients go away, there's room again
+	for _, conn := range slow {
+		conn.Close()
+	}
+	assert.Eventually(t, func() bool {
+		conn, _, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), nil)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,156 @@
+package websocket
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+// defaultRateLimitClients is the default number of client IPs tracked by the per-IP
+// upgrade rate limiter.
+const defaultRateLimitClients = 10000
+
+// UpgradeRateLimit limits the rate of websocket upgrade attempts from each client IP.
+type UpgradeRateLimit struct {
+	// PerIP is the sustained number of upgrades per second allowed from one client IP.
+	PerIP float64
+	// Burst is the number of upgrades a client IP may make at once.
+	Burst int
+	// MaxClients bounds the number of client IPs being tracked. The least recently seen
+	// client is forgotten when the limit is reached. Defaults to defaultRateLimitClients.
+	MaxClients uint
+}
+
+// GlobalUpgradeRateLimit limits the rate of websocket upgrade attempts across all clients.
+type GlobalUpgradeRateLimit struct {
+	// PerSecond is the sustained number of upgrades per second allowed by the proxy.
+	PerSecond float64
+	// Burst is the number of upgrades the proxy may accept at once.
+	Burst int
+}
+
+// slowStartMinFraction is the fraction of its full rate a slow starting token bucket starts at.
+const slowStartMinFraction = 0.1
+
+// tokenBucket is a token bucket rate limiter. It holds at most burst tokens and
+// is refilled at rate tokens per second.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// A slow starting bucket takes warmUp to reach its full rate and burst, at warmUpEnd
+	warmUp    time.Duration
+	warmUpEnd time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket, reporting false if none were available.
+func (b *tokenBucket) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// take takes a token from the bucket even if none are available, and returns how long the
+// caller should wait for the token to have been earned.
+func (b *tokenBucket) take() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / (b.rate * b.scale(b.last)) * float64(time.Second))
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	scale := b.scale(now)
+	b.tokens += now.Sub(b.last).Seconds() * b.rate * scale
+	if burst := math.Max(b.burst*scale, 1); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// newSlowStartTokenBucket returns a token bucket whose rate and burst ramp up linearly from
+// slowStartMinFraction of rate and burst to the full amounts over warmUp. It starts with a
+// single token.
+func newSlowStartTokenBucket(rate float64, burst int, warmUp time.Duration) *tokenBucket {
+	b := newTokenBucket(rate, burst)
+	b.tokens = 1
+	b.warmUp = warmUp
+	b.warmUpEnd = b.last.Add(warmUp)
+	return b
+}
+
+// scale returns the fraction of the full rate and burst the bucket allows at now.
+func (b *tokenBucket) scale(now time.Time) float64 {
+	if b.warmUpEnd.IsZero() || !now.Before(b.warmUpEnd) {
+		return 1
+	}
+	progress := 1 - b.warmUpEnd.Sub(now).Seconds()/b.warmUp.Seconds()
+	return math.Max(progress, slowStartMinFraction)
+}
+
+// ipRateLimiter keeps a token bucket per client IP, in an LRU cache to bound memory.
+type ipRateLimiter struct {
+	limit UpgradeRateLimit
+	// lock makes looking up and creating a client's bucket atomic
+	lock    sync.Mutex
+	buckets *lrucache.LRUCache
+}
+
+func newIPRateLimiter(limit UpgradeRateLimit) *ipRateLimiter {
+	maxClients := limit.MaxClients
+	if maxClients == 0 {
+		maxClients = defaultRateLimitClients
+	}
+	return &ipRateLimiter{
+		limit:   limit,
+		buckets: lrucache.NewLRUCache(maxClients),
+	}
+}
+
+// allow reports whether the client IP may make another upgrade attempt.
+func (l *ipRateLimiter) allow(ip string) bool {
+	l.lock.Lock()
+	bucket, ok := l.buckets.Get(ip)
+	if !ok {
+		bucket = newTokenBucket(l.limit.PerIP, l.limit.Burst)
+		l.buckets.Set(ip, bucket, time.Time{})
+	}
+	l.lock.Unlock()
+
+	return bucket.(*tokenBucket).allow()
+}
+
+// clientIP returns the IP address of the client that made the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,162 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflared/logger"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(0, 2)
+	assert.True(t, bucket.allow())
+	assert.True(t, bucket.allow())
+	assert.False(t, bucket.allow())
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	bucket := newTokenBucket(10, 1)
+	assert.Equal(t, time.Duration(0), bucket.take())
+	wait := bucket.take()
+	assert.True(t, wait > 0 && wait <= 100*time.Millisecond, wait)
+}
+
+func TestFrameRateLimit(t *testing.T) {
+	const frames = 150
+	for _, limited := range []bool{false, true} {
+		server, client := websocketPair(t)
+		h := newHandler(&testLogger{}, "", DefaultStreamHandler, ProxyOptions{})
+		if limited {
+			h.options.MaxFramesPerSecond = 100
+		}
+		conn := &Conn{Conn: server, readPolicy: h.readPolicy()}
+
+		go func() {
+			for i := 0; i < frames; i++ {
+				client.WriteMessage(gws.BinaryMessage, []byte{byte(i)})
+			}
+		}()
+		start := time.Now()
+		buf := make([]byte, 1)
+		for i := 0; i < frames; i++ {
+			_, err := conn.Read(buf)
+			assert.NoError(t, err)
+		}
+		elapsed := time.Since(start)
+
+		if limited {
+			// A burst of 100 frames, then 50 more at 100 per second
+			assert.True(t, elapsed >= 400*time.Millisecond, elapsed)
+		} else {
+			assert.True(t, elapsed < 400*time.Millisecond, elapsed)
+		}
+	}
+}
+
+func TestFrameRateWarmUp(t *testing.T) {
+	const frames = 30
+	for _, warmUp := range []bool{false, true} {
+		server, client := websocketPair(t)
+		h := newHandler(&testLogger{}, "", DefaultStreamHandler, ProxyOptions{MaxFramesPerSecond: 100})
+		if warmUp {
+			h.options.FrameRateWarmUp = time.Second
+		}
+		conn := &Conn{Conn: server, readPolicy: h.readPolicy()}
+
+		go func() {
+			for i := 0; i < frames; i++ {
+				client.WriteMessage(gws.BinaryMessage, []byte{byte(i)})
+			}
+		}()
+		start := time.Now()
+		buf := make([]byte, 1)
+		for i := 0; i < frames; i++ {
+			_, err := conn.Read(buf)
+			assert.NoError(t, err)
+		}
+		elapsed := time.Since(start)
+
+		if warmUp {
+			// The rate ramps up from 10 frames per second, so 30 frames take most of a second
+			assert.True(t, elapsed >= 300*time.Millisecond, elapsed)
+		} else {
+			// Within the burst at the full rate
+			assert.True(t, elapsed < 300*time.Millisecond, elapsed)
+		}
+	}
+}
+
+func TestSlowStartTokenBucket(t *testing.T) {
+	b := newSlowStartTokenBucket(100, 100, time.Second)
+	start := b.last
+	assert.Equal(t, slowStartMinFraction, b.scale(start))
+	assert.InDelta(t, 0.5, b.scale(start.Add(500*time.Millisecond)), 0.001)
+	assert.Equal(t, 1.0, b.scale(start.Add(time.Second)))
+
+	// Only the single starting token is available at first
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+}
+
+func TestUpgradeRateLimitPerIP(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	h := newHandler(logger, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+		UpgradeRateLimit: &UpgradeRateLimit{PerIP: 0.001, Burst: 2},
+	})
+
+	upgrade := func(remoteAddr string) int {
+		req := testRequest(t, "http://localhost/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	rejected := 0
+	for i := 0; i < 10; i++ {
+		if upgrade("192.0.2.1:1234") == http.StatusTooManyRequests {
+			rejected++
+		}
+	}
+	assert.Equal(t, 8, rejected)
+	assert.NotEqual(t, http.StatusTooManyRequests, upgrade("192.0.2.2:1234"))
+}
+
+func TestGlobalUpgradeRateLimit(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	h := newHandler(logger, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+		GlobalUpgradeRateLimit: &GlobalUpgradeRateLimit{PerSecond: 0.001, Burst: 3},
+	})
+
+	rejected := 0
+	for i := 0; i < 10; i++ {
+		req := testRequest(t, "http://localhost/", nil)
+		// Every attempt comes from a different client
+		req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i+1)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code == http.StatusServiceUnavailable {
+			rejected++
+		}
+	}
+	assert.Equal(t, 7, rejected)
+}
+
+func TestUpgradeRateLimitBoundsClients(t *testing.T) {
+	limiter := newIPRateLimiter(UpgradeRateLimit{PerIP: 0.001, Burst: 1, MaxClients: 2})
+	assert.True(t, limiter.allow("192.0.2.1"))
+	assert.True(t, limiter.allow("192.0.2.2"))
+	assert.True(t, limiter.allow("192.0.2.3"))
+	assert.Equal(t, 2, limiter.buckets.Len())
+}
@@ -0,0 +1,93 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultGorillaBufferSize is the buffer size gorilla uses when the upgrader doesn't set one.
+const defaultGorillaBufferSize = 4096
+
+var errInvalidUTF8 = errors.New("text message is not valid UTF-8")
+
+// readPolicy is applied to the messages read from a client connection.
+type readPolicy struct {
+	// strict rejects text messages that aren't valid UTF-8, see ProxyOptions.StrictFrameValidation
+	strict bool
+	// frameLimit, when set, throttles reads to its rate, see ProxyOptions.MaxFramesPerSecond
+	frameLimit *tokenBucket
+	// bufferSize, when set, is the size of the connection's read buffer
+	bufferSize int
+	// memory, when set, is charged for messages buffered in full, see ProxyOptions.MemoryBudget
+	memory *memoryAccount
+}
+
+// observeMessage records the size of a message read from the client, counting messages that
+// didn't fit in the read buffer.
+func (p readPolicy) observeMessage(size int64) {
+	if p.bufferSize > 0 && size > int64(p.bufferSize) {
+		oversizedMessages.Inc()
+	}
+}
+
+// readPolicy returns the policy for reading from client connections.
+func (h *handler) readPolicy() readPolicy {
+	policy := readPolicy{strict: h.options.StrictFrameValidation, bufferSize: h.upgrader.ReadBufferSize}
+	if policy.bufferSize <= 0 {
+		policy.bufferSize = defaultGorillaBufferSize
+	}
+	if h.options.MaxFramesPerSecond > 0 {
+		burst := int(h.options.MaxFramesPerSecond)
+		if burst < 1 {
+			burst = 1
+		}
+		if h.options.FrameRateWarmUp > 0 {
+			policy.frameLimit = newSlowStartTokenBucket(h.options.MaxFramesPerSecond, burst, h.options.FrameRateWarmUp)
+		} else {
+			policy.frameLimit = newTokenBucket(h.options.MaxFramesPerSecond, burst)
+		}
+	}
+	return policy
+}
+
+// nextMessage returns the type of the next message read from conn and a reader for it.
+//
+// When the policy limits the frame rate, it waits until the message is within the limit
+// before returning it. Not reading in the meantime pushes back on the client.
+//
+// When the policy is strict, text messages are read in full and rejected if they aren't
+// valid UTF-8, closing conn with 1007 (invalid frame payload data) as RFC 6455 requires.
+// gorilla always rejects unmasked client frames and reserved bits that weren't negotiated,
+// closing with 1002 (protocol error), so strict mode doesn't need to check those.
+func nextMessage(conn *websocket.Conn, policy readPolicy) (int, io.Reader, error) {
+	messageType, r, err := conn.NextReader()
+	if err != nil {
+		return messageType, r, err
+	}
+	if policy.frameLimit != nil {
+		if wait := policy.frameLimit.take(); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	if !policy.strict || messageType != websocket.TextMessage {
+		return messageType, r, nil
+	}
+	payload, err := policy.readMessage(conn, r)
+	if err != nil {
+		return messageType, nil, err
+	}
+	// Only the validation is charged to the memory budget, as the caller reads the payload
+	// however it would have read the message
+	policy.memory.release(int64(len(payload)))
+	if !utf8.Valid(payload) {
+		message := websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, errInvalidUTF8.Error())
+		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+		return messageType, nil, errInvalidUTF8
+	}
+	return messageType, bytes.NewReader(payload), nil
+}
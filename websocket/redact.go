@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+// redactedValue replaces the values of redacted headers.
+const redactedValue = "***"
+
+// defaultRedactedHeaders are the headers redacted when logging request headers, unless
+// ProxyOptions.RedactHeaders is set.
+var defaultRedactedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Cf-Access-Client-Secret",
+	"Cf-Access-Token",
+	"Sec-Websocket-Key",
+}
+
+// redactHeaders returns a copy of h with the values of the headers in redact replaced by
+// redactedValue. Header names are matched case insensitively.
+func redactHeaders(h http.Header, redact []string) http.Header {
+	redacted := h.Clone()
+	for _, name := range redact {
+		name = http.CanonicalHeaderKey(name)
+		if values, ok := redacted[name]; ok {
+			redacted[name] = make([]string, len(values))
+			for i := range values {
+				redacted[name][i] = redactedValue
+			}
+		}
+	}
+	return redacted
+}
+
+// formatHeaders formats h for logging, sorted by name.
+func formatHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, value := range h[name] {
+			formatted = append(formatted, name+": "+value)
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// logRequestHeaders logs r's headers at debug level when LogRequestHeaders is set, with
+// sensitive values redacted.
+func (h *handler) logRequestHeaders(log logger.Service, r *http.Request) {
+	if !h.options.LogRequestHeaders {
+		return
+	}
+	redact := h.options.RedactHeaders
+	if redact == nil {
+		redact = defaultRedactedHeaders
+	}
+	log.Debugf("Request headers from %s: %s", r.RemoteAddr, formatHeaders(redactHeaders(r.Header, redact)))
+}
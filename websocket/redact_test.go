@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	header.Add("Cookie", "a=1")
+	header.Add("Cookie", "b=2")
+	header.Set("User-Agent", "test")
+
+	redacted := redactHeaders(header, []string{"authorization", "cookie", "X-Missing"})
+	assert.Equal(t, []string{"***"}, redacted["Authorization"])
+	assert.Equal(t, []string{"***", "***"}, redacted["Cookie"])
+	assert.Equal(t, "test", redacted.Get("User-Agent"))
+	assert.NotContains(t, redacted, "X-Missing")
+	// The original headers are left alone
+	assert.Equal(t, "Bearer secret", header.Get("Authorization"))
+}
+
+func TestLogRequestHeaders(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	log := &testLogger{}
+	server, err := NewProxyServer(log, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{LogRequestHeaders: true, CloseGracePeriod: 10 * time.Millisecond})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go server.Serve(listener, shutdownC)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	header.Set("Cf-Access-Client-Secret", "client-secret")
+	header.Set("X-Debug", "visible")
+	conn := dialTestProxy(t, listener.Addr().String(), header)
+	defer conn.Close()
+
+	var logged string
+	assert.Eventually(t, func() bool {
+		for _, line := range log.Lines() {
+			if strings.Contains(line, "Request headers") {
+				logged = line
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, logged, "Authorization: ***")
+	assert.Contains(t, logged, "Cf-Access-Client-Secret: ***")
+	assert.Contains(t, logged, "Sec-Websocket-Key: ***")
+	assert.Contains(t, logged, "X-Debug: visible")
+	assert.NotContains(t, logged, "secret")
+}
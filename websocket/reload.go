@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// reloadableHandler serves each request with the handler that is current when it arrives,
+// so that swapping the handler doesn't affect the connections already being proxied.
+type reloadableHandler struct {
+	current atomic.Value // *handler
+}
+
+func newReloadableHandler(h *handler) *reloadableHandler {
+	rh := &reloadableHandler{}
+	rh.current.Store(h)
+	return rh
+}
+
+func (rh *reloadableHandler) load() *handler {
+	return rh.current.Load().(*handler)
+}
+
+func (rh *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh.load().ServeHTTP(w, r)
+}
+
+// UpdateConfig replaces the server's options without dropping connections. Connections
+// already being proxied keep the options they were accepted with, and new connections use
+// options. Rate limits start afresh with the new options, while MemoryBudget and
+// DestinationLimits keep counting the connections already open against their new limits.
+// A MemoryBudget or DestinationLimits that was unset before the update only counts the
+// connections accepted after it.
+//
+// The options that configure the server itself, rather than how each connection is handled,
+// keep the values the server was created with: BaseContext, HandshakeReadTimeout,
+// MaxPendingHandshakes, SessionResumeTTL, BackendHealthCheck, BackendPool and StallWarning.
+func (s *ProxyServer) UpdateConfig(options ProxyOptions) error {
+	if err := options.validate(); err != nil {
+		return err
+	}
+	h := newContextHandler(s.logger, s.handler.staticHost, s.handler.streamHandler, options)
+	h.handshakes = s.handler.handshakes
+	h.sessions = s.handler.sessions
+	h.connections = s.handler.connections
+	h.backendHealth = s.handler.backendHealth
+	h.backendPool = s.handler.backendPool
+	current := s.serving.load()
+	if h.memory != nil && current.memory != nil {
+		current.memory.setLimit(options.MemoryBudget)
+		h.memory = current.memory
+	}
+	if h.destinationLimiter != nil && current.destinationLimiter != nil {
+		current.destinationLimiter.setLimits(*options.DestinationLimits)
+		h.destinationLimiter = current.destinationLimiter
+	}
+	s.serving.current.Store(h)
+	s.logger.Infof("Updated the websocket proxy configuration")
+	return nil
+}
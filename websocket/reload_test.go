@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateConfig(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	allowOrigin := func(origin string) func(r *http.Request) bool {
+		return func(r *http.Request) bool { return r.Header.Get("Origin") == origin }
+	}
+	server, err := NewProxyServer(&testLogger{}, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{CheckOrigin: allowOrigin("https://old.example.com")})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go server.Serve(listener, shutdownC)
+	addr := listener.Addr().String()
+
+	existing := dialTestProxy(t, addr, http.Header{"Origin": {"https://old.example.com"}})
+	require.Eventually(t, func() bool { return len(server.Connections()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, server.UpdateConfig(ProxyOptions{CheckOrigin: allowOrigin("https://new.example.com")}))
+
+	// New connections are checked against the new origin
+	_, resp, err := gws.DefaultDialer.Dial("ws://"+addr, http.Header{"Origin": {"https://old.example.com"}})
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	updated := dialTestProxy(t, addr, http.Header{"Origin": {"https://new.example.com"}})
+
+	// The existing connection is still proxied, alongside the new one
+	for _, conn := range []*gws.Conn{existing, updated} {
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("hello")))
+		_, message, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("hello"), message)
+	}
+	assert.Len(t, server.Connections(), 2)
+}
+
+func TestUpdateConfigInvalid(t *testing.T) {
+	server, err := NewProxyServer(&testLogger{}, "localhost:0", DefaultStreamHandler, ProxyOptions{})
+	require.NoError(t, err)
+	assert.Error(t, server.UpdateConfig(ProxyOptions{DialNetwork: "udp"}))
+}
+
+func TestUpdateConfigKeepsLimits(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	cost := newHandler(&testLogger{}, "", DefaultStreamHandler, ProxyOptions{}).connectionMemory()
+	tests := map[string]ProxyOptions{
+		"memory budget":      {MemoryBudget: cost},
+		"destination limits": {DestinationLimits: &DestinationLimits{Default: 1}},
+	}
+	for name, options := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, err := NewProxyServer(&testLogger{}, backend.Addr().String(), DefaultStreamHandler, options)
+			require.NoError(t, err)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			shutdownC := make(chan struct{})
+			defer close(shutdownC)
+			go server.Serve(listener, shutdownC)
+			addr := listener.Addr().String()
+
+			dialTestProxy(t, addr, nil)
+			require.Eventually(t, func() bool { return len(server.Connections()) == 1 }, 5*time.Second, 10*time.Millisecond)
+			require.NoError(t, server.UpdateConfig(options))
+
+			// The connection accepted before the update still counts against the limit
+			_, resp, err := gws.DefaultDialer.Dial("ws://"+addr, nil)
+			assert.Error(t, err)
+			if assert.NotNil(t, resp) {
+				assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+)
+
+// maxCachedDestinations bounds the number of requests a caching resolver remembers.
+const maxCachedDestinations = 1024
+
+// Resolver works out the destination to proxy a request to. A resolver that fails with a
+// DestinationError refuses the request with its status and error, and other errors refuse
+// it with 400 Bad Request and the error's text, so errors must be safe to show to clients.
+// Resolvers can fail with NetworkAuthenticationError to send clients to log in first.
+type Resolver interface {
+	Resolve(ctx context.Context, r *http.Request) (string, error)
+}
+
+// StreamResolver is implemented by resolvers that let the clients of StartMuxProxyServer choose
+// the destination of each stream. ResolveStream returns the destination to proxy a stream to
+// when the client opened it to destination, or an error to refuse it. Resolvers that don't
+// implement it only allow streams to the destination Resolve returns, opened with an empty
+// MuxFrameOpen payload.
+type StreamResolver interface {
+	ResolveStream(ctx context.Context, r *http.Request, destination string) (string, error)
+}
+
+// ResolverFunc adapts a function to a Resolver.
+type ResolverFunc func(ctx context.Context, r *http.Request) (string, error)
+
+func (f ResolverFunc) Resolve(ctx context.Context, r *http.Request) (string, error) {
+	return f(ctx, r)
+}
+
+// DestinationError is an error resolving a request's destination. The client is sent Err
+// with Status, and Cause, which may not be safe to show the client, is only logged.
+type DestinationError struct {
+	Status int
+	Err    error
+	Cause  error
+}
+
+func (e *DestinationError) Error() string {
+	if e.Cause == nil {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + ": " + e.Cause.Error()
+}
+
+func (e *DestinationError) Unwrap() error {
+	return e.Err
+}
+
+// StaticResolver resolves every request to the same destination.
+type StaticResolver string
+
+func (s StaticResolver) Resolve(context.Context, *http.Request) (string, error) {
+	return string(s), nil
+}
+
+// JumpHeaderResolver resolves requests to the destination the client sent in the jump
+// destination header, which is set by the --destination flag of cloudflared access.
+type JumpHeaderResolver struct{}
+
+func (JumpHeaderResolver) Resolve(_ context.Context, r *http.Request) (string, error) {
+	jumpDestination := r.Header.Get(h2mux.CFJumpDestinationHeader)
+	if jumpDestination == "" {
+		return "", &DestinationError{Status: http.StatusBadRequest, Err: errNoDestination}
+	}
+	return jumpDestination, nil
+}
+
+// ResolveStream lets clients open streams to any destination, as they can with the jump
+// destination header.
+func (JumpHeaderResolver) ResolveStream(_ context.Context, _ *http.Request, destination string) (string, error) {
+	return destination, nil
+}
+
+// TokenResolver resolves requests to the destination granted by the token sent in the
+// cf-access-token header. It validates the token and returns the destination it grants.
+// Requests with a missing or invalid token are refused with 403 Forbidden.
+type TokenResolver func(token string) (string, error)
+
+func (f TokenResolver) Resolve(_ context.Context, r *http.Request) (string, error) {
+	token := r.Header.Get(h2mux.CFAccessTokenHeader)
+	if token == "" {
+		return "", &DestinationError{Status: http.StatusForbidden, Err: errInvalidDestinationToken}
+	}
+	destination, err := f(token)
+	if err != nil {
+		return "", &DestinationError{Status: http.StatusForbidden, Err: errInvalidDestinationToken, Cause: err}
+	}
+	return destination, nil
+}
+
+// ResolveStream allows streams to the destination granted by the request's token.
+func (f TokenResolver) ResolveStream(ctx context.Context, r *http.Request, destination string) (string, error) {
+	granted, err := f.Resolve(ctx, r)
+	if err != nil {
+		return "", err
+	}
+	if destination != granted {
+		return "", &DestinationError{Status: http.StatusForbidden, Err: errInvalidDestinationToken}
+	}
+	return granted, nil
+}
+
+// RouterResolver resolves requests by the host they were sent to, ignoring any port, so one
+// proxy can serve several destinations. Requests for other hosts are resolved by Fallback,
+// or refused with 404 Not Found if there is none.
+type RouterResolver struct {
+	Routes   map[string]string
+	Fallback Resolver
+}
+
+func (rr *RouterResolver) Resolve(ctx context.Context, r *http.Request) (string, error) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if destination, ok := rr.Routes[host]; ok {
+		return destination, nil
+	}
+	if rr.Fallback != nil {
+		return rr.Fallback.Resolve(ctx, r)
+	}
+	return "", &DestinationError{Status: http.StatusNotFound, Err: errNoRoute}
+}
+
+// DefaultTargetHostHeader is the header TargetHostResolver reads by default.
+const DefaultTargetHostHeader = "Cf-Target-Host"
+
+// TargetHostResolver resolves requests by the host named in a header, for clients that can't
+// set SNI or the Host header for the destination but can add headers. The host, ignoring any
+// port and compared in lower case, must be in Targets, which maps it to its destination.
+// Requests without the header are resolved by Fallback, or refused with 400 Bad Request if
+// there is none, and requests for hosts that aren't in Targets are refused with 403
+// Forbidden. The default NewCachingResolver key doesn't include the header.
+type TargetHostResolver struct {
+	// Header is the header naming the host, defaulting to DefaultTargetHostHeader.
+	Header   string
+	Targets  map[string]string
+	Fallback Resolver
+}
+
+func (tr *TargetHostResolver) Resolve(ctx context.Context, r *http.Request) (string, error) {
+	header := tr.Header
+	if header == "" {
+		header = DefaultTargetHostHeader
+	}
+	host := r.Header.Get(header)
+	if host == "" {
+		if tr.Fallback != nil {
+			return tr.Fallback.Resolve(ctx, r)
+		}
+		return "", &DestinationError{Status: http.StatusBadRequest, Err: errNoTargetHost}
+	}
+	return tr.resolveHost(host)
+}
+
+// ResolveStream resolves streams opened to a host in Targets like requests naming it in the
+// header.
+func (tr *TargetHostResolver) ResolveStream(_ context.Context, _ *http.Request, host string) (string, error) {
+	return tr.resolveHost(host)
+}
+
+func (tr *TargetHostResolver) resolveHost(host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if destination, ok := tr.Targets[strings.ToLower(host)]; ok {
+		return destination, nil
+	}
+	return "", &DestinationError{Status: http.StatusForbidden, Err: errTargetHostNotAllowed}
+}
+
+// NewCachingResolver returns a Resolver that remembers what resolver resolved each request
+// to for ttl, and its failures for negativeTTL, so that expensive resolutions, such as
+// lookups in a service registry, aren't repeated for every connection. Requests are told
+// apart by key, which defaults to their host, jump destination and destination token. A
+// zero TTL doesn't cache that outcome.
+func NewCachingResolver(resolver Resolver, key func(r *http.Request) string, ttl, negativeTTL time.Duration) Resolver {
+	if key == nil {
+		key = defaultResolverCacheKey
+	}
+	return &cachingResolver{
+		resolver:    resolver,
+		key:         key,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]cachedDestination),
+	}
+}
+
+func defaultResolverCacheKey(r *http.Request) string {
+	return r.Host + "\x00" + r.Header.Get(h2mux.CFJumpDestinationHeader) + "\x00" + r.Header.Get(h2mux.CFAccessTokenHeader)
+}
+
+type cachingResolver struct {
+	resolver    Resolver
+	key         func(r *http.Request) string
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	lock    sync.Mutex
+	entries map[string]cachedDestination
+}
+
+type cachedDestination struct {
+	destination string
+	err         error
+	expires     time.Time
+}
+
+func (c *cachingResolver) Resolve(ctx context.Context, r *http.Request) (string, error) {
+	key := c.key(r)
+	now := time.Now()
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	c.lock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.destination, entry.err
+	}
+
+	destination, err := c.resolver.Resolve(ctx, r)
+	ttl := c.ttl
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+	if ttl > 0 {
+		c.store(key, cachedDestination{destination: destination, err: err, expires: now.Add(ttl)})
+	}
+	return destination, err
+}
+
+// store caches entry, making room by dropping expired entries. If every entry is current,
+// entry isn't cached.
+func (c *cachingResolver) store(key string, entry cachedDestination) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCachedDestinations {
+		now := time.Now()
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCachedDestinations {
+			return
+		}
+	}
+	c.entries[key] = entry
+}
@@ -0,0 +1,251 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resolveStatus resolves r with resolver, returning the destination, or the status and
+// message the client would be refused with.
+func resolveStatus(resolver Resolver, r *http.Request) (string, int, string) {
+	destination, err := resolver.Resolve(context.Background(), r)
+	if err == nil {
+		return destination, 0, ""
+	}
+	var destinationErr *DestinationError
+	if errors.As(err, &destinationErr) {
+		return "", destinationErr.Status, destinationErr.Err.Error()
+	}
+	return "", http.StatusBadRequest, err.Error()
+}
+
+func TestStaticResolver(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(h2mux.CFJumpDestinationHeader, "elsewhere:22")
+	destination, status, _ := resolveStatus(StaticResolver("localhost:22"), r)
+	assert.Equal(t, "localhost:22", destination)
+	assert.Zero(t, status)
+}
+
+func TestJumpHeaderResolver(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, status, message := resolveStatus(JumpHeaderResolver{}, r)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, errNoDestination.Error(), message)
+
+	r.Header.Set(h2mux.CFJumpDestinationHeader, "localhost:22")
+	destination, status, _ := resolveStatus(JumpHeaderResolver{}, r)
+	assert.Equal(t, "localhost:22", destination)
+	assert.Zero(t, status)
+}
+
+func TestTokenResolver(t *testing.T) {
+	resolver := TokenResolver(destinationFromTestToken)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, status, message := resolveStatus(resolver, r)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, errInvalidDestinationToken.Error(), message)
+
+	r.Header.Set(h2mux.CFAccessTokenHeader, "not-a-token")
+	_, status, message = resolveStatus(resolver, r)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, errInvalidDestinationToken.Error(), message)
+
+	r.Header.Set(h2mux.CFAccessTokenHeader, signDestinationToken(t, testTokenKey, "localhost:22"))
+	destination, status, _ := resolveStatus(resolver, r)
+	assert.Equal(t, "localhost:22", destination)
+	assert.Zero(t, status)
+}
+
+func TestRouterResolver(t *testing.T) {
+	resolver := &RouterResolver{Routes: map[string]string{
+		"ssh.example.com": "localhost:22",
+		"rdp.example.com": "localhost:3389",
+	}}
+	tests := []struct {
+		host        string
+		destination string
+		status      int
+	}{
+		{host: "ssh.example.com", destination: "localhost:22"},
+		{host: "rdp.example.com:443", destination: "localhost:3389"},
+		{host: "other.example.com", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = test.host
+		destination, status, _ := resolveStatus(resolver, r)
+		assert.Equal(t, test.destination, destination, test.host)
+		assert.Equal(t, test.status, status, test.host)
+	}
+
+	resolver.Fallback = JumpHeaderResolver{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "other.example.com"
+	r.Header.Set(h2mux.CFJumpDestinationHeader, "localhost:8080")
+	destination, _, _ := resolveStatus(resolver, r)
+	assert.Equal(t, "localhost:8080", destination)
+}
+
+func TestTargetHostResolver(t *testing.T) {
+	resolver := &TargetHostResolver{Targets: map[string]string{
+		"ssh.internal": "localhost:22",
+		"rdp.internal": "localhost:3389",
+	}}
+	tests := []struct {
+		target      string
+		destination string
+		status      int
+	}{
+		{target: "ssh.internal", destination: "localhost:22"},
+		{target: "RDP.internal:443", destination: "localhost:3389"},
+		{target: "db.internal", status: http.StatusForbidden},
+		{status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.target != "" {
+			r.Header.Set(DefaultTargetHostHeader, test.target)
+		}
+		destination, status, _ := resolveStatus(resolver, r)
+		assert.Equal(t, test.destination, destination, test.target)
+		assert.Equal(t, test.status, status, test.target)
+	}
+
+	resolver.Header = "X-Backend"
+	resolver.Fallback = JumpHeaderResolver{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(DefaultTargetHostHeader, "ssh.internal")
+	r.Header.Set(h2mux.CFJumpDestinationHeader, "localhost:8080")
+	destination, _, _ := resolveStatus(resolver, r)
+	assert.Equal(t, "localhost:8080", destination)
+}
+
+func TestTargetHostRouting(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	resolver := &TargetHostResolver{Targets: map[string]string{"echo.internal": backend.Addr().String()}}
+	addr := startTestProxy(t, "", DefaultStreamHandler, ProxyOptions{Resolver: resolver})
+
+	conn := dialTestProxy(t, addr, http.Header{DefaultTargetHostHeader: {"echo.internal"}})
+	require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("hello")))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(message))
+
+	_, resp, err := gws.DefaultDialer.Dial("ws://"+addr, http.Header{DefaultTargetHostHeader: {"elsewhere.internal"}})
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	var calls int32
+	errUnknown := errors.New("unknown host")
+	resolver := NewCachingResolver(ResolverFunc(func(_ context.Context, r *http.Request) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		if r.Host == "unknown.example.com" {
+			return "", errUnknown
+		}
+		return fmt.Sprintf("backend-%d:22", atomic.LoadInt32(&calls)), nil
+	}), nil, 300*time.Millisecond, 100*time.Millisecond)
+	resolve := func(host string) (string, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+		return resolver.Resolve(context.Background(), r)
+	}
+
+	// Successful resolutions are cached for the TTL
+	destination, err := resolve("known.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "backend-1:22", destination)
+	destination, _ = resolve("known.example.com")
+	assert.Equal(t, "backend-1:22", destination)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Failures are cached for the negative TTL
+	_, err = resolve("unknown.example.com")
+	assert.Equal(t, errUnknown, err)
+	_, err = resolve("unknown.example.com")
+	assert.Equal(t, errUnknown, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = resolve("unknown.example.com")
+	assert.Equal(t, errUnknown, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	destination, _ = resolve("known.example.com")
+	assert.Equal(t, "backend-1:22", destination)
+
+	time.Sleep(200 * time.Millisecond)
+	destination, _ = resolve("known.example.com")
+	assert.Equal(t, "backend-4:22", destination)
+}
+
+func TestResolverOption(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, "", DefaultStreamHandler, ProxyOptions{
+		Resolver: &RouterResolver{Routes: map[string]string{"127.0.0.1": backend.Addr().String()}},
+	})
+
+	conn := dialTestProxy(t, addr, nil)
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("routed")))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "routed", string(message))
+
+	header := http.Header{}
+	header.Set("Host", "other.example.com")
+	_, resp, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), header)
+	assert.Equal(t, gws.ErrBadHandshake, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestNetworkAuthenticationRequired(t *testing.T) {
+	const loginURL = "https://example.cloudflareaccess.com/login?redirect=a&b"
+	tests := []struct {
+		name         string
+		err          *NetworkAuthenticationError
+		expectedBody string
+	}{
+		{
+			name:         "default body",
+			err:          &NetworkAuthenticationError{LoginURL: loginURL, Cause: errors.New("no session")},
+			expectedBody: `href="https://example.cloudflareaccess.com/login?redirect=a&amp;b"`,
+		},
+		{
+			name:         "custom body",
+			err:          &NetworkAuthenticationError{LoginURL: loginURL, Body: []byte("log in first")},
+			expectedBody: "log in first",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := ResolverFunc(func(context.Context, *http.Request) (string, error) {
+				return "", test.err
+			})
+			h := newHandler(&testLogger{}, "", DefaultStreamHandler, ProxyOptions{Resolver: resolver})
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			assert.Equal(t, http.StatusNetworkAuthenticationRequired, w.Code)
+			assert.Equal(t, loginURL, w.Header().Get("Location"))
+			assert.Contains(t, w.Body.String(), test.expectedBody)
+		})
+	}
+}
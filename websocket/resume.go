@@ -0,0 +1,202 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// resumeTokenHeader carries the token for resuming a session. The proxy sends it on the
+// upgrade response, and a reconnecting client sends it back on its handshake request.
+const resumeTokenHeader = "Cf-Resume-Token"
+
+var errBackendDetached = errors.New("backend connection was detached for resuming the session")
+
+// resumableBackend is a backend connection that can outlive the client connection it was
+// dialed for, so that a client that reconnects after a network failure can resume its
+// session with the same backend connection.
+type resumableBackend struct {
+	conn        net.Conn
+	token       string
+	destination string
+	// readLock is held while reading, so that detaching can wait for the reader to stop
+	readLock sync.Mutex
+	// pending is data read from the backend as the previous client was detached, which is
+	// given to the next client
+	pending []byte
+	// failed is set once the backend is unusable, and the session can't be resumed
+	failed int32
+}
+
+func newResumableBackend(conn net.Conn, destination string) (*resumableBackend, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return &resumableBackend{conn: conn, token: hex.EncodeToString(token), destination: destination}, nil
+}
+
+func (b *resumableBackend) fail() {
+	atomic.StoreInt32(&b.failed, 1)
+}
+
+func (b *resumableBackend) usable() bool {
+	if atomic.LoadInt32(&b.failed) != 0 {
+		return false
+	}
+	// A lazy backend that hasn't been dialed has no session to resume, and its reads don't
+	// honour deadlines until it has been dialed.
+	if lazy, ok := b.conn.(*lazyBackendConn); ok && lazy.connected() == nil {
+		return false
+	}
+	return true
+}
+
+// attach returns a connection to the backend for a client connection.
+func (b *resumableBackend) attach() *backendAttachment {
+	return &backendAttachment{Conn: b.conn, backend: b}
+}
+
+// backendAttachment is the backend connection given to one client connection. Once
+// detached, it no longer reads from or writes to the backend, so that a reconnecting client
+// can take over.
+type backendAttachment struct {
+	net.Conn
+	backend  *resumableBackend
+	detached int32
+}
+
+func (a *backendAttachment) isDetached() bool {
+	return atomic.LoadInt32(&a.detached) != 0
+}
+
+func (a *backendAttachment) Read(p []byte) (int, error) {
+	a.backend.readLock.Lock()
+	defer a.backend.readLock.Unlock()
+	if a.isDetached() {
+		return 0, errBackendDetached
+	}
+	if len(a.backend.pending) > 0 {
+		n := copy(p, a.backend.pending)
+		a.backend.pending = a.backend.pending[n:]
+		return n, nil
+	}
+
+	n, err := a.Conn.Read(p)
+	if a.isDetached() {
+		// The client has gone, so keep the data for the next one
+		a.backend.pending = append(a.backend.pending, p[:n]...)
+		return 0, errBackendDetached
+	}
+	if err != nil {
+		a.backend.fail()
+	}
+	return n, err
+}
+
+func (a *backendAttachment) Write(p []byte) (int, error) {
+	if a.isDetached() {
+		return 0, errBackendDetached
+	}
+	n, err := a.Conn.Write(p)
+	if err != nil {
+		a.backend.fail()
+	}
+	return n, err
+}
+
+// Close closes the backend, ending the session, unless the attachment has been detached.
+func (a *backendAttachment) Close() error {
+	if a.isDetached() {
+		return nil
+	}
+	a.backend.fail()
+	return a.Conn.Close()
+}
+
+// detach stops the attachment using the backend, waiting for any read in progress to
+// finish. It reports whether the backend is still usable.
+func (a *backendAttachment) detach() bool {
+	if !a.backend.usable() {
+		return false
+	}
+	atomic.StoreInt32(&a.detached, 1)
+	// Interrupt any read in progress, and wait for it to finish
+	a.Conn.SetReadDeadline(time.Now())
+	a.backend.readLock.Lock()
+	a.Conn.SetReadDeadline(time.Time{})
+	a.backend.readLock.Unlock()
+	return a.backend.usable()
+}
+
+// sessionStore holds the backends of clients that went away, until they resume their
+// session or the TTL expires.
+type sessionStore struct {
+	ttl      time.Duration
+	lock     sync.Mutex
+	sessions map[string]*parkedSession
+}
+
+type parkedSession struct {
+	backend *resumableBackend
+	timer   *time.Timer
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{ttl: ttl, sessions: make(map[string]*parkedSession)}
+}
+
+// resume returns the backend of the parked session with the token, if it is for the same
+// destination. It returns nil if the store is nil or there is no such session.
+func (s *sessionStore) resume(token, destination string) *resumableBackend {
+	if s == nil || token == "" {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[token]
+	if !ok || session.backend.destination != destination {
+		return nil
+	}
+	delete(s.sessions, token)
+	session.timer.Stop()
+	return session.backend
+}
+
+// park keeps the backend of a client connection open for the client to resume its session,
+// if the client went away without a close frame and the backend is still usable. The
+// backend is closed if the session isn't resumed within the TTL. It reports whether the
+// session was parked; otherwise the caller should close the backend.
+func (s *sessionStore) park(attachment *backendAttachment, closeReceived <-chan struct{}) bool {
+	if s == nil || attachment == nil {
+		return false
+	}
+	select {
+	case <-closeReceived:
+		// The client ended the session deliberately
+		return false
+	default:
+	}
+	if !attachment.detach() {
+		return false
+	}
+
+	backend := attachment.backend
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session := &parkedSession{backend: backend}
+	session.timer = time.AfterFunc(s.ttl, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.sessions[backend.token] == session {
+			delete(s.sessions, backend.token)
+			backend.conn.Close()
+		}
+	})
+	s.sessions[backend.token] = session
+	return true
+}
@@ -0,0 +1,111 @@
+package websocket
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingEchoBackend is an echo backend that counts the connections it accepts.
+func countingEchoBackend(t *testing.T, accepted *int32) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					conn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func TestSessionResume(t *testing.T) {
+	var accepted int32
+	backend := countingEchoBackend(t, &accepted)
+	events := newRecordingEventHandler()
+	options := ProxyOptions{SessionResumeTTL: time.Minute, EventHandler: events, CloseGracePeriod: 10 * time.Millisecond}
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, options)
+
+	echo := func(conn *gws.Conn, message string) {
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte(message)))
+		_, received, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, message, string(received))
+	}
+
+	conn, resp, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	token := resp.Header.Get(resumeTokenHeader)
+	assert.NotEmpty(t, token)
+	<-events.opened
+	echo(conn, "before disconnecting")
+
+	// Drop the connection without a close frame, as a network failure would
+	conn.UnderlyingConn().Close()
+	<-events.closed
+
+	header := http.Header{}
+	header.Set(resumeTokenHeader, token)
+	resumed, resp, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), header)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resumed.Close()
+	<-events.opened
+	assert.Equal(t, token, resp.Header.Get(resumeTokenHeader))
+	echo(resumed, "after resuming")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&accepted))
+
+	// Closing with a close frame ends the session
+	resumed.WriteMessage(gws.CloseMessage, gws.FormatCloseMessage(gws.CloseNormalClosure, ""))
+	<-events.closed
+	fresh, resp, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), header)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fresh.Close()
+	assert.NotEqual(t, token, resp.Header.Get(resumeTokenHeader))
+	echo(fresh, "new session")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&accepted))
+}
+
+func TestSessionResumeExpires(t *testing.T) {
+	var accepted int32
+	backend := countingEchoBackend(t, &accepted)
+	conn, err := net.Dial("tcp", backend.Addr().String())
+	assert.NoError(t, err)
+
+	store := newSessionStore(10 * time.Millisecond)
+	resumable, err := newResumableBackend(conn, backend.Addr().String())
+	assert.NoError(t, err)
+	assert.True(t, store.park(resumable.attach(), make(chan struct{})))
+	assert.Nil(t, store.resume(resumable.token, "elsewhere:22"))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, store.resume(resumable.token, backend.Addr().String()))
+	_, err = conn.Write([]byte("closed"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+// drainPollInterval is how often Shutdown checks whether the connections have finished.
+const drainPollInterval = 50 * time.Millisecond
+
+// ProxyServer is a websocket proxy server. Unlike StartProxyServer, it can be inspected while
+// it serves, and shut down gracefully.
+type ProxyServer struct {
+	logger logger.Service
+	// handler is the handler the server was created with. It holds the state shared by
+	// every configuration, such as the connections being proxied.
+	handler *handler
+	// serving holds the handler for the current configuration, see UpdateConfig
+	serving    *reloadableHandler
+	httpServer *http.Server
+}
+
+// NewProxyServer returns a proxy server, see StartProxyServerWithOptions.
+func NewProxyServer(logger logger.Service, staticHost string, streamHandler func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header), options ProxyOptions) (*ProxyServer, error) {
+	return NewContextProxyServer(logger, staticHost, IgnoreContext(streamHandler), options)
+}
+
+// NewContextProxyServer is NewProxyServer with a stream handler that is passed a context for
+// the request, see ProxyOptions.StreamContext.
+func NewContextProxyServer(logger logger.Service, staticHost string, streamHandler ContextStreamHandler, options ProxyOptions) (*ProxyServer, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	h := newContextHandler(logger, staticHost, streamHandler, options)
+	serving := newReloadableHandler(h)
+	return &ProxyServer{
+		logger:     logger,
+		handler:    h,
+		serving:    serving,
+		httpServer: newHTTPServer(serving, h),
+	}, nil
+}
+
+// Serve proxies connections accepted from listener until shutdownC is closed or Shutdown is
+// called. Closing shutdownC stops the server immediately, leaving connections being proxied
+// to finish by themselves.
+func (s *ProxyServer) Serve(listener net.Listener, shutdownC <-chan struct{}) error {
+	s.handler.backendHealth.start(s.logger, shutdownC)
+	s.handler.backendPool.start(s.logger, shutdownC)
+	s.handler.watchConnections(shutdownC)
+	return serveProxy(s.logger, s.httpServer, listener, shutdownC)
+}
+
+// Shutdown stops the server accepting connections and drains the connections being proxied.
+// Each client is sent a 1001 (going away) close frame, and the connections still open when
+// ctx is done are closed. It returns how many connections were closed that way, along with
+// ctx's error, so operators can tune how long they allow for draining.
+func (s *ProxyServer) Shutdown(ctx context.Context) (forcedClosed int, err error) {
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return s.handler.connections.closeAll(), err
+	}
+	s.handler.connections.goingAway()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for s.handler.connections.count() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if forcedClosed = s.handler.connections.closeAll(); forcedClosed > 0 {
+				s.logger.Infof("Closed %d websocket connections that didn't finish draining", forcedClosed)
+				return forcedClosed, ctx.Err()
+			}
+			return 0, nil
+		}
+	}
+	return 0, nil
+}
+
+// CloseConnection ends the connection with the given ID, as listed by Connections, for
+// example when an operator terminates a tunnel. The client is sent a close frame with code
+// and reason, which must be at most 123 bytes, and the connection is closed if the client
+// hasn't finished it within the close grace period. It returns an error if there is no open
+// connection with the ID.
+func (s *ProxyServer) CloseConnection(id string, code int, reason string) error {
+	return s.handler.connections.close(id, code, reason, s.serving.load().options.CloseGracePeriod)
+}
+
+// Connections returns a snapshot of the connections being proxied, oldest first.
+func (s *ProxyServer) Connections() []ConnectionInfo {
+	return s.handler.connections.snapshot()
+}
+
+// ConnectionsHandler returns a handler that responds with Connections as JSON, for an admin
+// endpoint. It should only be served to operators.
+func (s *ProxyServer) ConnectionsHandler() http.Handler {
+	return s.handler.connections.connectionsHandler()
+}
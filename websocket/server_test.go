@@ -0,0 +1,85 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownDrain(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	server, err := NewProxyServer(&testLogger{}, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{CloseGracePeriod: 10 * time.Millisecond})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Serve(listener, shutdownC) }()
+
+	// The cooperative client answers the close frame, which gorilla does while reading
+	cooperative := dialTestProxy(t, listener.Addr().String(), nil)
+	go func() {
+		for {
+			if _, _, err := cooperative.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// The stuck client never reads, so it never sees the close frame
+	stuck := dialTestProxy(t, listener.Addr().String(), nil)
+	require.Eventually(t, func() bool { return len(server.Connections()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	forcedClosed, err := server.Shutdown(ctx)
+	assert.Equal(t, 1, forcedClosed)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.NoError(t, <-serveErr)
+
+	// The stuck client was sent a close frame, and then its connection was closed
+	stuck.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = stuck.ReadMessage()
+	closeErr, ok := err.(*gws.CloseError)
+	require.True(t, ok, err)
+	assert.Equal(t, gws.CloseGoingAway, closeErr.Code)
+	_, _, err = stuck.ReadMessage()
+	assert.Error(t, err)
+
+	_, err = net.Dial("tcp", listener.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestShutdownAllCooperative(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	server, err := NewProxyServer(&testLogger{}, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{CloseGracePeriod: 10 * time.Millisecond})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go server.Serve(listener, shutdownC)
+
+	conn := dialTestProxy(t, listener.Addr().String(), nil)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	require.Eventually(t, func() bool { return len(server.Connections()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	forcedClosed, err := server.Shutdown(ctx)
+	assert.Equal(t, 0, forcedClosed)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,29 @@
+package websocket
+
+import (
+	"io"
+	"time"
+
+	"github.com/cloudflare/cloudflared/logger"
+	"github.com/gorilla/websocket"
+)
+
+// sessionExpiredReason is sent in the close frame when a connection reaches the maximum
+// session duration.
+const sessionExpiredReason = "session expired"
+
+// limitSession ends the connection once it has been open for the maximum session duration,
+// however active it is. The client is sent a 1001 (going away) close frame, so it knows to
+// reconnect, and the backend is closed to stop the proxying. The returned timer must be
+// stopped when the connection ends. It returns nil if there is no maximum.
+func (h *handler) limitSession(log logger.Service, conn *websocket.Conn, backend io.Closer) *time.Timer {
+	if h.options.MaxSessionDuration <= 0 {
+		return nil
+	}
+	return time.AfterFunc(h.options.MaxSessionDuration, func() {
+		log.Debugf("Closing connection from %s after the maximum session duration of %s", conn.RemoteAddr(), h.options.MaxSessionDuration)
+		message := websocket.FormatCloseMessage(websocket.CloseGoingAway, sessionExpiredReason)
+		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+		backend.Close()
+	})
+}
@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxSessionDuration(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	const maxDuration = 200 * time.Millisecond
+
+	for _, options := range []ProxyOptions{
+		{MaxSessionDuration: maxDuration},
+		{MaxSessionDuration: maxDuration, WebsocketBackend: true},
+	} {
+		destination := backend.Addr().String()
+		if options.WebsocketBackend {
+			destination = strings.TrimPrefix(echoWebsocketBackend(t).URL, "http://")
+		}
+		addr := startTestProxy(t, destination, DefaultStreamHandler, options)
+		// The session starts during the handshake
+		start := time.Now()
+		conn := dialTestProxy(t, addr, nil)
+
+		// Keep the connection busy until it is closed
+		var err error
+		for err == nil && time.Since(start) < 5*time.Second {
+			if err = conn.WriteMessage(gws.BinaryMessage, []byte("active")); err == nil {
+				_, _, err = conn.ReadMessage()
+			}
+		}
+
+		assert.True(t, time.Since(start) >= maxDuration)
+		closeErr, ok := err.(*gws.CloseError)
+		if assert.True(t, ok, err) {
+			assert.Equal(t, gws.CloseGoingAway, closeErr.Code)
+			assert.Equal(t, sessionExpiredReason, closeErr.Text)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// connStats counts the data proxied over a connection. It is safe for concurrent use,
+// and a nil *connStats counts nothing.
+type connStats struct {
+	start time.Time
+	// toBackend is the number of bytes read from the client
+	toBackend int64
+	// toClient is the number of bytes written to the client
+	toClient int64
+	// wire, when set, counts the bytes written to the client's connection, see
+	// ProxyOptions.OnCompressionStats
+	wire *writeCountingConn
+}
+
+func newConnStats() *connStats {
+	return &connStats{start: time.Now()}
+}
+
+func (s *connStats) addToBackend(n int64) {
+	if s != nil {
+		atomic.AddInt64(&s.toBackend, n)
+	}
+}
+
+func (s *connStats) addToClient(n int64) {
+	if s != nil {
+		atomic.AddInt64(&s.toClient, n)
+	}
+}
+
+// totals returns the bytes sent to the backend and the client so far.
+func (s *connStats) totals() (toBackend, toClient int64) {
+	return atomic.LoadInt64(&s.toBackend), atomic.LoadInt64(&s.toClient)
+}
+
+// connectionClosed deregisters a connection that ended for reason, and reports its final
+// statistics to the metrics, the OnClose callback and the EventHandler.
+func (h *handler) connectionClosed(event ConnectionEvent, stats *connStats, reason string) {
+	h.connections.remove(event.ID)
+	connectionsClosed.WithLabelValues(reason).Inc()
+	toBackend, toClient := stats.totals()
+	duration := time.Since(stats.start)
+	if event.span != nil {
+		event.span.AddEvent("closed", map[string]string{
+			"reason":           reason,
+			"bytes.to_backend": strconv.FormatInt(toBackend, 10),
+			"bytes.to_client":  strconv.FormatInt(toClient, 10),
+		})
+	}
+	if h.options.OnClose != nil {
+		h.options.OnClose(event.ID, toBackend, toClient, duration)
+	}
+	if h.options.EventHandler != nil {
+		h.options.EventHandler.ConnectionClosed(event, toBackend, toClient, duration)
+	}
+	if h.options.OnCompressionStats != nil && stats.wire != nil {
+		h.options.OnCompressionStats(event.ID, toClient, stats.wire.count())
+	}
+}
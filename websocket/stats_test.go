@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type closedConnection struct {
+	connID              string
+	toBackend, toClient int64
+	duration            time.Duration
+}
+
+func TestOnCloseTotals(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	closedC := make(chan closedConnection, 1)
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+		OnClose: func(connID string, toBackend, toClient int64, duration time.Duration) {
+			closedC <- closedConnection{connID, toBackend, toClient, duration}
+		},
+	})
+	conn := dialTestProxy(t, addr, nil)
+
+	var sent int64
+	for _, size := range []int{1, 100, 4096} {
+		message := make([]byte, size)
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, message))
+		sent += int64(size)
+		var echoed int
+		for echoed < size {
+			_, reply, err := conn.ReadMessage()
+			if !assert.NoError(t, err) {
+				return
+			}
+			echoed += len(reply)
+		}
+	}
+	// Drop the connection without a close handshake
+	conn.UnderlyingConn().Close()
+
+	select {
+	case closed := <-closedC:
+		assert.NotEmpty(t, closed.connID)
+		assert.Equal(t, sent, closed.toBackend)
+		assert.Equal(t, sent, closed.toClient)
+		assert.True(t, closed.duration > 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose was not called")
+	}
+}
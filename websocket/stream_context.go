@@ -0,0 +1,27 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// ContextStreamHandler is a stream handler that is also passed a context for the request, so
+// that it can use values computed when the connection was accepted, such as the client's
+// identity or routing decisions. See ProxyOptions.StreamContext.
+type ContextStreamHandler func(ctx context.Context, wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header)
+
+// IgnoreContext adapts a stream handler that doesn't take a context.
+func IgnoreContext(streamHandler func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header)) ContextStreamHandler {
+	return func(_ context.Context, wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header) {
+		streamHandler(wsConn, remoteConn, requestHeaders)
+	}
+}
+
+// streamContext returns the context to pass to the stream handler for r.
+func (h *handler) streamContext(r *http.Request) context.Context {
+	if h.options.StreamContext != nil {
+		return h.options.StreamContext(r)
+	}
+	return r.Context()
+}
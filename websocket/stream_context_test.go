@@ -0,0 +1,76 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type identityKey struct{}
+
+func TestContextStreamHandler(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	identityC := make(chan interface{}, 1)
+	streamHandler := func(ctx context.Context, wsConn *Conn, remoteConn net.Conn, _ http.Header) {
+		identityC <- ctx.Value(identityKey{})
+	}
+	server, err := NewContextProxyServer(&testLogger{}, backend.Addr().String(), streamHandler, ProxyOptions{
+		StreamContext: func(r *http.Request) context.Context {
+			return context.WithValue(r.Context(), identityKey{}, r.Header.Get("X-Identity"))
+		},
+		CloseGracePeriod: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go server.Serve(listener, shutdownC)
+
+	header := http.Header{}
+	header.Set("X-Identity", "user@example.com")
+	dialTestProxy(t, listener.Addr().String(), header)
+	select {
+	case identity := <-identityC:
+		assert.Equal(t, "user@example.com", identity)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream handler was not called")
+	}
+}
+
+type deploymentKey struct{}
+
+func TestBaseContext(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	deploymentC := make(chan interface{}, 1)
+	streamHandler := func(ctx context.Context, wsConn *Conn, remoteConn net.Conn, _ http.Header) {
+		deploymentC <- ctx.Value(deploymentKey{})
+	}
+	server, err := NewContextProxyServer(&testLogger{}, backend.Addr().String(), streamHandler, ProxyOptions{
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), deploymentKey{}, "eu-west")
+		},
+		CloseGracePeriod: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go server.Serve(listener, shutdownC)
+
+	dialTestProxy(t, listener.Addr().String(), nil)
+	select {
+	case deployment := <-deploymentC:
+		assert.Equal(t, "eu-west", deployment)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream handler was not called")
+	}
+}
@@ -0,0 +1,215 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// dialRawWebsocket performs the websocket handshake with the proxy at addr, adding header to
+// the request, and returns the raw connection, so that tests can send and inspect frames
+// in ways gorilla's client doesn't allow.
+func dialRawWebsocket(t *testing.T, addr string, header http.Header) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := testRequest(t, fmt.Sprintf("http://%s/", addr), nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	assert.NoError(t, req.Write(conn))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	return conn, br
+}
+
+// writeRawFrame writes a single frame with the given first byte (FIN, reserved bits and
+// opcode) and a short payload, masking it if masked is set.
+func writeRawFrame(t *testing.T, w io.Writer, b0 byte, masked bool, payload []byte) {
+	frame := []byte{b0, byte(len(payload))}
+	if len(payload) >= 126 {
+		frame[1] = 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+	if masked {
+		key := []byte{1, 2, 3, 4}
+		frame[1] |= 0x80
+		frame = append(frame, key...)
+		for i, b := range payload {
+			frame = append(frame, b^key[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := w.Write(frame)
+	assert.NoError(t, err)
+}
+
+// readRawFrame reads an unmasked frame from the server, returning its first byte (FIN,
+// reserved bits and opcode) and payload.
+func readRawFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		io.ReadFull(r, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		io.ReadFull(r, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// readCloseCode reads frames from the server until a close frame, and returns its code.
+func readCloseCode(t *testing.T, r *bufio.Reader) int {
+	for {
+		b0, payload, err := readRawFrame(r)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		if b0&0x0f == gws.CloseMessage {
+			if len(payload) < 2 {
+				return gws.CloseNoStatusReceived
+			}
+			return int(binary.BigEndian.Uint16(payload))
+		}
+	}
+}
+
+func TestStrictFrameValidation(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{StrictFrameValidation: true})
+
+	tests := []struct {
+		name     string
+		b0       byte
+		masked   bool
+		payload  []byte
+		expected int
+	}{
+		{
+			name:     "unmasked client frame",
+			b0:       0x80 | gws.BinaryMessage,
+			payload:  []byte("unmasked"),
+			expected: gws.CloseProtocolError,
+		},
+		{
+			name:     "reserved bit set",
+			b0:       0x80 | 0x40 | gws.BinaryMessage,
+			masked:   true,
+			payload:  []byte("reserved"),
+			expected: gws.CloseProtocolError,
+		},
+		{
+			name:     "invalid UTF-8 text",
+			b0:       0x80 | gws.TextMessage,
+			masked:   true,
+			payload:  []byte{0xff, 0xfe, 0xfd},
+			expected: gws.CloseInvalidFramePayloadData,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, r := dialRawWebsocket(t, addr, nil)
+			writeRawFrame(t, conn, test.b0, test.masked, test.payload)
+			assert.Equal(t, test.expected, readCloseCode(t, r))
+		})
+	}
+}
+
+// A compressed frame from a client that didn't negotiate compression is a protocol error,
+// whether or not the proxy supports compression and strict validation is enabled.
+func TestCompressedFrameWithoutNegotiation(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		options ProxyOptions
+	}{
+		{name: "compression disabled"},
+		{name: "compression not offered", options: ProxyOptions{ScalableCompression: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, test.options)
+			conn, r := dialRawWebsocket(t, addr, nil)
+			writeRawFrame(t, conn, 0x80|0x40|gws.BinaryMessage, true, []byte("compressed?"))
+			assert.Equal(t, gws.CloseProtocolError, readCloseCode(t, r))
+		})
+	}
+}
+
+func TestInvalidUTF8AllowedWithoutStrictMode(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{})
+
+	conn := dialTestProxy(t, addr, nil)
+	invalid := []byte{0xff, 0xfe, 0xfd}
+	assert.NoError(t, conn.WriteMessage(gws.TextMessage, invalid))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, invalid, message)
+}
+
+func TestMalformedWebsocketKey(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{StrictHandshakeValidation: true})
+
+	tests := []struct {
+		name     string
+		key      string
+		expected int
+	}{
+		{name: "valid", key: "dGhlIHNhbXBsZSBub25jZQ==", expected: http.StatusSwitchingProtocols},
+		{name: "not base64", key: "not a websocket key!", expected: http.StatusBadRequest},
+		{name: "too short", key: "c2hvcnQ=", expected: http.StatusBadRequest},
+		{name: "too long", key: "dGhpcyBub25jZSBpcyB0b28gbG9uZw==", expected: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+addr, nil)
+			assert.NoError(t, err)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-Websocket-Version", "13")
+			req.Header.Set("Sec-Websocket-Key", test.key)
+			resp, err := http.DefaultClient.Do(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, test.expected, resp.StatusCode)
+		})
+	}
+}
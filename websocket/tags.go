@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+const (
+	defaultMaxTags = 16
+	// maxTagValueLength truncates long tag values, so clients can't bloat every log line.
+	maxTagValueLength = 256
+)
+
+// connectionTags returns the tags attached to the request by headers starting with the
+// tag header prefix, keyed by the lower case remainder of the header name. Only the first
+// MaxTags tags, in order of name, are kept.
+func (h *handler) connectionTags(r *http.Request) map[string]string {
+	if h.options.TagHeaderPrefix == "" {
+		return nil
+	}
+	prefix := http.CanonicalHeaderKey(h.options.TagHeaderPrefix)
+	var names []string
+	for header := range r.Header {
+		if strings.HasPrefix(header, prefix) && len(header) > len(prefix) {
+			names = append(names, header)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	maxTags := h.options.MaxTags
+	if maxTags <= 0 {
+		maxTags = defaultMaxTags
+	}
+	if len(names) > maxTags {
+		h.logger.Debugf("Ignoring %d tags from %s over the limit of %d", len(names)-maxTags, r.RemoteAddr, maxTags)
+		names = names[:maxTags]
+	}
+
+	tags := make(map[string]string, len(names))
+	for _, header := range names {
+		value := r.Header.Get(header)
+		if len(value) > maxTagValueLength {
+			value = value[:maxTagValueLength]
+		}
+		tags[strings.ToLower(header[len(prefix):])] = value
+	}
+	return tags
+}
+
+// connectionLogger returns a logger for a connection's log lines, which appends its tags
+// to each line.
+func (h *handler) connectionLogger(tags map[string]string) logger.Service {
+	if len(tags) == 0 {
+		return h.logger
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, tags[name])
+	}
+	return &taggedLogger{Service: h.logger, suffix: " tags=[" + strings.Join(pairs, " ") + "]"}
+}
+
+// taggedLogger appends a connection's tags to each line it logs.
+type taggedLogger struct {
+	logger.Service
+	suffix string
+}
+
+func (l *taggedLogger) Error(message string) { l.Service.Error(message + l.suffix) }
+func (l *taggedLogger) Info(message string)  { l.Service.Info(message + l.suffix) }
+func (l *taggedLogger) Debug(message string) { l.Service.Debug(message + l.suffix) }
+func (l *taggedLogger) Fatal(message string) { l.Service.Fatal(message + l.suffix) }
+
+func (l *taggedLogger) Errorf(format string, args ...interface{}) {
+	l.Service.Error(fmt.Sprintf(format, args...) + l.suffix)
+}
+func (l *taggedLogger) Infof(format string, args ...interface{}) {
+	l.Service.Info(fmt.Sprintf(format, args...) + l.suffix)
+}
+func (l *taggedLogger) Debugf(format string, args ...interface{}) {
+	l.Service.Debug(fmt.Sprintf(format, args...) + l.suffix)
+}
+func (l *taggedLogger) Fatalf(format string, args ...interface{}) {
+	l.Service.Fatal(fmt.Sprintf(format, args...) + l.suffix)
+}
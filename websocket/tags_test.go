@@ -0,0 +1,91 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingEventHandler sends the events it receives to channels.
+type recordingEventHandler struct {
+	opened chan ConnectionEvent
+	closed chan ConnectionEvent
+}
+
+func newRecordingEventHandler() *recordingEventHandler {
+	return &recordingEventHandler{
+		opened: make(chan ConnectionEvent, 1),
+		closed: make(chan ConnectionEvent, 1),
+	}
+}
+
+func (e *recordingEventHandler) ConnectionOpened(event ConnectionEvent) {
+	e.opened <- event
+}
+
+func (e *recordingEventHandler) ConnectionClosed(event ConnectionEvent, toBackend, toClient int64, duration time.Duration) {
+	e.closed <- event
+}
+
+func TestConnectionTags(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	tests := []struct {
+		maxTags   int
+		tags      map[string]string
+		logSuffix string
+	}{
+		{
+			tags:      map[string]string{"env": "prod", "team": "core"},
+			logSuffix: `tags=[env="prod" team="core"]`,
+		},
+		{
+			maxTags:   1,
+			tags:      map[string]string{"env": "prod"},
+			logSuffix: `tags=[env="prod"]`,
+		},
+	}
+	for _, test := range tests {
+		log := &testLogger{}
+		events := newRecordingEventHandler()
+		options := ProxyOptions{TagHeaderPrefix: "Cf-Tag-", MaxTags: test.maxTags, EventHandler: events, CloseGracePeriod: 10 * time.Millisecond}
+		server := httptest.NewServer(newHandler(log, backend.Addr().String(), DefaultStreamHandler, options))
+
+		header := http.Header{}
+		header.Set("Cf-Tag-Team", "core")
+		header.Set("Cf-Tag-Env", "prod")
+		header.Set("Cf-Other", "ignored")
+		conn := dialTestProxy(t, server.Listener.Addr().String(), header)
+
+		opened := <-events.opened
+		assert.Equal(t, test.tags, opened.Tags)
+		assert.Equal(t, backend.Addr().String(), opened.Destination)
+		conn.Close()
+		closed := <-events.closed
+		assert.Equal(t, opened, closed)
+		server.Close()
+
+		dialed := false
+		for _, line := range log.Lines() {
+			if strings.HasPrefix(line, fmt.Sprintf("Dialed backend %s", backend.Addr())) {
+				dialed = true
+				assert.True(t, strings.HasSuffix(line, test.logSuffix), line)
+			}
+		}
+		assert.True(t, dialed)
+	}
+}
+
+func TestConnectionTagsDisabled(t *testing.T) {
+	h := newHandler(&testLogger{}, "localhost:1", DefaultStreamHandler, ProxyOptions{})
+	req := testRequest(t, "http://example.com/", nil)
+	req.Header.Set("Cf-Tag-Team", "core")
+	assert.Nil(t, h.connectionTags(req))
+	assert.Equal(t, h.logger, h.connectionLogger(nil))
+}
@@ -0,0 +1,34 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+// logTLSParameters logs the TLS version and cipher suite the client negotiated, for auditing,
+// when the proxy terminates TLS. Plaintext connections aren't logged.
+func logTLSParameters(log logger.Service, r *http.Request) {
+	if r.TLS == nil {
+		return
+	}
+	log.Infof("Client %s negotiated %s with cipher suite %s", r.RemoteAddr, tlsVersionName(r.TLS.Version), tls.CipherSuiteName(r.TLS.CipherSuite))
+}
+
+// tlsVersionName returns the name of a TLS version, such as TLS 1.3.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("TLS version 0x%04X", version)
+	}
+}
@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflared/tlsconfig"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogTLSParameters(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	helloCert, err := tlsconfig.GetHelloCertificate()
+	assert.NoError(t, err)
+
+	for _, useTLS := range []bool{false, true} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		scheme := "ws"
+		if useTLS {
+			scheme = "wss"
+			listener = tls.NewListener(listener, &tls.Config{
+				Certificates: []tls.Certificate{helloCert},
+				MaxVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{
+					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				},
+			})
+		}
+		log := &testLogger{}
+		shutdownC := make(chan struct{})
+		events := newRecordingEventHandler()
+		options := ProxyOptions{EventHandler: events, CloseGracePeriod: 10 * time.Millisecond}
+		go StartProxyServerWithOptions(log, listener, backend.Addr().String(), shutdownC, DefaultStreamHandler, options)
+
+		dialer := gws.Dialer{TLSClientConfig: websocketClientTLSConfig(t)}
+		conn, _, err := dialer.Dial(fmt.Sprintf("%s://%s/", scheme, listener.Addr()), nil)
+		if assert.NoError(t, err) {
+			<-events.opened
+			conn.Close()
+			<-events.closed
+		}
+		close(shutdownC)
+
+		var negotiated []string
+		for _, line := range log.Lines() {
+			if strings.Contains(line, " negotiated ") {
+				negotiated = append(negotiated, line)
+			}
+		}
+		if !useTLS {
+			assert.Empty(t, negotiated)
+			continue
+		}
+		if assert.Len(t, negotiated, 1) {
+			assert.Contains(t, negotiated[0], "negotiated TLS 1.2 with cipher suite TLS_ECDHE_")
+			assert.Contains(t, negotiated[0], "_WITH_AES_128_GCM_SHA256")
+		}
+	}
+}
+
+func TestTLSVersionName(t *testing.T) {
+	assert.Equal(t, "TLS 1.3", tlsVersionName(tls.VersionTLS13))
+	assert.Equal(t, "TLS version 0x0300", tlsVersionName(0x0300))
+}
@@ -0,0 +1,49 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+// tlsHandshakeRecordType is the first byte a client sends to start a TLS handshake.
+const tlsHandshakeRecordType = 0x16
+
+// tlsMismatchListener diagnoses clients that try to use TLS with a proxy that doesn't
+// terminate TLS, typically a wss:// URL used for a ws:// proxy. Without this, the client
+// just gets a cryptic handshake failure and nothing is logged.
+type tlsMismatchListener struct {
+	net.Listener
+	logger logger.Service
+}
+
+func (l *tlsMismatchListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := conn.(*tls.Conn); ok {
+		return conn, nil
+	}
+	return &tlsMismatchConn{Conn: conn, logger: l.logger}, nil
+}
+
+// tlsMismatchConn checks whether the first data read from a plaintext connection is a TLS
+// handshake.
+type tlsMismatchConn struct {
+	net.Conn
+	logger  logger.Service
+	checked bool
+}
+
+func (c *tlsMismatchConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.checked && n > 0 {
+		c.checked = true
+		if p[0] == tlsHandshakeRecordType {
+			c.logger.Errorf("Client %s started a TLS handshake, but the websocket proxy on %s doesn't use TLS: connect with ws:// rather than wss://, or put the proxy behind TLS", c.RemoteAddr(), c.LocalAddr())
+		}
+	}
+	return n, err
+}
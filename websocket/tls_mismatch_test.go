@@ -0,0 +1,43 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSMismatchDiagnostic(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	log := &testLogger{}
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go StartProxyServer(log, listener, "localhost:1", shutdownC, DefaultStreamHandler)
+
+	diagnosed := func() bool {
+		for _, line := range log.Lines() {
+			if strings.Contains(line, "started a TLS handshake") && strings.Contains(line, "connect with ws://") {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A plaintext request isn't diagnosed
+	resp, err := http.Get("http://" + listener.Addr().String())
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.False(t, diagnosed())
+
+	tlsConn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		tlsConn.Close()
+	}
+	assert.Error(t, err)
+	assert.Eventually(t, diagnosed, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+const defaultSessionTicketKeyRotation = time.Hour
+
+// ALPN protocol IDs for HTTP/2 and HTTP/1.1.
+const (
+	http2Proto = "h2"
+	http1Proto = "http/1.1"
+)
+
+var errNoSessionTicketKeys = errors.New("no TLS session ticket keys")
+
+// StartTLSProxyServer is StartProxyServerWithOptions for a proxy that terminates TLS itself,
+// with tlsConfig, on a plain TCP listener. The TLS options in options override tlsConfig.
+func StartTLSProxyServer(logger logger.Service, listener net.Listener, staticHost string, shutdownC <-chan struct{}, streamHandler func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header), tlsConfig *tls.Config, options ProxyOptions) error {
+	server, err := NewProxyServer(logger, staticHost, streamHandler, options)
+	if err != nil {
+		return err
+	}
+	tlsConfig = tlsConfig.Clone()
+	hardenTLSConfig(tlsConfig, options)
+	if options.SessionTicketKeys != nil {
+		keys, err := sessionTicketKeys(options.SessionTicketKeys)
+		if err != nil {
+			return err
+		}
+		tlsConfig.SetSessionTicketKeys(keys)
+		rotation := options.SessionTicketKeyRotation
+		if rotation <= 0 {
+			rotation = defaultSessionTicketKeyRotation
+		}
+		go rotateSessionTicketKeys(logger, tlsConfig, options.SessionTicketKeys, rotation, shutdownC)
+	}
+	return server.Serve(tls.NewListener(listener, tlsConfig), shutdownC)
+}
+
+// hardenTLSConfig applies the TLS options to tlsConfig.
+func hardenTLSConfig(tlsConfig *tls.Config, options ProxyOptions) {
+	if options.TLSMinVersion != 0 {
+		tlsConfig.MinVersion = options.TLSMinVersion
+	}
+	if len(options.TLSCipherSuites) > 0 {
+		tlsConfig.CipherSuites = options.TLSCipherSuites
+		tlsConfig.PreferServerCipherSuites = true
+	}
+	nextProtos := make([]string, 0, len(tlsConfig.NextProtos)+1)
+	if options.TLSEnableHTTP2 {
+		nextProtos = append(nextProtos, http2Proto)
+	}
+	for _, proto := range tlsConfig.NextProtos {
+		if proto != http2Proto {
+			nextProtos = append(nextProtos, proto)
+		}
+	}
+	if len(nextProtos) > 0 && !containsString(nextProtos, http1Proto) {
+		nextProtos = append(nextProtos, http1Proto)
+	}
+	tlsConfig.NextProtos = nextProtos
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// rotateSessionTicketKeys replaces tlsConfig's session ticket keys every interval until
+// shutdownC is closed. Handshakes in flight carry on with the keys they started with.
+func rotateSessionTicketKeys(logger logger.Service, tlsConfig *tls.Config, getKeys func() ([][32]byte, error), interval time.Duration, shutdownC <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			keys, err := sessionTicketKeys(getKeys)
+			if err != nil {
+				logger.Errorf("Cannot rotate TLS session ticket keys, keeping the current keys: %s", err)
+				continue
+			}
+			tlsConfig.SetSessionTicketKeys(keys)
+		case <-shutdownC:
+			return
+		}
+	}
+}
+
+// sessionTicketKeys gets the session ticket keys from getKeys, which must return at least one.
+func sessionTicketKeys(getKeys func() ([][32]byte, error)) ([][32]byte, error) {
+	keys, err := getKeys()
+	if err == nil && len(keys) == 0 {
+		err = errNoSessionTicketKeys
+	}
+	return keys, err
+}
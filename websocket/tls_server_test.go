@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/cloudflared/tlsconfig"
+)
+
+// ticketKeySource hands out the session ticket keys it is set to, signalling each call.
+type ticketKeySource struct {
+	lock  sync.Mutex
+	keys  [][32]byte
+	calls chan struct{}
+}
+
+func (s *ticketKeySource) set(keys ...[32]byte) {
+	s.lock.Lock()
+	s.keys = keys
+	s.lock.Unlock()
+	// Wait for a rotation that is sure to have started after the keys were set
+	<-s.calls
+	<-s.calls
+}
+
+func (s *ticketKeySource) get() ([][32]byte, error) {
+	s.lock.Lock()
+	keys := s.keys
+	s.lock.Unlock()
+	select {
+	case s.calls <- struct{}{}:
+	default:
+	}
+	return keys, nil
+}
+
+func TestSessionTicketKeyRotation(t *testing.T) {
+	helloCert, err := tlsconfig.GetHelloCertificate()
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(helloCert.Certificate[0])
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	source := &ticketKeySource{keys: [][32]byte{{1}}, calls: make(chan struct{})}
+	go StartTLSProxyServer(&testLogger{}, listener, "localhost:1", shutdownC, DefaultStreamHandler, &tls.Config{Certificates: []tls.Certificate{helloCert}}, ProxyOptions{
+		SessionTicketKeys:        source.get,
+		SessionTicketKeyRotation: 10 * time.Millisecond,
+	})
+
+	// Returns whether the connection resumed a session from the cache
+	connect := func(cache tls.ClientSessionCache) bool {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			RootCAs:            roots,
+			ServerName:         leaf.DNSNames[0],
+			ClientSessionCache: cache,
+			// TLS 1.2 issues the ticket during the handshake
+			MaxVersion: tls.VersionTLS12,
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().DidResume
+	}
+
+	cacheA, cacheB := tls.NewLRUClientSessionCache(1), tls.NewLRUClientSessionCache(1)
+	assert.False(t, connect(cacheA))
+	assert.False(t, connect(cacheB))
+	assert.True(t, connect(cacheA))
+
+	// Tickets issued before the rotation are accepted while the old key is kept
+	source.set([32]byte{2}, [32]byte{1})
+	assert.True(t, connect(cacheA))
+
+	// and not once it is dropped
+	source.set([32]byte{3})
+	assert.False(t, connect(cacheB))
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	helloCert, err := tlsconfig.GetHelloCertificate()
+	require.NoError(t, err)
+
+	connect := func(minVersion, clientVersion uint16) error {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		shutdownC := make(chan struct{})
+		defer close(shutdownC)
+		go StartTLSProxyServer(&testLogger{}, listener, "localhost:1", shutdownC, DefaultStreamHandler, &tls.Config{Certificates: []tls.Certificate{helloCert}}, ProxyOptions{
+			TLSMinVersion: minVersion,
+		})
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS10,
+			MaxVersion:         clientVersion,
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	assert.NoError(t, connect(tls.VersionTLS11, tls.VersionTLS11))
+	assert.Error(t, connect(tls.VersionTLS12, tls.VersionTLS11))
+	assert.NoError(t, connect(tls.VersionTLS12, tls.VersionTLS12))
+}
+
+func TestHardenTLSConfig(t *testing.T) {
+	tests := []struct {
+		nextProtos []string
+		http2      bool
+		expected   []string
+	}{
+		{nextProtos: nil, expected: []string{}},
+		{nextProtos: []string{"h2", "http/1.1"}, expected: []string{"http/1.1"}},
+		{nextProtos: []string{"h2"}, http2: true, expected: []string{"h2", "http/1.1"}},
+		{nextProtos: nil, http2: true, expected: []string{"h2", "http/1.1"}},
+	}
+	for _, test := range tests {
+		config := &tls.Config{NextProtos: test.nextProtos}
+		hardenTLSConfig(config, ProxyOptions{TLSEnableHTTP2: test.http2})
+		assert.Equal(t, test.expected, config.NextProtos)
+	}
+
+	config := &tls.Config{}
+	hardenTLSConfig(config, ProxyOptions{TLSMinVersion: tls.VersionTLS12, TLSCipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}})
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, config.CipherSuites)
+	assert.True(t, config.PreferServerCipherSuites)
+
+	assert.Error(t, (&ProxyOptions{TLSMinVersion: 0x0200}).validate())
+}
@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+const (
+	traceFromClient = "from client"
+	traceToClient   = "to client"
+)
+
+// frameTracer logs the type and size of each frame proxied over a connection, see
+// ProxyOptions.TraceFrames. A nil frameTracer logs nothing, so tracing costs a nil check
+// per frame when it is disabled.
+type frameTracer struct {
+	log logger.Service
+}
+
+func (t *frameTracer) frame(direction string, messageType int, size int64) {
+	if t == nil {
+		return
+	}
+	t.log.Debugf("Frame %s: %s, %d bytes", direction, messageTypeName(messageType), size)
+}
+
+func messageTypeName(messageType int) string {
+	switch messageType {
+	case websocket.TextMessage:
+		return "text"
+	case websocket.BinaryMessage:
+		return "binary"
+	case websocket.CloseMessage:
+		return "close"
+	case websocket.PingMessage:
+		return "ping"
+	case websocket.PongMessage:
+		return "pong"
+	default:
+		return fmt.Sprintf("type %d", messageType)
+	}
+}
@@ -0,0 +1,51 @@
+package websocket
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceFrames(t *testing.T) {
+	frameLines := func(traceFrames bool) []string {
+		backend := echoBackend(t)
+		defer backend.Close()
+		log := &testLogger{}
+		server, err := NewProxyServer(log, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{TraceFrames: traceFrames, CloseGracePeriod: 10 * time.Millisecond})
+		require.NoError(t, err)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		shutdownC := make(chan struct{})
+		defer close(shutdownC)
+		go server.Serve(listener, shutdownC)
+
+		conn := dialTestProxy(t, listener.Addr().String(), nil)
+		require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("hello")))
+		_, message, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(message))
+
+		// The echoed frame is logged after it is written, so wait for the connection to end
+		conn.Close()
+		require.Eventually(t, func() bool { return len(server.Connections()) == 0 }, 5*time.Second, 10*time.Millisecond)
+
+		var lines []string
+		for _, line := range log.Lines() {
+			if strings.HasPrefix(line, "Frame ") {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+
+	lines := frameLines(true)
+	assert.Contains(t, lines, "Frame from client: binary, 5 bytes")
+	assert.Contains(t, lines, "Frame to client: binary, 5 bytes")
+
+	assert.Empty(t, frameLines(false))
+}
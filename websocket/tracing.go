@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// traceparentHeader carries the W3C trace context of the client's request.
+const traceparentHeader = "Traceparent"
+
+// Tracer starts a span for each proxied connection, for distributed tracing. It mirrors the
+// shape of the OpenTelemetry tracing API, which this module doesn't depend on, so that an
+// OpenTelemetry tracer provider can be plugged in with a small adapter. It must be safe
+// for concurrent use.
+type Tracer interface {
+	// Start starts a span called name, continuing the trace of parent if it is valid.
+	Start(ctx context.Context, name string, parent SpanContext) Span
+}
+
+// Span is a span started by a Tracer. It must be safe for concurrent use.
+type Span interface {
+	SetAttribute(key, value string)
+	AddEvent(name string, attributes map[string]string)
+	End()
+}
+
+// SpanContext identifies the remote span a connection's trace continues, as sent by the
+// client in the W3C traceparent header.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether s identifies a span.
+func (s SpanContext) IsValid() bool {
+	return s.TraceID != [16]byte{} && s.SpanID != [8]byte{}
+}
+
+// parseTraceparent parses a version 00 W3C traceparent header, returning the zero
+// SpanContext if it is missing or malformed.
+func parseTraceparent(header string) SpanContext {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}
+	}
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return SpanContext{}
+	}
+	sc.Sampled = flags&1 == 1
+	if !sc.IsValid() {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// noopSpan is the Span used when there is no Tracer.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, string)        {}
+func (noopSpan) AddEvent(string, map[string]string) {}
+func (noopSpan) End()                               {}
+
+// spanKey is the context key of a request's connection span.
+type spanKey struct{}
+
+// startConnectionSpan starts the span of the connection requested by r, continuing the
+// client's trace, and returns r with the span in its context. The span must be ended.
+func (h *handler) startConnectionSpan(r *http.Request, destination string) (*http.Request, Span) {
+	if h.options.Tracer == nil {
+		return r, noopSpan{}
+	}
+	span := h.options.Tracer.Start(r.Context(), "websocket.connection", parseTraceparent(r.Header.Get(traceparentHeader)))
+	span.SetAttribute("client.address", r.RemoteAddr)
+	span.SetAttribute("destination", destination)
+	return r.WithContext(context.WithValue(r.Context(), spanKey{}, span)), span
+}
+
+// spanFromContext returns the connection span in ctx, or a span that records nothing.
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTracer keeps the spans it starts in memory.
+type recordingTracer struct {
+	lock  sync.Mutex
+	spans []*recordingSpan
+}
+
+func (t *recordingTracer) Start(_ context.Context, name string, parent SpanContext) Span {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	span := &recordingSpan{name: name, parent: parent, attributes: make(map[string]string)}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func (t *recordingTracer) Spans() []*recordingSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]*recordingSpan(nil), t.spans...)
+}
+
+type recordingSpan struct {
+	lock       sync.Mutex
+	name       string
+	parent     SpanContext
+	attributes map[string]string
+	events     []string
+	eventAttrs map[string]map[string]string
+	ended      bool
+}
+
+func (s *recordingSpan) SetAttribute(key, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *recordingSpan) AddEvent(name string, attributes map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, name)
+	if s.eventAttrs == nil {
+		s.eventAttrs = make(map[string]map[string]string)
+	}
+	s.eventAttrs[name] = attributes
+}
+
+func (s *recordingSpan) End() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ended = true
+}
+
+func (s *recordingSpan) isEnded() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ended
+}
+
+func TestConnectionSpan(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	tracer := &recordingTracer{}
+	events := newRecordingEventHandler()
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{Tracer: tracer, EventHandler: events, CloseGracePeriod: 10 * time.Millisecond})
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	conn := dialTestProxy(t, addr, header)
+	require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("traced")))
+	_, _, err := conn.ReadMessage()
+	require.NoError(t, err)
+	opened := <-events.opened
+	conn.Close()
+	<-events.closed
+
+	spans := tracer.Spans()
+	require.Len(t, spans, 1)
+	span := spans[0]
+	require.Eventually(t, span.isEnded, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "websocket.connection", span.name)
+	assert.True(t, span.parent.IsValid())
+	assert.True(t, span.parent.Sampled)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(span.parent.TraceID[:]))
+	assert.Equal(t, opened.ID, span.attributes["connection.id"])
+	assert.Equal(t, backend.Addr().String(), span.attributes["destination"])
+	assert.NotEmpty(t, span.attributes["client.address"])
+	assert.Equal(t, []string{"backend dialed", "upgraded", "closed"}, span.events)
+	assert.Equal(t, "6", span.eventAttrs["closed"]["bytes.to_backend"])
+	assert.NotEmpty(t, span.eventAttrs["closed"]["reason"])
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, sc.IsValid())
+	assert.False(t, sc.Sampled)
+
+	for _, header := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	} {
+		assert.False(t, parseTraceparent(header).IsValid(), header)
+	}
+}
@@ -0,0 +1,79 @@
+package websocket
+
+import (
+	"net"
+)
+
+// Direction is the direction data is travelling through the proxy.
+type Direction int
+
+const (
+	// ToBackend is data sent by the client to the backend.
+	ToBackend Direction = iota
+	// ToClient is data sent by the backend to the client.
+	ToClient
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ToBackend:
+		return "to backend"
+	case ToClient:
+		return "to client"
+	default:
+		return "unknown direction"
+	}
+}
+
+// Transformer inspects or modifies the data proxied over each connection, for example to
+// sniff protocols or redact data. Transform is called with each chunk of data as it is
+// copied, which is whatever a single read returned, so chunks don't line up with messages
+// or protocol boundaries. It returns the data to send on instead, which may be p itself,
+// a different length, or empty. Returning an error closes the connection.
+//
+// Transform is called from each direction's goroutine, so it must be safe for concurrent
+// use. It adds a function call and usually a copy to every chunk, and its own cost is paid
+// on the proxy's hot path, so it should be kept cheap.
+type Transformer interface {
+	Transform(direction Direction, p []byte) ([]byte, error)
+}
+
+// transformConn is a backend connection that passes the data written to it, which comes
+// from the client, and the data read from it, which goes to the client, through a
+// Transformer.
+type transformConn struct {
+	net.Conn
+	transformer Transformer
+	// pending holds transformed data from the backend that didn't fit in the caller's buffer
+	pending []byte
+}
+
+func (c *transformConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			transformed, transformErr := c.transformer.Transform(ToClient, p[:n])
+			if transformErr != nil {
+				return 0, transformErr
+			}
+			c.pending = transformed
+		}
+		if err != nil && len(c.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *transformConn) Write(p []byte) (int, error) {
+	transformed, err := c.transformer.Transform(ToBackend, p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(transformed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
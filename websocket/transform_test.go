@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// transformerFunc adapts a function to a Transformer.
+type transformerFunc func(direction Direction, p []byte) ([]byte, error)
+
+func (f transformerFunc) Transform(direction Direction, p []byte) ([]byte, error) {
+	return f(direction, p)
+}
+
+// recordingBackend accepts a single connection and sends everything read from it on the
+// returned channel once the connection is closed.
+func recordingBackend(t *testing.T) (net.Listener, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	receivedC := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		received, _ := ioutil.ReadAll(conn)
+		receivedC <- received
+	}()
+	return listener, receivedC
+}
+
+func TestTransformer(t *testing.T) {
+	backend, receivedC := recordingBackend(t)
+	defer backend.Close()
+	upper := transformerFunc(func(direction Direction, p []byte) ([]byte, error) {
+		if direction == ToBackend {
+			return bytes.ToUpper(p), nil
+		}
+		return p, nil
+	})
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{Transformer: upper, CloseGracePeriod: 10 * time.Millisecond})
+
+	conn := dialTestProxy(t, addr, nil)
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("hello ")))
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("backend")))
+	conn.Close()
+
+	select {
+	case received := <-receivedC:
+		assert.Equal(t, "HELLO BACKEND", string(received))
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend connection wasn't closed")
+	}
+}
+
+func TestTransformerError(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	reject := transformerFunc(func(direction Direction, p []byte) ([]byte, error) {
+		if bytes.Contains(p, []byte("secret")) {
+			return nil, errors.New("refusing to proxy a secret")
+		}
+		return p, nil
+	})
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{Transformer: reject, CloseGracePeriod: 10 * time.Millisecond})
+
+	conn := dialTestProxy(t, addr, nil)
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("public")))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "public", string(message))
+
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("secret")))
+	_, _, err = conn.ReadMessage()
+	code, ok := CloseCode(err)
+	assert.True(t, ok)
+	assert.Equal(t, gws.CloseNormalClosure, code)
+}
+
+func TestTransformConnReadBuffersOutput(t *testing.T) {
+	client, backend := net.Pipe()
+	defer client.Close()
+	double := transformerFunc(func(direction Direction, p []byte) ([]byte, error) {
+		return append(append([]byte{}, p...), p...), nil
+	})
+	conn := &transformConn{Conn: client, transformer: double}
+	go func() {
+		backend.Write([]byte("abcd"))
+		backend.Close()
+	}()
+
+	received, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdabcd", string(received))
+}
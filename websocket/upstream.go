@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cloudflare/cloudflared/h2mux"
+	"github.com/cloudflare/cloudflared/logger"
+)
+
+// upstreamConn is a connection to an upstream websocket proxy, used as the backend
+// connection when chaining proxies.
+type upstreamConn struct {
+	*Conn
+}
+
+func (c *upstreamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// dialUpstream connects to the upstream websocket proxy, asking it to connect to
+// destination. The client's request headers are passed on, apart from the handshake headers,
+// so that the upstream proxy can authenticate the request.
+func (h *handler) dialUpstream(r *http.Request, log logger.Service, destination string) (net.Conn, error) {
+	start := time.Now()
+	upstream := h.options.UpstreamWebSocket
+	upstreamReq := r.Clone(r.Context())
+	upstreamReq.URL = &url.URL{Scheme: upstream.Scheme, Host: upstream.Host, Path: upstream.Path, RawQuery: upstream.RawQuery}
+	upstreamReq.Host = upstream.Host
+	upstreamReq.Header.Set(h2mux.CFJumpDestinationHeader, destination)
+	h.setBackendUserAgent(upstreamReq.Header)
+
+	conn, _, err := clientConnect(upstreamReq, h.backendDialler(), ClientOptions{}, handshakeBackend)
+	if err != nil {
+		log.Debugf("Connecting to %s through upstream proxy %s failed after %s: %s", destination, upstream.Host, time.Since(start), err)
+		return nil, err
+	}
+	log.Debugf("Connected to %s through upstream proxy %s in %s", destination, upstream.Host, time.Since(start))
+	return &upstreamConn{&Conn{Conn: conn}}, nil
+}
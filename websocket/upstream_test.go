@@ -0,0 +1,65 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamWebSocket(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	// The upstream proxy has no static host, so it relies on the jump destination header
+	upstreamAddr := startTestProxy(t, "", DefaultStreamHandler, ProxyOptions{})
+	upstream, err := url.Parse(fmt.Sprintf("ws://%s/", upstreamAddr))
+	assert.NoError(t, err)
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{UpstreamWebSocket: upstream})
+
+	conn := dialTestProxy(t, addr, nil)
+	for _, message := range []string{"through", "two proxies"} {
+		assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte(message)))
+		_, received, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, message, string(received))
+	}
+}
+
+func TestUpstreamWebSocketUnavailable(t *testing.T) {
+	upstream, err := url.Parse("ws://127.0.0.1:1/")
+	assert.NoError(t, err)
+	log := &testLogger{}
+	h := newHandler(log, "127.0.0.1:2", DefaultStreamHandler, ProxyOptions{UpstreamWebSocket: upstream})
+
+	conn, err := h.connectBackend(testRequest(t, "http://example.com/", nil), log, "127.0.0.1:2")
+	assert.Error(t, err)
+	assert.Nil(t, conn)
+}
+
+func TestUpstreamWebSocketUserAgent(t *testing.T) {
+	userAgents := make(chan string, 1)
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents <- r.UserAgent()
+		upgrader := gws.Upgrader{}
+		if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+			conn.Close()
+		}
+	}))
+	defer upstreamServer.Close()
+	upstream, err := url.Parse(strings.Replace(upstreamServer.URL, "http://", "ws://", 1))
+	require.NoError(t, err)
+	h := newHandler(&testLogger{}, "127.0.0.1:2", DefaultStreamHandler, ProxyOptions{UpstreamWebSocket: upstream, UserAgent: "proxy/2.0", AppendUserAgent: true})
+
+	r := testRequest(t, "http://example.com/", nil)
+	conn, err := h.connectBackend(r, &testLogger{}, "127.0.0.1:2")
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, "curl/7.59.0 proxy/2.0", <-userAgents)
+}
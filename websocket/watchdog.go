@@ -0,0 +1,28 @@
+package websocket
+
+import (
+	"time"
+)
+
+// watchConnections logs a warning for each connection that moves no data for the
+// StallWarning period, until shutdownC is closed. It does nothing if StallWarning isn't set.
+func (h *handler) watchConnections(shutdownC <-chan struct{}) {
+	period := h.options.StallWarning
+	if period <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(period / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, conn := range h.connections.stalled(period) {
+					h.logger.Infof("Connection %s from %s to %s has moved no data for %s, after %d bytes to the backend and %d to the client. Its proxying may be stuck", conn.ID, conn.RemoteAddr, conn.Destination, period, conn.ToBackend, conn.ToClient)
+				}
+			case <-shutdownC:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStallWarning(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	// The stream handler never copies anything, as if it had deadlocked
+	unblock := make(chan struct{})
+	defer close(unblock)
+	stuck := func(*Conn, net.Conn, http.Header) { <-unblock }
+	log := &testLogger{}
+	server, err := NewProxyServer(log, backend.Addr().String(), stuck, ProxyOptions{StallWarning: 50 * time.Millisecond, CloseGracePeriod: 10 * time.Millisecond})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	go server.Serve(listener, shutdownC)
+
+	dialTestProxy(t, listener.Addr().String(), nil)
+	warnings := func() int {
+		count := 0
+		for _, line := range log.Lines() {
+			if strings.Contains(line, "may be stuck") {
+				count++
+			}
+		}
+		return count
+	}
+	assert.Eventually(t, func() bool { return warnings() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// The stall is only reported once
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, 1, warnings())
+}
@@ -2,21 +2,26 @@ package websocket
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha1"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"runtime/debug"
+	"strings"
 	"time"
 
-	"github.com/cloudflare/cloudflared/h2mux"
 	"github.com/cloudflare/cloudflared/logger"
 	"github.com/cloudflare/cloudflared/sshserver"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
@@ -24,13 +29,58 @@ const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
 
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+	// Default time allowed to read the next pong message from the peer.
+	defaultPongWait = 60 * time.Second
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+	// Size of the buffer used when streaming data into a websocket connection.
+	streamBufferSize = 32 * 1024
+
+	// Default time to wait for the peer to acknowledge a close frame.
+	defaultCloseGracePeriod = time.Second
+
+	// Default time to wait for the backend to be dialed.
+	defaultBackendDialTimeout = 10 * time.Second
+
+	// Default size below which frames are sent uncompressed.
+	defaultCompressionMinSize = 256
+)
+
+var (
+	// errNoDestination is returned to the client when neither a static host nor a jump
+	// destination header was provided, so there is nowhere to proxy the connection to.
+	errNoDestination = errors.New("no destination provided: set the --destination flag on the client")
+	// errInvalidDestinationToken is returned to the client when the destination token is
+	// missing or fails validation. The reason is logged rather than returned.
+	errInvalidDestinationToken = errors.New("invalid destination token")
+	// errNoRoute is returned to the client when a RouterResolver has no route for the host
+	// the request was sent to.
+	errNoRoute = errors.New("no route to a destination for this host")
+	// errNoTargetHost is returned to the client when a TargetHostResolver has no header to
+	// resolve the request by.
+	errNoTargetHost = errors.New("no target host provided")
+	// errTargetHostNotAllowed is returned to the client when a TargetHostResolver doesn't
+	// allow the host it asked for.
+	errTargetHostNotAllowed = errors.New("target host is not allowed")
+	// errControlPlane is returned to the client when a ControlPlaneResolver couldn't get a
+	// destination from its control plane. The reason is logged rather than returned.
+	errControlPlane = errors.New("cannot resolve the destination")
+	// errBackendDialTimeout is returned when the backend wasn't dialed within the timeout.
+	errBackendDialTimeout = errors.New("timed out dialing backend")
+	// errInitialBackendPayload is returned when the initial payload couldn't be written to
+	// the backend.
+	errInitialBackendPayload = errors.New("cannot send the initial payload to the backend")
 )
 
+// reservedResponseHeaders are set by the upgrader during the handshake and must not be
+// overridden by configured response headers.
+var reservedResponseHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Accept",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Extensions",
+}
+
 var stripWebsocketHeaders = []string{
 	"Upgrade",
 	"Connection",
@@ -43,26 +93,207 @@ var stripWebsocketHeaders = []string{
 // but implements a ReadWriter
 type Conn struct {
 	*websocket.Conn
+	// coalescer, when set, batches small writes into fewer frames
+	coalescer *coalescingWriter
+	// stats, when set, counts the data transferred over the connection
+	stats *connStats
+	// streamReader and streamWriter, when set, replace reading and writing whole messages.
+	// They are used by layers that transform the data, such as stream compression.
+	streamReader io.Reader
+	streamWriter io.Writer
+	// readPolicy is applied to the messages read from the connection
+	readPolicy readPolicy
+	// peerCertificates are the client's verified TLS certificates, if any
+	peerCertificates []*x509.Certificate
+	// compression, when set, decides whether each frame written is compressed
+	compression *frameCompression
+	// gate blocks reads and writes while the connection is paused
+	gate pauseGate
+	// tracer, when set, logs every frame read and written
+	tracer *frameTracer
+	// maxFrameSize, when set, caps the size of the frames written, see
+	// ProxyOptions.MaxClientFrameSize
+	maxFrameSize int
+}
+
+// SetWriteCompression enables or disables compression of subsequent frames written to the
+// connection. It only has an effect when permessage-deflate was negotiated, and is useful
+// to avoid recompressing data that is already compressed. It takes precedence over the
+// proxy's SkipCompression, CompressionMinSize and MaxCompressedFrameSize options.
+func (c *Conn) SetWriteCompression(enable bool) {
+	c.compression.override()
+	c.Conn.EnableWriteCompression(enable)
+}
+
+// PeerCertificates returns the certificates the client presented when the proxy terminates
+// TLS, leaf first. When the TLS config requires and verifies client certificates they have
+// been verified by the time the stream handler runs. It returns nil for connections without
+// TLS or without a client certificate.
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	return c.peerCertificates
 }
 
 // Read will read messages from the websocket connection
 func (c *Conn) Read(p []byte) (int, error) {
-	_, message, err := c.Conn.ReadMessage()
+	if c.streamReader != nil {
+		n, err := c.streamReader.Read(p)
+		c.gate.wait()
+		c.stats.addToBackend(int64(n))
+		return n, err
+	}
+	messageType, r, err := nextMessage(c.Conn, c.readPolicy)
 	if err != nil {
 		return 0, err
 	}
+	message, err := c.readPolicy.readMessage(c.Conn, r)
+	if err != nil {
+		return 0, err
+	}
+	defer c.readPolicy.memory.release(int64(len(message)))
+	c.tracer.frame(traceFromClient, messageType, int64(len(message)))
+	c.gate.wait()
+	c.readPolicy.observeMessage(int64(len(message)))
 
-	return copy(p, message), nil
+	n := copy(p, message)
+	c.stats.addToBackend(int64(n))
+	return n, nil
 
 }
 
-// Write will write messages to the websocket connection
+// Write will write messages to the websocket connection. p is sent as a single binary frame,
+// which gorilla writes in full or not at all, so Write never makes a partial write: it
+// returns len(p) on success and 0 with the error on failure. The exception is when the
+// frame size is capped, see ProxyOptions.MaxClientFrameSize, when p may be split into
+// several frames and Write returns the size of the frames sent before a failure. Writing an
+// empty p is a no-op, rather than sending an empty frame.
 func (c *Conn) Write(p []byte) (int, error) {
-	if err := c.Conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
-		return 0, err
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.gate.wait()
+	if c.streamWriter != nil {
+		n, err := c.streamWriter.Write(p)
+		c.stats.addToClient(int64(n))
+		return n, err
+	}
+	if c.coalescer != nil {
+		return c.coalescer.Write(p)
+	}
+	c.compression.apply(c.Conn, p)
+	n, err := writeBinaryFrames(c.Conn, p, c.maxFrameSize, c.tracer)
+	c.stats.addToClient(int64(n))
+	return n, err
+}
+
+// writeBinaryFrames sends p to conn as binary frames of at most maxFrameSize bytes, or as a
+// single frame if maxFrameSize is zero, returning how much of p was sent.
+func writeBinaryFrames(conn *websocket.Conn, p []byte, maxFrameSize int, tracer *frameTracer) (int, error) {
+	var written int
+	for written < len(p) {
+		frame := p[written:]
+		if maxFrameSize > 0 && len(frame) > maxFrameSize {
+			frame = frame[:maxFrameSize]
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			return written, err
+		}
+		tracer.frame(traceToClient, websocket.BinaryMessage, int64(len(frame)))
+		written += len(frame)
+	}
+	return written, nil
+}
+
+// ReadFrom writes the data read from r to the websocket connection as binary frames, one
+// frame per read, until r returns io.EOF. This lets io.Copy stream into the connection.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	if c.coalescer != nil || c.streamWriter != nil {
+		// Hide ReadFrom so io.Copy goes through Write
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+
+	var total int64
+	bufferSize := streamBufferSize
+	if c.maxFrameSize > 0 && c.maxFrameSize < bufferSize {
+		// Each read is sent as one frame
+		bufferSize = c.maxFrameSize
+	}
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := r.Read(buf)
+		c.gate.wait()
+		if n > 0 {
+			c.compression.apply(c.Conn, buf[:n])
+			if werr := c.writeFrame(buf[:n]); werr != nil {
+				if isClosedConnErr(werr) {
+					// The connection is closing, which ends the copy cleanly
+					return total, nil
+				}
+				return total, werr
+			}
+			c.tracer.frame(traceToClient, websocket.BinaryMessage, int64(n))
+			total += int64(n)
+			c.stats.addToClient(int64(n))
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// writeFrame sends p to the client as one binary frame.
+func (c *Conn) writeFrame(p []byte) error {
+	w, err := c.Conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(p); err != nil {
+		return err
 	}
+	return w.Close()
+}
 
-	return len(p), nil
+// WriteTo streams messages from the websocket connection to w until the connection is
+// closed. Unlike Read, each message is streamed rather than buffered in full, so messages
+// larger than the caller's buffer are never truncated.
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	if c.streamReader != nil {
+		// Hide WriteTo so io.Copy goes through Read
+		return io.Copy(w, struct{ io.Reader }{c})
+	}
+	var total int64
+	for {
+		messageType, r, err := nextMessage(c.Conn, c.readPolicy)
+		if err != nil {
+			return total, err
+		}
+		c.gate.wait()
+		n, err := io.Copy(w, r)
+		c.tracer.frame(traceFromClient, messageType, n)
+		total += n
+		c.stats.addToBackend(n)
+		c.readPolicy.observeMessage(n)
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// CloseCode returns the close code from an error returned when reading from a websocket
+// connection, and whether the error was caused by a close frame. Common codes are:
+//
+//	1000 (websocket.CloseNormalClosure): the peer finished the conversation cleanly
+//	1001 (websocket.CloseGoingAway): the peer is shutting down or navigating away
+//	1006 (websocket.CloseAbnormalClosure): the connection was lost without a close frame
+//	1011 (websocket.CloseInternalServerErr): the peer hit an unexpected condition
+func CloseCode(err error) (int, bool) {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code, true
+	}
+	return 0, false
 }
 
 // IsWebSocketUpgrade checks to see if the request is a WebSocket connection.
@@ -75,34 +306,159 @@ type Dialler interface {
 	Dial(url *url.URL, headers http.Header) (*websocket.Conn, *http.Response, error)
 }
 
+// DiallerOptions configures the Dialler returned by NewDialler.
+type DiallerOptions struct {
+	// TLSConfig is used for wss origins.
+	TLSConfig *tls.Config
+	// MaxResponseHeaderBytes limits the size of the origin's handshake response. Dials fail
+	// with ErrResponseHeaderTooLarge when it is exceeded. Zero means no limit.
+	MaxResponseHeaderBytes int64
+	// DialNetwork is the network used to dial origins: "tcp", "tcp4" or "tcp6". Defaults to "tcp".
+	DialNetwork string
+	// WriteBufferPool, when set, shares write buffers between connections, see
+	// ProxyOptions.WriteBufferPool.
+	WriteBufferPool websocket.BufferPool
+	// MaskingKeys supplies the 4 byte key used to mask each frame sent to the origin, for
+	// reproducible tests and fuzzing. Never set it in production: RFC 6455 requires
+	// unpredictable keys, which the default, crypto/rand, provides.
+	MaskingKeys io.Reader
+}
+
+// NewDialler returns the default Dialler configured with options.
+func NewDialler(options DiallerOptions) (Dialler, error) {
+	if err := validateDialNetwork(options.DialNetwork); err != nil {
+		return nil, err
+	}
+	return &defaultDialler{
+		tlsConfig:              options.TLSConfig,
+		maxResponseHeaderBytes: options.MaxResponseHeaderBytes,
+		network:                options.DialNetwork,
+		maskingKeys:            options.MaskingKeys,
+		writeBufferPool:        options.WriteBufferPool,
+	}, nil
+}
+
 type defaultDialler struct {
-	tlsConfig *tls.Config
+	tlsConfig              *tls.Config
+	maxResponseHeaderBytes int64
+	// network overrides the network gorilla dials with when set
+	network string
+	// maskingKeys replaces gorilla's masking keys when set
+	maskingKeys     io.Reader
+	writeBufferPool websocket.BufferPool
+}
+
+// dialContext dials the origin on the dialler's network.
+func (dd *defaultDialler) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dd.network != "" {
+		network = dd.network
+	}
+	return new(net.Dialer).DialContext(ctx, network, addr)
 }
 
 func (dd *defaultDialler) Dial(url *url.URL, header http.Header) (*websocket.Conn, *http.Response, error) {
-	d := &websocket.Dialer{TLSClientConfig: dd.tlsConfig}
-	return d.Dial(url.String(), header)
+	d := &websocket.Dialer{TLSClientConfig: dd.tlsConfig, NetDialContext: dd.dialContext, WriteBufferPool: dd.writeBufferPool}
+	if dd.maxResponseHeaderBytes <= 0 && dd.maskingKeys == nil {
+		return d.Dial(url.String(), header)
+	}
+	return dd.dialWrapped(d, url, header)
+}
+
+// ClientOptions configures the optional behaviour of ClientConnectWithOptions.
+// The zero value gives the default behaviour.
+type ClientOptions struct {
+	// StreamCompression offers to compress the tunnelled data, which the proxy accepts if it
+	// has stream compression enabled. Use NewClientConn to wrap the returned connection so
+	// the data is compressed if the offer was accepted.
+	StreamCompression bool
+	// TransparentExtensions passes the client's Sec-WebSocket-Extensions header through to the
+	// origin instead of stripping it, so that the client and origin negotiate extensions end
+	// to end. This is only safe when the caller copies the underlying connection byte for byte,
+	// because the frames are never decoded by cloudflared.
+	// Note that gorilla fails the handshake if the origin accepts permessage-deflate without
+	// both no_context_takeover parameters.
+	TransparentExtensions bool
+	// PreserveURLHost sends the host of the request URL as the handshake's Host, instead of
+	// the request's Host. This suits origins behind virtual hosting that are addressed by the
+	// URL rather than by the host the client asked for.
+	PreserveURLHost bool
 }
 
 // ClientConnect creates a WebSocket client connection for provided request. Caller is responsible for closing
 // the connection. The response body may not contain the entire response and does
-// not need to be closed by the application.
+// not need to be closed by the application. How long the dial and handshake took is
+// recorded in the cloudflared_websocket_handshake_duration_seconds metric.
+//
+// Trailers sent by the origin are in the response's Trailer. Most origins won't send any:
+// a successful upgrade response has no body, so it can't carry trailers, and only the first
+// 1KB of the body of a refused handshake is read, so only refusals with a shorter chunked
+// body can have them.
 func ClientConnect(req *http.Request, dialler Dialler) (*websocket.Conn, *http.Response, error) {
+	return ClientConnectWithOptions(req, dialler, ClientOptions{})
+}
+
+// ClientConnectWithOptions is ClientConnect with the optional behaviour described by options.
+func ClientConnectWithOptions(req *http.Request, dialler Dialler, options ClientOptions) (*websocket.Conn, *http.Response, error) {
+	return clientConnect(req, dialler, options, handshakeClient)
+}
+
+// clientConnect is ClientConnectWithOptions, recording the handshake's duration under side.
+func clientConnect(req *http.Request, dialler Dialler, options ClientOptions, side string) (*websocket.Conn, *http.Response, error) {
 	req.URL.Scheme = ChangeRequestScheme(req.URL)
 	wsHeaders := websocketHeaders(req)
+	if extensions := req.Header.Values("Sec-Websocket-Extensions"); options.TransparentExtensions && len(extensions) > 0 {
+		// gorilla refuses the canonical header name because it sets the header itself when
+		// compression is enabled. Use the RFC capitalization to pass it through as is.
+		wsHeaders["Sec-WebSocket-Extensions"] = extensions
+	}
+	if options.PreserveURLHost {
+		// gorilla uses the URL's host when the headers don't set one
+		wsHeaders.Del("Host")
+	}
+	if options.StreamCompression {
+		wsHeaders.Set(streamCompressionHeader, streamCompressionDeflate)
+	}
 
 	if dialler == nil {
 		dialler = new(defaultDialler)
 	}
+	start := time.Now()
 	conn, response, err := dialler.Dial(req.URL, wsHeaders)
 	if err != nil {
 		return nil, response, err
 	}
+	handshakeDuration.WithLabelValues(side).Observe(time.Since(start).Seconds())
 	response.Header.Set("Sec-WebSocket-Accept", generateAcceptKey(req))
 	return conn, response, err
 }
 
+// connDialler is a Dialler that performs the handshake over an existing connection
+// instead of dialing a new one.
+type connDialler struct {
+	conn net.Conn
+}
+
+func (d *connDialler) Dial(url *url.URL, header http.Header) (*websocket.Conn, *http.Response, error) {
+	// This is what the deprecated websocket.NewClient does
+	dialer := &websocket.Dialer{
+		NetDial: func(_, _ string) (net.Conn, error) {
+			return d.conn, nil
+		},
+	}
+	return dialer.Dial(url.String(), header)
+}
+
+// ClientConnectOverConn is ClientConnect, but performs the handshake over conn rather than
+// dialing the origin. This allows websockets to be carried over other transports, such as
+// multiplexed streams. conn is closed if the handshake fails.
+func ClientConnectOverConn(conn net.Conn, req *http.Request) (*websocket.Conn, *http.Response, error) {
+	return ClientConnect(req, &connDialler{conn: conn})
+}
+
 // HijackConnection takes over an HTTP connection. Caller is responsible for closing connection.
+// Clients may send data straight after their request without waiting for the response, and
+// the HTTP server may already have buffered it, so reads from the returned connection
+// return those buffered bytes first.
 func HijackConnection(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
 	hj, ok := w.(http.Hijacker)
 	if !ok {
@@ -113,9 +469,23 @@ func HijackConnection(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error
 	if err != nil {
 		return nil, nil, err
 	}
+	if brw.Reader.Buffered() > 0 {
+		return &hijackedConn{Conn: conn, reader: brw.Reader}, brw, nil
+	}
 	return conn, brw, nil
 }
 
+// hijackedConn is a connection whose reads go through a reader that may have data buffered
+// from it already.
+type hijackedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
 // Stream copies copy data to & from provided io.ReadWriters.
 func Stream(conn, backendConn io.ReadWriter) {
 	proxyDone := make(chan struct{}, 2)
@@ -134,85 +504,953 @@ func Stream(conn, backendConn io.ReadWriter) {
 	<-proxyDone
 }
 
+// StreamWait is Stream, but it doesn't return until both directions have finished copying,
+// so neither connection is used after it returns. Once one direction finishes, the other is
+// unblocked with an expired deadline, which is then cleared so the caller can go on using
+// the connections, for example to send a close frame. Connections without deadlines are
+// closed instead, if they are io.Closers.
+func StreamWait(conn, backendConn io.ReadWriter) {
+	proxyDone := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(conn, backendConn)
+		proxyDone <- struct{}{}
+	}()
+
+	go func() {
+		io.Copy(backendConn, conn)
+		proxyDone <- struct{}{}
+	}()
+
+	<-proxyDone
+	interruptCopy(conn)
+	interruptCopy(backendConn)
+	<-proxyDone
+	clearDeadlines(conn)
+	clearDeadlines(backendConn)
+}
+
+// deadliner is a connection whose blocked reads and writes can be interrupted by deadlines.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// interruptCopy interrupts any read or write blocked on c, see StreamWait.
+func interruptCopy(c io.ReadWriter) {
+	if d, ok := c.(deadliner); ok {
+		expired := time.Unix(1, 0)
+		d.SetReadDeadline(expired)
+		d.SetWriteDeadline(expired)
+	} else if closer, ok := c.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// clearDeadlines removes the deadlines set by interruptCopy.
+func clearDeadlines(c io.ReadWriter) {
+	if d, ok := c.(deadliner); ok {
+		d.SetReadDeadline(time.Time{})
+		d.SetWriteDeadline(time.Time{})
+	}
+}
+
 // DefaultStreamHandler is provided to the the standard websocket to origin stream
 // This exist to allow SOCKS to deframe data before it gets to the origin
 func DefaultStreamHandler(wsConn *Conn, remoteConn net.Conn, _ http.Header) {
 	Stream(wsConn, remoteConn)
 }
 
+// ProxyOptions configures the optional behaviour of the websocket proxy server.
+// The zero value gives the default behaviour.
+type ProxyOptions struct {
+	// CoalesceDelay enables coalescing of backend data written to the client. Data is held
+	// for at most this long so that many small backend writes are sent as a single frame.
+	// Zero disables coalescing.
+	CoalesceDelay time.Duration
+	// CoalesceSize is the number of buffered bytes that causes a frame to be sent straight
+	// away while coalescing. Defaults to defaultCoalesceSize.
+	CoalesceSize int
+	// MaxMuxStreams caps the number of streams open at once on each multiplexed connection.
+	// Opening a stream beyond it is answered with MuxFrameClose. Zero means
+	// defaultMaxMuxStreams, and a negative value removes the cap.
+	MaxMuxStreams int
+	// MaxClientFrameSize, when set, caps the size of the frames written to the client, for
+	// intermediaries that limit frame sizes. Larger backend reads are split into several
+	// frames, each sent as its own binary message. Zero means no cap. It doesn't apply to
+	// websocket backends or multiplexed connections.
+	MaxClientFrameSize int
+	// ResponseHeader holds additional headers sent on the upgrade response. Headers that are
+	// part of the websocket handshake are set by the proxy and are ignored here.
+	ResponseHeader http.Header
+	// ServerIdentity, when set, returns a value identifying this proxy instance, which is
+	// sent in the ServerIdentityHeader of upgrade responses so it's possible to tell which
+	// instance served a connection. StaticServerIdentity returns a fixed identity.
+	ServerIdentity func(r *http.Request) string
+	// ServerIdentityHeader is the header ServerIdentity is sent in. Defaults to "Server".
+	ServerIdentityHeader string
+	// UpgradeRateLimit, when set, rejects upgrade attempts from client IPs that exceed the
+	// rate limit with 429 Too Many Requests.
+	UpgradeRateLimit *UpgradeRateLimit
+	// GlobalUpgradeRateLimit, when set, rejects upgrade attempts that exceed the rate limit
+	// for the whole proxy, whichever client they come from, with 503 Service Unavailable.
+	// This protects the backends from a flood of reconnections, for example while recovering
+	// from an incident. Attempts rejected by UpgradeRateLimit don't count towards it.
+	GlobalUpgradeRateLimit *GlobalUpgradeRateLimit
+	// DestinationLimits, when set, caps the number of client connections proxied to each
+	// destination at once. Requests for a destination at its cap are refused with 503
+	// Service Unavailable, while other destinations are unaffected. Each stream of a
+	// multiplexed connection counts as a connection, and is closed if its destination is at
+	// its cap.
+	DestinationLimits *DestinationLimits
+	// BackendHealthCheck, when set, probes backends in the background and rejects requests
+	// with 503 Service Unavailable while none of them are healthy.
+	BackendHealthCheck *BackendHealthCheck
+	// DialBackend dials the backend for each connection. Defaults to net.Dialer.DialContext.
+	DialBackend func(ctx context.Context, network, address string) (net.Conn, error)
+	// BackendDialTimeout bounds how long dialing the backend can take. Clients are sent a
+	// 504 if it runs out before the upgrade. Defaults to defaultBackendDialTimeout.
+	BackendDialTimeout time.Duration
+	// DialNetwork is the network used to dial backends: "tcp", "tcp4" or "tcp6". Use tcp4 or
+	// tcp6 to force an address family on dual-stack hosts. Defaults to "tcp".
+	DialNetwork string
+	// DestinationParser, when set, turns each resolved destination into the network and
+	// address DialBackend is called with, for deployments that encode backends in their own
+	// formats, such as service discovery URIs. Destinations that fail to parse are treated
+	// as failed dials. By default the destination is dialed as an address on DialNetwork.
+	// It doesn't apply to websocket backends, upstream proxies or backend health checks.
+	DestinationParser func(raw string) (network, address string, err error)
+	// WebsocketBackend treats the destination as a websocket server. Messages are proxied
+	// between the client and backend with their original type, rather than the decoded data
+	// being written to a TCP connection. The stream handler is not used in this mode.
+	WebsocketBackend bool
+	// UpstreamWebSocket chains this proxy to another websocket proxy, such as another
+	// cloudflared. Instead of dialing the destination, the proxy connects to the upstream
+	// proxy and asks it to connect to the destination with the jump destination header. The
+	// stream handler is given the upstream connection as its backend, so SSH preambles and
+	// other stream handling work unchanged.
+	UpstreamWebSocket *url.URL
+	// ForwardOriginalURI sends the client's request URI and method to websocket backends in
+	// the X-Original-URI and X-Original-Method handshake headers, replacing any sent by the
+	// client. It only applies to websocket backends.
+	ForwardOriginalURI bool
+	// UserAgent replaces the client's User-Agent, which is otherwise forwarded, on handshakes
+	// with websocket backends and upstream proxies. With AppendUserAgent it is appended to
+	// the client's User-Agent instead, so the backend can see both the client and the proxy.
+	UserAgent       string
+	AppendUserAgent bool
+	// PongWait is how long the proxy waits for the client to answer its pings, which are sent
+	// every nine tenths of it. Connections to clients that don't answer in time are closed
+	// as idle. Defaults to a minute.
+	PongWait time.Duration
+	// CloseGracePeriod bounds how long the proxy waits for the client to acknowledge its close
+	// frame before closing the socket. Defaults to defaultCloseGracePeriod.
+	CloseGracePeriod time.Duration
+	// HandshakeReadTimeout bounds how long a client can take to send its handshake request,
+	// so that clients that stall part way through don't tie up the server. The deadline is
+	// cleared once the request has been read. Zero means no limit.
+	HandshakeReadTimeout time.Duration
+	// MaxPendingHandshakes limits the connections that have been accepted but haven't
+	// finished sending their handshake request, so that slow clients, such as a slowloris
+	// attack, can't tie up the server. Connections accepted while the limit is reached are
+	// refused with 503 Service Unavailable once their request arrives. Connections that are
+	// being proxied don't count towards it. Zero means no limit.
+	MaxPendingHandshakes int
+	// Upgrader is used to upgrade client connections, giving full control over the gorilla
+	// upgrader. Defaults to an upgrader with 1KB buffers.
+	Upgrader *websocket.Upgrader
+	// ScalableCompression enables permessage-deflate with settings suited to proxying many
+	// connections, see configureScalableCompression.
+	ScalableCompression bool
+	// CompressionLevel, when set, returns the flate compression level for the frames sent to
+	// the client making request r when permessage-deflate was negotiated, from
+	// flate.HuffmanOnly to flate.BestCompression, for example to trade CPU for bandwidth on
+	// slow links. Invalid levels are logged and ignored. It overrides ScalableCompression's
+	// level.
+	CompressionLevel func(r *http.Request) int
+	// SkipCompression, when set, is called with each frame written to the client when
+	// permessage-deflate was negotiated. Frames it returns true for are sent uncompressed,
+	// for example data that is already compressed. LooksCompressed is a suitable detector.
+	SkipCompression func(p []byte) bool
+	// MaxCompressedFrameSize, when set, sends frames larger than it uncompressed, bounding
+	// the CPU spent compressing bulk transfers.
+	MaxCompressedFrameSize int
+	// CompressionMinSize sends frames smaller than it uncompressed, since compressing them
+	// costs CPU and can even make them larger. Zero means defaultCompressionMinSize, and a
+	// negative value compresses frames of any size.
+	CompressionMinSize int
+	// ReadBufferSize and WriteBufferSize override the upgrader's buffer sizes when non-zero.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// WriteBufferPool, when set, shares write buffers between connections instead of each
+	// connection holding its own for its lifetime, reducing memory and allocations when
+	// there are many connections. NewWriteBufferPool returns a suitable pool. It overrides
+	// the Upgrader's pool, and is also used to dial websocket backends.
+	WriteBufferPool websocket.BufferPool
+	// CheckOrigin overrides the upgrader's CheckOrigin when set.
+	CheckOrigin func(r *http.Request) bool
+	// InitialBackendPayload, when set, is written to each backend as soon as it is connected,
+	// before any data is proxied, for protocols that need a fixed preamble from the proxy.
+	// If it can't be written the client is refused with 502 Bad Gateway, or, when the backend
+	// is dialed lazily, sent a 1011 close frame. It doesn't apply to websocket backends or
+	// resumed sessions, whose backends already received it.
+	InitialBackendPayload []byte
+	// LogRequestHeaders logs the headers of each request that reaches the backend at debug
+	// level, for debugging clients. The values of the headers in RedactHeaders are replaced
+	// with "***".
+	LogRequestHeaders bool
+	// RedactHeaders are the headers whose values are redacted when headers are logged.
+	// Defaults to Authorization, Cookie, Cf-Access-Client-Secret, Cf-Access-Token and
+	// Sec-WebSocket-Key. Set it to an empty, non-nil slice to log every value.
+	RedactHeaders []string
+	// ChaosLatency, when set, delays the data proxied in both directions, for testing how
+	// clients cope with slow or unsteady links. It is for testing only and is off by default.
+	// It doesn't apply to websocket backends or multiplexed connections.
+	ChaosLatency *ChaosLatency
+	// Tracer, when set, traces each connection with a span from when its destination is
+	// resolved until it closes, with events for dialing the backend, upgrading and closing.
+	// Spans continue the trace in the client's W3C traceparent header, if any. It doesn't
+	// apply to multiplexed connections.
+	Tracer Tracer
+	// EchoBackend serves the destination "echo:" by echoing each message the client sends
+	// back to it verbatim, instead of proxying to a backend, so operators can check the path
+	// through the proxy without a real backend. The stream handler isn't used, and it
+	// doesn't apply to multiplexed connections.
+	EchoBackend bool
+	// DisableBackendNoDelay allows the backend TCP connection to delay small writes (Nagle's
+	// algorithm), trading latency for throughput. By default small writes are sent immediately.
+	DisableBackendNoDelay bool
+	// BackendReadBuffer and BackendWriteBuffer, when set, size the backend TCP connection's
+	// socket receive and send buffers, for backends across links with a large bandwidth-delay
+	// product. By default the operating system's buffer sizes are used.
+	BackendReadBuffer  int
+	BackendWriteBuffer int
+	// BackendUserTimeout, when set, is how long data written to the backend may remain
+	// unacknowledged before the backend connection is closed (TCP_USER_TIMEOUT), which
+	// detects dead backends sooner than keepalives. It is only supported on Linux, and is
+	// ignored elsewhere.
+	BackendUserTimeout time.Duration
+	// DestinationFromToken, when set, takes the destination from a token sent in the
+	// cf-access-token header instead of the jump destination header, so that clients can only
+	// reach destinations they hold a valid token for. It validates the token and returns the
+	// destination it grants. Requests with a missing or invalid token are refused with 403.
+	// It is not used when the proxy has a static host.
+	DestinationFromToken func(token string) (string, error)
+	// Resolver, when set, resolves the destination of each request instead of the static
+	// host, DestinationFromToken or the jump destination header. NewCachingResolver caches
+	// the destinations of a resolver. Multiplexed connections resolve each stream with it,
+	// see StreamResolver.
+	Resolver Resolver
+	// OnClose is called when each connection ends with the connection's ID, the number of bytes
+	// proxied from the client to the backend and from the backend to the client, and how long
+	// the connection was open.
+	OnClose func(connID string, toBackend, toClient int64, duration time.Duration)
+	// OnCompressionStats, when set, is called when each connection ends with the number of
+	// bytes of data sent to the client, and the number of bytes it took on the wire once
+	// compressed by permessage-deflate or stream compression, including frame headers.
+	// compressed/uncompressed is the compression ratio achieved, which helps judge whether
+	// compression is worth its CPU cost. Setting it counts every write to the client.
+	OnCompressionStats func(connID string, uncompressed, compressed int64)
+	// EventHandler, when set, is notified as each connection is opened and closed.
+	EventHandler EventHandler
+	// TagHeaderPrefix, when set, lets clients tag their connection with request headers
+	// starting with the prefix, such as Cf-Tag-Team: core. The tags are appended to the
+	// connection's log lines and passed to the EventHandler.
+	TagHeaderPrefix string
+	// MaxTags limits how many tags a connection can have, defaulting to 16. Extra tags are
+	// ignored.
+	MaxTags int
+	// StreamCompression compresses the tunnelled data with clients that offer it in their
+	// handshake, see ClientOptions.StreamCompression. Other clients are proxied uncompressed.
+	// It doesn't apply to websocket backends.
+	StreamCompression bool
+	// DisablePanicRecovery lets panics in the stream handler propagate instead of being
+	// logged and recovered by the proxy. They then reach net/http's own recovery, which logs
+	// them to the server's error log rather than the proxy's logger and drops the client
+	// connection. Either way only panics on the stream handler's own goroutine are covered:
+	// panics in goroutines it starts, such as the copies DefaultStreamHandler runs with
+	// Stream and so any Conn hooks, transformer or chaos injection they call, crash the
+	// process. It doesn't apply to multiplexed connections, whose streams aren't recovered.
+	// This is useful when debugging a stream handler.
+	DisablePanicRecovery bool
+	// StrictFrameValidation closes connections that send text messages that aren't valid
+	// UTF-8 with 1007, as RFC 6455 requires. Unmasked client frames and unexpected reserved
+	// bits, including RSV1 on frames from clients that didn't negotiate compression, are
+	// always rejected with 1002.
+	StrictFrameValidation bool
+	// StrictHandshakeValidation rejects upgrade requests whose Sec-WebSocket-Key isn't the
+	// base64 encoding of a 16 byte nonce with 400, before the backend is dialed.
+	StrictHandshakeValidation bool
+	// MemoryBudget caps the memory, in bytes, buffered across all connections. Each
+	// connection is charged an estimate of its buffers when it is accepted, and new
+	// connections are refused with 503 while they don't fit. Messages read in full, such as
+	// by Conn.Read, are charged while they are buffered. When one doesn't fit, the connection
+	// that has buffered the most is closed with 1013 (try again later), which refuses the
+	// message if it is the connection reading it. Zero means no budget.
+	MemoryBudget int64
+	// BackendPool keeps connections to the static host dialed ahead of clients, which are
+	// handed to clients instead of dialing the backend. Pooled connections are reaped after
+	// the pool's IdleTTL. It suits backends that don't mind idle connections, and doesn't
+	// apply to upstream proxies, websocket backends or other destinations.
+	BackendPool *BackendPool
+	// LazyBackendDial delays dialing the backend until the client first sends data, so that
+	// clients that never send anything don't hold a backend connection open. It is only
+	// suitable for protocols where the client speaks first: reads from the backend block
+	// until the client has sent something.
+	LazyBackendDial bool
+	// Transformer, when set, is passed the data proxied in each direction and can modify it.
+	// It doesn't apply to websocket backends.
+	Transformer Transformer
+	// MessageFramer, when set, sends each length-delimited message from the backend to the
+	// client as one frame. With a Transformer, the transformed data is framed. It can't be
+	// combined with CoalesceDelay, which merges frames, and the framing is lost for clients
+	// using stream compression. It doesn't apply to websocket backends.
+	MessageFramer *MessageFramer
+	// MaxFramesPerSecond throttles the messages read from each client to this rate, with
+	// bursts of up to a second's worth, so that a flood of tiny frames can't monopolise the
+	// CPU. The client is slowed down rather than disconnected. Zero disables the limit.
+	MaxFramesPerSecond float64
+	// FrameRateWarmUp, when set, ramps each connection's MaxFramesPerSecond limit, and its
+	// burst, up from a tenth to the full amount over this period, rather than starting at
+	// the full rate. This smooths the load when many clients reconnect at once.
+	FrameRateWarmUp time.Duration
+	// MaxSessionDuration limits how long each connection can stay open, however active it
+	// is, for example to force clients to reconnect and reauthenticate every hour. When it
+	// is reached, the client is sent a 1001 (going away) close frame with the reason
+	// "session expired". Zero means no limit.
+	MaxSessionDuration time.Duration
+	// SessionResumeTTL lets clients resume their session after losing their connection.
+	// Each connection is given a token in the Cf-Resume-Token upgrade response header. When
+	// a client goes away without a close frame, its backend connection is kept open for this
+	// long, and a new connection sending the token in the same header is attached to it
+	// instead of dialing the backend again. Data in flight when the client went away may be
+	// lost, so the protocol must tolerate that. Zero disables resuming. It doesn't apply to
+	// websocket backends.
+	SessionResumeTTL time.Duration
+	// TraceFrames logs the type and size of every frame proxied in each direction at debug
+	// level, for deep debugging. It adds a log line per frame, so it should only be enabled
+	// while debugging. It doesn't apply to websocket backends or multiplexed connections.
+	TraceFrames bool
+	// StallWarning, when set, logs a warning for each connection that moves no data in either
+	// direction for this long, to help find proxying that has deadlocked. Connections that
+	// are legitimately quiet for long periods are reported too, once per quiet period.
+	StallWarning time.Duration
+	// HealthCheckPath, when set, is answered with 200 OK for load balancers and orchestrators,
+	// without upgrading or dialing the backend. Empty disables the health check.
+	HealthCheckPath string
+	// TestClientPath, when set, serves browsers a page at this path that opens a websocket to
+	// the same URL, sends the messages typed into it and shows the replies, to help verify
+	// an endpoint by hand. Browsers can't set the jump destination header, so it suits
+	// proxies with a static host, resolver or echo backend. Empty, the default, disables it.
+	TestClientPath string
+	// BaseContext, when set, returns the base context for requests accepted from listener,
+	// as http.Server.BaseContext does. Request contexts, and so the contexts passed to
+	// ContextStreamHandlers, derive from it, so it can carry deployment-wide values or
+	// cancel every request together. Defaults to context.Background.
+	BaseContext func(listener net.Listener) context.Context
+	// StreamContext, when set, returns the context passed to the ContextStreamHandler for
+	// a request, for example with the client's identity attached. Defaults to the request's
+	// context, which is cancelled when the connection ends.
+	StreamContext func(r *http.Request) context.Context
+	// SessionTicketKeys, when set, is called every SessionTicketKeyRotation by
+	// StartTLSProxyServer to get the TLS session ticket keys. The first key encrypts new
+	// tickets and all of them decrypt tickets, so returning the previous keys after the new
+	// one lets clients keep resuming sessions with tickets issued before the rotation. If it
+	// fails, the current keys are kept.
+	SessionTicketKeys func() ([][32]byte, error)
+	// SessionTicketKeyRotation is how often SessionTicketKeys is called. Defaults to an hour.
+	SessionTicketKeyRotation time.Duration
+	// TLSMinVersion, when set, is the oldest TLS version StartTLSProxyServer accepts, such
+	// as tls.VersionTLS12. Clients that only support older versions fail the handshake.
+	TLSMinVersion uint16
+	// TLSCipherSuites, when set, are the cipher suites StartTLSProxyServer allows for TLS 1.2
+	// and earlier, in order of preference, and the server's preference is used over the
+	// client's. TLS 1.3 cipher suites aren't configurable.
+	TLSCipherSuites []uint16
+	// TLSEnableHTTP2 lets StartTLSProxyServer negotiate HTTP/2 with clients that offer it.
+	// Websocket upgrades need HTTP/1.1, so by default HTTP/2 isn't negotiated, even if the
+	// TLS config lists it. Only enable it if the proxy also serves other HTTP/2 clients, such
+	// as health checks.
+	TLSEnableHTTP2 bool
+}
+
+// validate checks that the options are usable.
+func (o *ProxyOptions) validate() error {
+	if err := validateDialNetwork(o.DialNetwork); err != nil {
+		return err
+	}
+	if o.MessageFramer != nil {
+		if o.CoalesceDelay > 0 {
+			return errors.New("a message framer can't be combined with write coalescing")
+		}
+		if err := o.MessageFramer.validate(); err != nil {
+			return err
+		}
+	}
+	if o.BackendPool != nil && o.BackendPool.MaxIdle <= 0 {
+		return errors.New("the backend pool must keep at least one idle connection")
+	}
+	if o.TLSMinVersion != 0 && (o.TLSMinVersion < tls.VersionTLS10 || o.TLSMinVersion > tls.VersionTLS13) {
+		return fmt.Errorf("unknown minimum TLS version: %s", tlsVersionName(o.TLSMinVersion))
+	}
+	for _, reserved := range reservedResponseHeaders {
+		if http.CanonicalHeaderKey(o.ServerIdentityHeader) == reserved {
+			return fmt.Errorf("%s is part of the websocket handshake and can't be the server identity header", reserved)
+		}
+	}
+	return nil
+}
+
+// validateDialNetwork checks that network is a TCP network that can be used to dial backends.
+func validateDialNetwork(network string) error {
+	switch network {
+	case "", "tcp", "tcp4", "tcp6":
+		return nil
+	default:
+		return fmt.Errorf("invalid dial network %q: must be tcp, tcp4 or tcp6", network)
+	}
+}
+
 // StartProxyServer will start a websocket server that will decode
 // the websocket data and write the resulting data to the provided
+// It blocks until the server stops. It returns nil when the server is shut down by closing
+// shutdownC, and otherwise the error that stopped it, such as the listener failing.
 func StartProxyServer(logger logger.Service, listener net.Listener, staticHost string, shutdownC <-chan struct{}, streamHandler func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header)) error {
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-	}
-	h := handler{
-		upgrader:      upgrader,
-		logger:        logger,
-		staticHost:    staticHost,
-		streamHandler: streamHandler,
+	return StartProxyServerWithOptions(logger, listener, staticHost, shutdownC, streamHandler, ProxyOptions{})
+}
+
+// StartProxyServerWithOptions is StartProxyServer with the optional behaviour described by options.
+func StartProxyServerWithOptions(logger logger.Service, listener net.Listener, staticHost string, shutdownC <-chan struct{}, streamHandler func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header), options ProxyOptions) error {
+	server, err := NewProxyServer(logger, staticHost, streamHandler, options)
+	if err != nil {
+		return err
 	}
+	return server.Serve(listener, shutdownC)
+}
 
-	httpServer := &http.Server{Addr: listener.Addr().String(), Handler: &h}
+// serveProxy serves a websocket proxy handler on listener until shutdownC is closed.
+func serveProxy(logger logger.Service, httpServer *http.Server, listener net.Listener, shutdownC <-chan struct{}) error {
+	// http.Server.Addr is a TCP address, it is meaningless for unix sockets
+	if _, ok := listener.Addr().(*net.TCPAddr); ok {
+		httpServer.Addr = listener.Addr().String()
+	}
 	go func() {
 		<-shutdownC
+		// Closing the server closes the listener, which also unlinks the socket file for
+		// unix listeners created with net.Listen.
 		httpServer.Close()
 	}()
 
-	return httpServer.Serve(listener)
+	logger.Debugf("Websocket proxy server listening on %s", listenerAddress(listener))
+	if err := httpServer.Serve(&tlsMismatchListener{Listener: listener, logger: logger}); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// newHTTPServer returns the HTTP server for a proxy serving requests with serving, which
+// is h or wraps it.
+func newHTTPServer(serving http.Handler, h *handler) *http.Server {
+	server := &http.Server{
+		Handler:           serving,
+		BaseContext:       h.options.BaseContext,
+		ReadHeaderTimeout: h.options.HandshakeReadTimeout,
+	}
+	if h.handshakes != nil {
+		server.ConnContext = h.handshakes.connContext
+		server.ConnState = h.handshakes.connState
+	}
+	return server
+}
+
+// listenerAddress returns a printable address for the listener. The network is included
+// for unix sockets, because a bare path is ambiguous in log lines.
+func listenerAddress(listener net.Listener) string {
+	addr := listener.Addr()
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return addr.Network() + ":" + addr.String()
+	}
+	return addr.String()
 }
 
 // HTTP handler for the websocket proxy.
 type handler struct {
-	logger        logger.Service
-	staticHost    string
-	upgrader      websocket.Upgrader
-	streamHandler func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header)
+	logger             logger.Service
+	staticHost         string
+	resolver           Resolver
+	upgrader           websocket.Upgrader
+	streamHandler      ContextStreamHandler
+	options            ProxyOptions
+	ipLimiter          *ipRateLimiter
+	globalLimiter      *tokenBucket
+	destinationLimiter *destinationLimiter
+	handshakes         *handshakeTracker
+	memory             *memoryBudget
+	sessions           *sessionStore
+	connections        *connectionRegistry
+	backendHealth      *backendHealthChecker
+	backendPool        *backendPool
+}
+
+func newHandler(logger logger.Service, staticHost string, streamHandler func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header), options ProxyOptions) *handler {
+	return newContextHandler(logger, staticHost, IgnoreContext(streamHandler), options)
+}
+
+func newContextHandler(logger logger.Service, staticHost string, streamHandler ContextStreamHandler, options ProxyOptions) *handler {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+	if options.Upgrader != nil {
+		upgrader = *options.Upgrader
+	}
+	if options.ReadBufferSize > 0 {
+		upgrader.ReadBufferSize = options.ReadBufferSize
+	}
+	if options.WriteBufferSize > 0 {
+		upgrader.WriteBufferSize = options.WriteBufferSize
+	}
+	if options.CheckOrigin != nil {
+		upgrader.CheckOrigin = options.CheckOrigin
+	}
+	if options.WriteBufferPool != nil {
+		upgrader.WriteBufferPool = options.WriteBufferPool
+	}
+	if options.ScalableCompression {
+		configureScalableCompression(&upgrader)
+	}
+	h := &handler{
+		upgrader:      upgrader,
+		logger:        logger,
+		staticHost:    staticHost,
+		streamHandler: streamHandler,
+		options:       options,
+		connections:   newConnectionRegistry(),
+	}
+	if options.UpgradeRateLimit != nil {
+		h.ipLimiter = newIPRateLimiter(*options.UpgradeRateLimit)
+	}
+	if limit := options.GlobalUpgradeRateLimit; limit != nil {
+		h.globalLimiter = newTokenBucket(limit.PerSecond, limit.Burst)
+	}
+	if options.DestinationLimits != nil {
+		h.destinationLimiter = newDestinationLimiter(*options.DestinationLimits)
+	}
+	if options.MaxPendingHandshakes > 0 {
+		h.handshakes = newHandshakeTracker(options.MaxPendingHandshakes)
+	}
+	if options.MemoryBudget > 0 {
+		h.memory = newMemoryBudget(options.MemoryBudget)
+	}
+	if options.SessionResumeTTL > 0 {
+		h.sessions = newSessionStore(options.SessionResumeTTL)
+	}
+	switch {
+	case options.Resolver != nil:
+		h.resolver = options.Resolver
+	case staticHost != "":
+		h.resolver = StaticResolver(staticHost)
+	case options.DestinationFromToken != nil:
+		h.resolver = TokenResolver(options.DestinationFromToken)
+	default:
+		h.resolver = JumpHeaderResolver{}
+	}
+	if h.options.DialBackend == nil {
+		h.options.DialBackend = new(net.Dialer).DialContext
+	}
+	if h.options.DialNetwork == "" {
+		h.options.DialNetwork = "tcp"
+	}
+	if h.options.PongWait <= 0 {
+		h.options.PongWait = defaultPongWait
+	}
+	if h.options.CloseGracePeriod <= 0 {
+		h.options.CloseGracePeriod = defaultCloseGracePeriod
+	}
+	if h.options.BackendDialTimeout <= 0 {
+		h.options.BackendDialTimeout = defaultBackendDialTimeout
+	}
+	if options.BackendHealthCheck != nil {
+		h.backendHealth = newBackendHealthChecker(*options.BackendHealthCheck, staticHost, h.options.DialBackend, h.options.DialNetwork, h.options.BackendDialTimeout)
+	}
+	if options.BackendPool != nil && staticHost != "" {
+		h.backendPool = h.newBackendPool(*options.BackendPool)
+	}
+	if h.options.ServerIdentityHeader == "" {
+		h.options.ServerIdentityHeader = "Server"
+	}
+	if h.options.MaxMuxStreams == 0 {
+		h.options.MaxMuxStreams = defaultMaxMuxStreams
+	}
+	if h.options.CompressionMinSize == 0 {
+		h.options.CompressionMinSize = defaultCompressionMinSize
+	}
+	return h
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// If remote is an empty string, get the destination from the client.
-	finalDestination := h.staticHost
-	if finalDestination == "" {
-		if jumpDestination := r.Header.Get(h2mux.CFJumpDestinationHeader); jumpDestination == "" {
-			h.logger.Error("Did not receive final destination from client. The --destination flag is likely not set")
-			return
-		} else {
-			finalDestination = jumpDestination
-		}
+	if !h.handshakes.handshakeRead(r) {
+		h.logger.Debugf("Rejecting request from %s: too many pending handshakes", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if h.options.HealthCheckPath != "" && r.URL.Path == h.options.HealthCheckPath {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if h.serveTestClient(w, r) {
+		return
 	}
 
-	stream, err := net.Dial("tcp", finalDestination)
+	if h.ipLimiter != nil && !h.ipLimiter.allow(clientIP(r)) {
+		h.logger.Debugf("Rejecting upgrade from %s: rate limit exceeded", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	if h.globalLimiter != nil && !h.globalLimiter.allow() {
+		h.logger.Debugf("Rejecting upgrade from %s: global rate limit exceeded", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if !h.backendHealth.healthy() {
+		h.logger.Debugf("Rejecting request from %s: no healthy backends", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if h.rejectMalformedKey(w, r) {
+		return
+	}
+
+	finalDestination, err := h.resolver.Resolve(r.Context(), r)
+	var authErr *NetworkAuthenticationError
+	if errors.As(err, &authErr) {
+		h.logger.Debugf("Refusing request from %s: %s", r.RemoteAddr, err)
+		authErr.write(w)
+		return
+	}
 	if err != nil {
-		h.logger.Errorf("Cannot connect to remote: %s", err)
+		h.logger.Errorf("Cannot resolve the destination for %s: %s", r.RemoteAddr, err)
+		status, message := http.StatusBadRequest, err.Error()
+		var destinationErr *DestinationError
+		if errors.As(err, &destinationErr) {
+			status, message = destinationErr.Status, destinationErr.Err.Error()
+		}
+		http.Error(w, message, status)
+		return
+	}
+
+	if !h.destinationLimiter.acquire(finalDestination) {
+		h.logger.Debugf("Rejecting request from %s: too many connections to %s", r.RemoteAddr, finalDestination)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer h.destinationLimiter.release(finalDestination)
+
+	memory, ok := h.memory.admit(h.connectionMemory())
+	if !ok {
+		h.logger.Debugf("Rejecting request from %s: memory budget exceeded", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 		return
 	}
+	defer memory.close()
+
+	r, span := h.startConnectionSpan(r, finalDestination)
+	defer span.End()
+	tags := h.connectionTags(r)
+	log := h.connectionLogger(tags)
+	h.logRequestHeaders(log, r)
+	if h.options.EchoBackend && finalDestination == echoDestination {
+		h.serveEcho(w, r, tags)
+		return
+	}
+	if h.options.WebsocketBackend {
+		h.serveWebsocketBackend(w, r, finalDestination, tags)
+		return
+	}
+
+	resumed := h.sessions.resume(r.Header.Get(resumeTokenHeader), finalDestination)
+	var stream net.Conn
+	if resumed != nil {
+		log.Debugf("Resuming session to %s", finalDestination)
+		stream = resumed.conn
+	} else if h.options.LazyBackendDial {
+		stream = newLazyBackendConn(finalDestination, func() (net.Conn, error) {
+			conn, err := h.connectBackend(r, log, finalDestination)
+			if err != nil {
+				log.Errorf("Cannot connect to remote: %s", err)
+			}
+			return conn, err
+		})
+	} else {
+		stream, err = h.connectBackend(r, log, finalDestination)
+		if err != nil {
+			log.Errorf("Cannot connect to remote: %s", err)
+			if errors.Is(err, errBackendDialTimeout) {
+				http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+			} else if errors.Is(err, errInitialBackendPayload) {
+				http.Error(w, errInitialBackendPayload.Error(), http.StatusBadGateway)
+			} else {
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			}
+			return
+		}
+	}
+	var attachment *backendAttachment
+	if h.sessions != nil {
+		backend := resumed
+		if backend == nil {
+			if backend, err = newResumableBackend(stream, finalDestination); err != nil {
+				log.Errorf("Cannot create resume token: %s", err)
+				stream.Close()
+				return
+			}
+		}
+		attachment = backend.attach()
+		stream = attachment
+	}
+	backendErrors := &backendErrorConn{Conn: stream}
+	stream = backendErrors
+	if h.options.ChaosLatency != nil {
+		stream = &chaosConn{Conn: stream, latency: h.options.ChaosLatency}
+	}
+	if h.options.Transformer != nil {
+		stream = &transformConn{Conn: stream, transformer: h.options.Transformer}
+	}
+	if h.options.MessageFramer != nil {
+		stream = newFramingConn(stream, h.options.MessageFramer)
+	}
 	defer stream.Close()
 
 	if !websocket.IsWebSocketUpgrade(r) {
-		w.Write(nonWebSocketRequestPage())
+		writeNonWebSocketResponse(w)
 		return
 	}
-	conn, err := h.upgrader.Upgrade(w, r, nil)
+	responseHeader := h.responseHeader(r)
+	compress := h.options.StreamCompression && offersStreamCompression(r.Header)
+	if compress {
+		responseHeader.Set(streamCompressionHeader, streamCompressionDeflate)
+	}
+	if attachment != nil {
+		responseHeader.Set(resumeTokenHeader, attachment.backend.token)
+	}
+	conn, handshakeDuration, err := h.upgrade(w, r, responseHeader)
 	if err != nil {
-		h.logger.Errorf("failed to upgrade: %s", err)
+		log.Errorf("failed to upgrade: %s", err)
 		return
 	}
-	conn.SetReadDeadline(time.Now().Add(pongWait))
-	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	done := make(chan struct{})
-	go pinger(h.logger, conn, done)
+	h.configureCompression(log, conn, r)
+	logTLSParameters(log, r)
+	event := ConnectionEvent{ID: uuid.New().String(), RemoteAddr: r.RemoteAddr, Destination: finalDestination, Tags: tags, HandshakeDuration: handshakeDuration, span: spanFromContext(r.Context())}
+	keepAlive := h.startKeepAlive(log, conn, event.ID)
+	wsConn := &Conn{Conn: conn, stats: newConnStats(), readPolicy: h.readPolicy(), compression: h.compressFrameFilter(), maxFrameSize: h.options.MaxClientFrameSize}
+	wsConn.readPolicy.memory = memory
+	if r.TLS != nil {
+		wsConn.peerCertificates = r.TLS.PeerCertificates
+	}
+	if h.options.TraceFrames {
+		wsConn.tracer = &frameTracer{log: log}
+	}
+	var frames io.Writer = messageWriter{conn: conn, tracer: wsConn.tracer, maxFrameSize: wsConn.maxFrameSize}
+	if h.options.CoalesceDelay > 0 {
+		// With compression the stats count the uncompressed data as it is written, rather
+		// than the compressed data the coalescer sends
+		coalescerStats := wsConn.stats
+		if compress {
+			coalescerStats = nil
+		}
+		wsConn.coalescer = newCoalescingWriter(conn, h.options.CoalesceDelay, h.options.CoalesceSize, coalescerStats)
+		wsConn.coalescer.compression = wsConn.compression
+		wsConn.coalescer.tracer = wsConn.tracer
+		wsConn.coalescer.maxFrameSize = wsConn.maxFrameSize
+		frames = wsConn.coalescer
+	}
+	if compress {
+		wsConn.enableStreamCompression(frames)
+	}
+	closeReceived := notifyClose(conn)
+	h.connectionOpened(event, wsConn.stats, conn)
+	memory.onShed(h.shedConnection(event.ID))
+	sessionTimer := h.limitSession(log, conn, stream)
 	defer func() {
-		done <- struct{}{}
-		conn.Close()
+		sessionExpired := sessionTimer != nil && !sessionTimer.Stop()
+		keepAlive.stop()
+		if wsConn.coalescer != nil {
+			wsConn.coalescer.Flush()
+		}
+		h.closeGracefully(log, conn, closeReceived, backendErrors.closeMessage)
+		// Close the backend, or detach it for the client to resume the session, before
+		// reporting, so no more data can be counted
+		if !h.sessions.park(attachment, closeReceived) {
+			stream.Close()
+		}
+		h.connectionClosed(event, wsConn.stats, closeReason(keepAlive, sessionExpired, backendErrors.closeMessage))
 	}()
 
-	h.streamHandler(&Conn{conn}, stream, r.Header)
+	h.serveStream(h.streamContext(r), log, wsConn, stream, r.Header)
+}
+
+// notifyClose returns a channel that is closed when a close frame is read from conn.
+func notifyClose(conn *websocket.Conn) <-chan struct{} {
+	closeReceived := make(chan struct{})
+	replyToClose := conn.CloseHandler()
+	conn.SetCloseHandler(func(code int, text string) error {
+		close(closeReceived)
+		return replyToClose(code, text)
+	})
+	return closeReceived
+}
+
+// closeGracefully sends a close frame, with the code and reason from closeMessage, and waits
+// up to the close grace period for the client to acknowledge it before closing the socket.
+// The acknowledgement is read by whichever goroutine is still reading from conn, which
+// signals closeReceived.
+func (h *handler) closeGracefully(log logger.Service, conn *websocket.Conn, closeReceived <-chan struct{}, closeMessage func() (int, string)) {
+	defer conn.Close()
+
+	select {
+	case <-closeReceived:
+		// The client started the close handshake, and it was acknowledged when received
+		return
+	default:
+	}
+	message := websocket.FormatCloseMessage(closeMessage())
+	if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait)); err != nil {
+		return
+	}
+	select {
+	case <-closeReceived:
+	case <-time.After(h.options.CloseGracePeriod):
+		log.Debugf("Client %s did not acknowledge close within %s", conn.RemoteAddr(), h.options.CloseGracePeriod)
+	}
+}
+
+// connectBackend connects to the backend for the client's request, either by dialing the
+// destination or, when chaining proxies, through the upstream websocket proxy.
+func (h *handler) connectBackend(r *http.Request, log logger.Service, destination string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if h.options.UpstreamWebSocket != nil {
+		conn, err = h.dialUpstream(r, log, destination)
+	} else if conn = h.pooledBackend(log, destination); conn == nil {
+		conn, err = h.dialBackend(r.Context(), log, destination)
+	}
+	span := spanFromContext(r.Context())
+	if err != nil {
+		span.AddEvent("backend dial failed", map[string]string{"error": err.Error()})
+		return nil, err
+	}
+	span.AddEvent("backend dialed", map[string]string{"backend.address": conn.RemoteAddr().String()})
+	if err := h.sendInitialBackendPayload(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// pooledBackend checks out a connection to destination from the backend pool, returning nil
+// if there isn't one. Only the static host is pooled.
+func (h *handler) pooledBackend(log logger.Service, destination string) net.Conn {
+	if destination != h.staticHost {
+		return nil
+	}
+	conn := h.backendPool.get(log)
+	if conn != nil {
+		log.Debugf("Using pooled backend connection to %s", destination)
+	}
+	return conn
+}
+
+// sendInitialBackendPayload writes the InitialBackendPayload, if any, to a new backend
+// connection.
+func (h *handler) sendInitialBackendPayload(conn net.Conn) error {
+	if len(h.options.InitialBackendPayload) == 0 {
+		return nil
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	defer conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.Write(h.options.InitialBackendPayload); err != nil {
+		return fmt.Errorf("%w: %s", errInitialBackendPayload, err)
+	}
+	return nil
+}
+
+// dialBackend dials the destination, logging the address it resolved to and how long the dial took.
+func (h *handler) dialBackend(ctx context.Context, log logger.Service, destination string) (net.Conn, error) {
+	network, address := h.options.DialNetwork, destination
+	if h.options.DestinationParser != nil {
+		var err error
+		if network, address, err = h.options.DestinationParser(destination); err != nil {
+			log.Debugf("Cannot parse backend destination %s: %s", destination, err)
+			return nil, err
+		}
+	}
+	return h.dialBackendAddress(ctx, log, destination, network, address)
+}
+
+// dialBackendAddress dials the backend for destination at address on network, within the
+// backend dial timeout.
+func (h *handler) dialBackendAddress(ctx context.Context, log logger.Service, destination, network, address string) (net.Conn, error) {
+	start := time.Now()
+	dialCtx, cancel := context.WithTimeout(ctx, h.options.BackendDialTimeout)
+	defer cancel()
+	conn, err := h.options.DialBackend(dialCtx, network, address)
+	if err != nil {
+		if dialCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("%w: %s", errBackendDialTimeout, err)
+		}
+		log.Debugf("Dial to backend %s failed after %s: %s", destination, time.Since(start), err)
+		return nil, err
+	}
+	log.Debugf("Dialed backend %s (resolved %s) in %s", destination, conn.RemoteAddr(), time.Since(start))
+	h.configureBackendConn(conn)
+	return conn, nil
+}
+
+// responseHeader returns the configured headers to send on the upgrade response to r,
+// without any headers reserved for the websocket handshake.
+func (h *handler) responseHeader(r *http.Request) http.Header {
+	header := http.Header{}
+	if len(h.options.ResponseHeader) > 0 {
+		header = h.options.ResponseHeader.Clone()
+		for _, reserved := range reservedResponseHeaders {
+			header.Del(reserved)
+		}
+	}
+	if h.options.ServerIdentity != nil {
+		header.Set(h.options.ServerIdentityHeader, h.options.ServerIdentity(r))
+	}
+	return header
+}
+
+// StaticServerIdentity returns a ProxyOptions.ServerIdentity that always returns identity.
+func StaticServerIdentity(identity string) func(r *http.Request) string {
+	return func(*http.Request) string {
+		return identity
+	}
+}
+
+// serveStream runs the stream handler, recovering from any panic on its goroutine so that a
+// misbehaving handler only takes down its own connection rather than the whole proxy. Panics
+// in goroutines the handler starts aren't recovered.
+func (h *handler) serveStream(ctx context.Context, log logger.Service, wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header) {
+	if !h.options.DisablePanicRecovery {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("websocket stream handler panicked: %v\n%s", r, debug.Stack())
+			}
+		}()
+	}
+	h.streamHandler(ctx, wsConn, remoteConn, requestHeaders)
 }
 
 // SendSSHPreamble sends the final SSH destination address to the cloudflared SSH proxy
 // The destination is preceded by its length
+// If stream is buffered and has a Flush() error method, the preamble is flushed once written
 // Not part of sshserver module to fix compilation for incompatible operating systems
 func SendSSHPreamble(stream net.Conn, destination, token string) error {
 	preamble := sshserver.SSHPreamble{Destination: destination, JWT: token}
@@ -234,6 +1472,28 @@ func SendSSHPreamble(stream net.Conn, destination, token string) error {
 	if _, err := stream.Write(payload); err != nil {
 		return err
 	}
+
+	return flushPreamble(stream)
+}
+
+// SendVersionedSSHPreamble is SendSSHPreamble, but starts the preamble with a version byte so
+// that later preamble formats can be negotiated, see sshserver.WriteSSHPreamble. Older SSH
+// proxies refuse versioned preambles.
+func SendVersionedSSHPreamble(stream net.Conn, destination, token string) error {
+	preamble := sshserver.SSHPreamble{Destination: destination, JWT: token}
+	if err := sshserver.WriteSSHPreamble(stream, preamble); err != nil {
+		return err
+	}
+	return flushPreamble(stream)
+}
+
+// flushPreamble flushes stream if it is buffered. The preamble has to reach the SSH proxy
+// before any SSH traffic, which the proxy is waiting on, so it can't be left sitting in a
+// buffered stream.
+func flushPreamble(stream net.Conn) error {
+	if flusher, ok := stream.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
 	return nil
 }
 
@@ -282,15 +1542,30 @@ func ChangeRequestScheme(reqURL *url.URL) string {
 	}
 }
 
-// pinger simulates the websocket connection to keep it alive
-func pinger(logger logger.Service, ws *websocket.Conn, done chan struct{}) {
+// isClosedConnErr reports whether err comes from using a websocket connection after a close
+// frame was sent or the connection was closed, which is how connections normally end. The
+// closed connection error is matched by its text because this module targets go 1.15,
+// which doesn't have net.ErrClosed to compare it with.
+func isClosedConnErr(err error) bool {
+	return err == websocket.ErrCloseSent || strings.HasSuffix(err.Error(), "use of closed network connection")
+}
+
+// pinger simulates the websocket connection to keep it alive. Each ping carries the time it
+// was sent, see pingPayload. Failed pings are logged with connectionID and the client's
+// address.
+func pinger(logger logger.Service, ws *websocket.Conn, connectionID string, done chan struct{}, pingPeriod time.Duration) {
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
-				logger.Debugf("failed to send ping message: %s", err)
+			now := time.Now()
+			if err := ws.WriteControl(websocket.PingMessage, pingPayload(now), now.Add(writeWait)); err != nil {
+				if isClosedConnErr(err) {
+					// The connection is closing, so there is no need to keep it alive
+					return
+				}
+				logger.Debugf("failed to send ping message on connection %s from %s: %s", connectionID, ws.RemoteAddr(), err)
 			}
 		case <-done:
 			return
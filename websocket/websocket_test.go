@@ -1,17 +1,38 @@
 package websocket
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/cloudflared/hello"
 	"github.com/cloudflare/cloudflared/logger"
+	"github.com/cloudflare/cloudflared/sshserver"
 	"github.com/cloudflare/cloudflared/tlsconfig"
+	gws "github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/websocket"
 )
 
@@ -38,6 +59,104 @@ func testRequest(t *testing.T, url string, stream io.ReadWriter) *http.Request {
 	return req
 }
 
+// testLogger is a logger.Service that records every line logged to it.
+type testLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) log(message string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, message)
+}
+
+func (l *testLogger) Error(message string) { l.log(message) }
+func (l *testLogger) Info(message string)  { l.log(message) }
+func (l *testLogger) Debug(message string) { l.log(message) }
+func (l *testLogger) Fatal(message string) { l.log(message) }
+
+func (l *testLogger) Errorf(format string, args ...interface{}) { l.log(fmt.Sprintf(format, args...)) }
+func (l *testLogger) Infof(format string, args ...interface{})  { l.log(fmt.Sprintf(format, args...)) }
+func (l *testLogger) Debugf(format string, args ...interface{}) { l.log(fmt.Sprintf(format, args...)) }
+func (l *testLogger) Fatalf(format string, args ...interface{}) { l.log(fmt.Sprintf(format, args...)) }
+
+func (l *testLogger) Add(io.Writer, logger.Formatter, ...logger.Level) {}
+
+// Lines returns the lines logged so far.
+func (l *testLogger) Lines() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+// echoBackend starts a TCP server that echoes everything written to it.
+func echoBackend(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// startTestProxy starts a proxy server to staticHost with the given stream handler and
+// options and returns its address. The server is shut down at the end of the test.
+func startTestProxy(t *testing.T, staticHost string, streamHandler func(*Conn, net.Conn, http.Header), options ProxyOptions) string {
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	shutdownC := make(chan struct{})
+	t.Cleanup(func() { close(shutdownC) })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go StartProxyServerWithOptions(logger, listener, staticHost, shutdownC, streamHandler, options)
+	return listener.Addr().String()
+}
+
+// dialTestProxy opens a websocket client connection to the proxy at addr.
+func dialTestProxy(t *testing.T, addr string, header http.Header) *gws.Conn {
+	conn, _, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), header)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// websocketPair returns the server and client ends of a websocket connection.
+func websocketPair(t testing.TB) (*gws.Conn, *gws.Conn) {
+	serverC := make(chan *gws.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := gws.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverC <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := gws.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial websocket server: %s", err)
+	}
+	serverConn := <-serverC
+	t.Cleanup(func() {
+		client.Close()
+		serverConn.Close()
+	})
+	return serverConn, client
+}
+
 func websocketClientTLSConfig(t *testing.T) *tls.Config {
 	certPool := x509.NewCertPool()
 	helloCert, err := tlsconfig.GetHelloCertificateX509()
@@ -56,6 +175,118 @@ func TestWebsocketHeaders(t *testing.T) {
 	assert.Equal(t, "curl/7.59.0", wsHeaders.Get("User-Agent"))
 }
 
+func TestClientConnectTransparentExtensions(t *testing.T) {
+	const extensions = "permessage-deflate; client_max_window_bits"
+	receivedC := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedC <- r.Header.Get("Sec-Websocket-Extensions")
+		upgrader := gws.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer origin.Close()
+
+	for _, transparent := range []bool{false, true} {
+		req := testRequest(t, origin.URL, nil)
+		req.Header.Set("Sec-Websocket-Extensions", extensions)
+		conn, _, err := ClientConnectWithOptions(req, nil, ClientOptions{TransparentExtensions: transparent})
+		assert.NoError(t, err)
+		conn.Close()
+
+		if transparent {
+			assert.Equal(t, extensions, <-receivedC)
+		} else {
+			assert.Empty(t, <-receivedC)
+		}
+	}
+}
+
+func TestClientConnectPreserveURLHost(t *testing.T) {
+	receivedC := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedC <- r.Host
+		upgrader := gws.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	assert.NoError(t, err)
+
+	for _, preserve := range []bool{false, true} {
+		req := testRequest(t, origin.URL, nil)
+		req.Host = "virtual.example.com"
+		conn, _, err := ClientConnectWithOptions(req, nil, ClientOptions{PreserveURLHost: preserve})
+		assert.NoError(t, err)
+		conn.Close()
+
+		if preserve {
+			assert.Equal(t, originURL.Host, <-receivedC)
+		} else {
+			assert.Equal(t, "virtual.example.com", <-receivedC)
+		}
+	}
+}
+
+// hijackableResponse is a ResponseWriter whose connection can be hijacked.
+type hijackableResponse struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+	brw  *bufio.ReadWriter
+}
+
+func (h *hijackableResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, h.brw, nil
+}
+
+func TestClientConnectOverConn(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	requestC := make(chan *http.Request, 1)
+	go func() {
+		brw := bufio.NewReadWriter(bufio.NewReader(serverConn), bufio.NewWriter(serverConn))
+		req, err := http.ReadRequest(brw.Reader)
+		if err != nil {
+			return
+		}
+		requestC <- req
+		upgrader := gws.Upgrader{}
+		conn, err := upgrader.Upgrade(&hijackableResponse{httptest.NewRecorder(), serverConn, brw}, req, nil)
+		if err != nil {
+			return
+		}
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(messageType, message)
+	}()
+
+	req := testRequest(t, "http://example.com/ssh", nil)
+	conn, resp, err := ClientConnectOverConn(clientConn, req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, testSecWebsocketAccept, resp.Header.Get("Sec-WebSocket-Accept"))
+
+	received := <-requestC
+	assert.Equal(t, "example.com", received.Host)
+	assert.Equal(t, "/ssh", received.URL.Path)
+
+	assert.NoError(t, conn.WriteMessage(gws.TextMessage, []byte("over a pipe")))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "over a pipe", string(message))
+}
+
 func TestGenerateAcceptKey(t *testing.T) {
 	req := testRequest(t, "http://example.com", nil)
 	assert.Equal(t, testSecWebsocketAccept, generateAcceptKey(req))
@@ -101,6 +332,497 @@ func TestServe(t *testing.T) {
 	<-errC
 }
 
+func TestStartProxyServerNoDestination(t *testing.T) {
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go StartProxyServer(logger, listener, "", shutdownC, DefaultStreamHandler)
+
+	client := http.Client{Timeout: 5 * time.Second}
+	req := testRequest(t, fmt.Sprintf("http://%s/", listener.Addr()), nil)
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), errNoDestination.Error())
+}
+
+func TestStartProxyServerUnixSocket(t *testing.T) {
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	shutdownC := make(chan struct{})
+	errC := make(chan error)
+
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "websocket")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "proxy.sock")
+	listener, err := net.Listen("unix", socketPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "unix:"+socketPath, listenerAddress(listener))
+
+	go func() {
+		errC <- StartProxyServer(logger, listener, backend.Addr().String(), shutdownC, DefaultStreamHandler)
+	}()
+
+	dialer := gws.Dialer{
+		NetDial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}
+	conn, _, err := dialer.Dial("ws://unix/", nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	message := []byte("hello over a unix socket")
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, message))
+	_, echoed, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, message, echoed)
+
+	close(shutdownC)
+	<-errC
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err), "socket file should be unlinked on shutdown")
+}
+
+func TestStreamHandlerPanicRecovery(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	var calls int32
+	streamHandler := func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			panic("misbehaving stream handler")
+		}
+		DefaultStreamHandler(wsConn, remoteConn, requestHeaders)
+	}
+	addr := startTestProxy(t, backend.Addr().String(), streamHandler, ProxyOptions{})
+
+	// The first connection is closed when its handler panics
+	conn := dialTestProxy(t, addr, nil)
+	_, _, err := conn.ReadMessage()
+	assert.Error(t, err)
+
+	// and the server carries on serving new ones
+	conn = dialTestProxy(t, addr, nil)
+	message := []byte("still alive")
+	assert.NoError(t, conn.WriteMessage(gws.BinaryMessage, message))
+	_, echoed, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, message, echoed)
+}
+
+func TestUpgradeResponseHeader(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	responseHeader := http.Header{}
+	responseHeader.Set("X-Frame-Options", "DENY")
+	responseHeader.Set("Cf-Cache-Status", "DYNAMIC")
+	responseHeader.Set("Upgrade", "not-websocket")
+	responseHeader.Set("Sec-Websocket-Accept", "bogus")
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{ResponseHeader: responseHeader})
+
+	conn, resp, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/", addr), nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "DENY", resp.Header.Get("X-Frame-Options"))
+	assert.Equal(t, "DYNAMIC", resp.Header.Get("Cf-Cache-Status"))
+	assert.Equal(t, []string{"websocket"}, resp.Header["Upgrade"])
+	assert.Len(t, resp.Header["Sec-Websocket-Accept"], 1)
+}
+
+func TestServerIdentity(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		options ProxyOptions
+		header  string
+		value   string
+	}{
+		{name: "static", options: ProxyOptions{ServerIdentity: StaticServerIdentity("cloudflared-1")}, header: "Server", value: "cloudflared-1"},
+		{
+			name: "per request",
+			options: ProxyOptions{
+				ServerIdentity:       func(r *http.Request) string { return "cloudflared-1 " + r.URL.Path },
+				ServerIdentityHeader: "Cf-Instance",
+			},
+			header: "Cf-Instance",
+			value:  "cloudflared-1 /path",
+		},
+		{name: "none", header: "Server"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, test.options)
+			conn, resp, err := gws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/path", addr), nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+			assert.Equal(t, test.value, resp.Header.Get(test.header))
+		})
+	}
+
+	_, err := NewProxyServer(&testLogger{}, "", DefaultStreamHandler, ProxyOptions{ServerIdentityHeader: "upgrade"})
+	assert.Error(t, err)
+}
+
+func TestConnWriteTo(t *testing.T) {
+	server, client := websocketPair(t)
+
+	messages := make([][]byte, 3)
+	var sent bytes.Buffer
+	for i := range messages {
+		messages[i] = make([]byte, 1024*1024)
+		rand.Read(messages[i])
+		sent.Write(messages[i])
+	}
+	go func() {
+		for _, message := range messages {
+			client.WriteMessage(gws.BinaryMessage, message)
+		}
+		client.WriteMessage(gws.CloseMessage, gws.FormatCloseMessage(gws.CloseNormalClosure, ""))
+	}()
+
+	var received bytes.Buffer
+	n, err := (&Conn{Conn: server}).WriteTo(&received)
+	assert.True(t, gws.IsCloseError(err, gws.CloseNormalClosure))
+	assert.Equal(t, int64(sent.Len()), n)
+	assert.Equal(t, sent.Bytes(), received.Bytes())
+}
+
+func TestConnReadFrom(t *testing.T) {
+	server, client := websocketPair(t)
+
+	sent := make([]byte, 4*1024*1024)
+	rand.Read(sent)
+	go func() {
+		n, err := (&Conn{Conn: server}).ReadFrom(bytes.NewReader(sent))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(sent)), n)
+	}()
+
+	var received bytes.Buffer
+	for received.Len() < len(sent) {
+		_, message, err := client.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.LessOrEqual(t, len(message), streamBufferSize)
+		received.Write(message)
+	}
+	assert.Equal(t, sent, received.Bytes())
+}
+
+func TestConnWriteEmpty(t *testing.T) {
+	server, client := websocketPair(t)
+	conn := &Conn{Conn: server}
+
+	n, err := conn.Write(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = conn.Write([]byte("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	// The empty write didn't send a frame, so the first frame is the data
+	_, message, err := client.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(message))
+}
+
+func TestConnWriteError(t *testing.T) {
+	server, _ := websocketPair(t)
+	conn := &Conn{Conn: server}
+	server.Close()
+
+	n, err := conn.Write([]byte("data"))
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestCloseCode(t *testing.T) {
+	server, client := websocketPair(t)
+	go client.WriteMessage(gws.CloseMessage, gws.FormatCloseMessage(gws.CloseGoingAway, "restarting"))
+
+	_, err := (&Conn{Conn: server}).Read(make([]byte, 10))
+	code, ok := CloseCode(err)
+	assert.True(t, ok)
+	assert.Equal(t, gws.CloseGoingAway, code)
+
+	_, ok = CloseCode(io.ErrUnexpectedEOF)
+	assert.False(t, ok)
+	_, ok = CloseCode(nil)
+	assert.False(t, ok)
+}
+
+func benchmarkConnCopy(b *testing.B, copyFn func(dst io.Writer, conn *Conn) (int64, error)) {
+	server, client := websocketPair(b)
+	message := make([]byte, 16*1024)
+	b.SetBytes(int64(len(message)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			client.WriteMessage(gws.BinaryMessage, message)
+		}
+		client.WriteMessage(gws.CloseMessage, gws.FormatCloseMessage(gws.CloseNormalClosure, ""))
+	}()
+	copyFn(ioutil.Discard, &Conn{Conn: server})
+}
+
+func BenchmarkConnRead(b *testing.B) {
+	benchmarkConnCopy(b, func(dst io.Writer, conn *Conn) (int64, error) {
+		// Hide WriteTo so io.Copy goes through Read
+		return io.Copy(dst, struct{ io.Reader }{conn})
+	})
+}
+
+func BenchmarkConnWriteTo(b *testing.B) {
+	benchmarkConnCopy(b, func(dst io.Writer, conn *Conn) (int64, error) {
+		return io.Copy(dst, conn)
+	})
+}
+
+// benchmarkWriteBufferPool upgrades connections, with the proxy's upgrader configured by
+// options, that each send one message. Each connection allocates a 64KB write buffer unless
+// they share a pool.
+func benchmarkWriteBufferPool(b *testing.B, options ProxyOptions) {
+	options.WriteBufferSize = 64 * 1024
+	h := newHandler(&testLogger{}, "", DefaultStreamHandler, options)
+	message := []byte("message")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := h.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(gws.BinaryMessage, message)
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, _, err := gws.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+func BenchmarkWriteBuffers(b *testing.B) {
+	benchmarkWriteBufferPool(b, ProxyOptions{})
+}
+
+func BenchmarkWriteBufferPool(b *testing.B) {
+	benchmarkWriteBufferPool(b, ProxyOptions{WriteBufferPool: NewWriteBufferPool()})
+}
+
+func TestDialBackendLogging(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	logger := &testLogger{}
+	options := ProxyOptions{
+		DialBackend: func(ctx context.Context, network, address string) (net.Conn, error) {
+			time.Sleep(10 * time.Millisecond)
+			if address == "unreachable:1" {
+				return nil, errors.New("connection refused")
+			}
+			return net.Dial(network, backend.Addr().String())
+		},
+	}
+
+	h := newHandler(logger, "backend.example.com:22", DefaultStreamHandler, options)
+	h.ServeHTTP(httptest.NewRecorder(), testRequest(t, "http://localhost/", nil))
+	h = newHandler(logger, "unreachable:1", DefaultStreamHandler, options)
+	h.ServeHTTP(httptest.NewRecorder(), testRequest(t, "http://localhost/", nil))
+
+	lines := logger.Lines()
+	success := regexp.MustCompile(`^Dialed backend backend\.example\.com:22 \(resolved ([^)]+)\) in (\S+)$`)
+	failure := regexp.MustCompile(`^Dial to backend unreachable:1 failed after (\S+): connection refused$`)
+	var successLine, failureLine []string
+	for _, line := range lines {
+		if m := success.FindStringSubmatch(line); m != nil {
+			successLine = m
+		}
+		if m := failure.FindStringSubmatch(line); m != nil {
+			failureLine = m
+		}
+	}
+	if assert.NotNil(t, successLine, "lines: %v", lines) {
+		assert.Equal(t, backend.Addr().String(), successLine[1])
+		duration, err := time.ParseDuration(successLine[2])
+		assert.NoError(t, err)
+		assert.True(t, duration >= 10*time.Millisecond)
+	}
+	if assert.NotNil(t, failureLine, "lines: %v", lines) {
+		_, err := time.ParseDuration(failureLine[1])
+		assert.NoError(t, err)
+	}
+}
+
+func TestCloseGracePeriod(t *testing.T) {
+	// The backend hangs up straight away, so the proxy closes the websocket
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		if conn, err := backend.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	const gracePeriod = 200 * time.Millisecond
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{CloseGracePeriod: gracePeriod})
+	conn := dialTestProxy(t, addr, nil)
+	// Ignore the close frame rather than acknowledging it
+	conn.SetCloseHandler(func(int, string) error { return nil })
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gws.IsCloseError(err, gws.CloseNormalClosure), "unexpected error: %v", err)
+	closeReceived := time.Now()
+
+	conn.UnderlyingConn().SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.UnderlyingConn().Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "proxy should close the socket")
+	elapsed := time.Since(closeReceived)
+	assert.True(t, elapsed >= gracePeriod*3/4, "socket closed after %s", elapsed)
+	assert.True(t, elapsed < 2*time.Second, "socket closed after %s", elapsed)
+}
+
+func TestCustomUpgrader(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	var handshakeErr error
+	upgrader := &gws.Upgrader{
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			handshakeErr = reason
+			w.WriteHeader(status)
+		},
+	}
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	h := newHandler(logger, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+		Upgrader:       upgrader,
+		ReadBufferSize: 4096,
+	})
+	assert.Equal(t, 4096, h.upgrader.ReadBufferSize)
+
+	req := testRequest(t, "http://localhost/", nil)
+	req.Header.Set("Sec-Websocket-Version", "12")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Error(t, handshakeErr)
+}
+
+func TestCheckOriginOverride(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+
+	var originErr error
+	upgrader := &gws.Upgrader{
+		CheckOrigin: func(*http.Request) bool { return true },
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			originErr = reason
+			w.WriteHeader(status)
+		},
+	}
+	logger := logger.NewOutputWriter(logger.NewMockWriteManager())
+	h := newHandler(logger, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{
+		Upgrader:    upgrader,
+		CheckOrigin: func(r *http.Request) bool { return r.Header.Get("Origin") == "https://allowed.example.com" },
+	})
+
+	req := testRequest(t, "http://localhost/", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Error(t, originErr)
+}
+
+// bufferedConn is a net.Conn whose writes are buffered until flushed.
+type bufferedConn struct {
+	net.Conn
+	w *bufio.Writer
+}
+
+func (c *bufferedConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *bufferedConn) Flush() error {
+	return c.w.Flush()
+}
+
+func TestSendSSHPreambleFlushes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- SendSSHPreamble(&bufferedConn{Conn: client, w: bufio.NewWriter(client)}, "ssh.example.com:22", "token")
+	}()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	size := make([]byte, sshserver.SSHPreambleLength)
+	_, err := io.ReadFull(server, size)
+	assert.NoError(t, err)
+	payload := make([]byte, binary.BigEndian.Uint16(size))
+	_, err = io.ReadFull(server, payload)
+	assert.NoError(t, err)
+	assert.NoError(t, <-errC)
+
+	var preamble sshserver.SSHPreamble
+	assert.NoError(t, json.Unmarshal(payload, &preamble))
+	assert.Equal(t, "ssh.example.com:22", preamble.Destination)
+	assert.Equal(t, "token", preamble.JWT)
+}
+
+func TestSendVersionedSSHPreamble(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- SendVersionedSSHPreamble(&bufferedConn{Conn: client, w: bufio.NewWriter(client)}, "ssh.example.com:22", "token")
+	}()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	preamble, err := sshserver.ReadSSHPreamble(server)
+	require.NoError(t, err)
+	assert.NoError(t, <-errC)
+	assert.Equal(t, "ssh.example.com:22", preamble.Destination)
+	assert.Equal(t, "token", preamble.JWT)
+}
+
 // func TestStartProxyServer(t *testing.T) {
 // 	var wg sync.WaitGroup
 // 	remoteAddress := "localhost:1113"
@@ -138,3 +860,442 @@ func TestServe(t *testing.T) {
 // 	assert.NoError(t, err)
 // 	wg.Wait()
 // }
+
+func TestHealthCheckPath(t *testing.T) {
+	var dials int32
+	options := ProxyOptions{
+		HealthCheckPath: "/healthz",
+		DialBackend: func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return nil, errors.New("backend unavailable")
+		},
+	}
+	h := newHandler(&testLogger{}, "localhost:1", DefaultStreamHandler, options)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, testRequest(t, "http://example.com/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials))
+
+	// Other paths are proxied as usual
+	h.ServeHTTP(httptest.NewRecorder(), testRequest(t, "http://example.com/", nil))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+
+	// The health check is disabled by default
+	options.HealthCheckPath = ""
+	h = newHandler(&testLogger{}, "localhost:1", DefaultStreamHandler, options)
+	h.ServeHTTP(httptest.NewRecorder(), testRequest(t, "http://example.com/healthz", nil))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dials))
+}
+
+func TestPeerCertificates(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	helloCert, err := tlsconfig.GetHelloCertificate()
+	assert.NoError(t, err)
+	clientTLSConfig := websocketClientTLSConfig(t)
+	clientTLSConfig.Certificates = []tls.Certificate{helloCert}
+
+	for _, useTLS := range []bool{false, true} {
+		subjectC := make(chan string, 1)
+		streamHandler := func(wsConn *Conn, remoteConn net.Conn, requestHeaders http.Header) {
+			if certs := wsConn.PeerCertificates(); len(certs) > 0 {
+				subjectC <- certs[0].Subject.CommonName
+			} else {
+				subjectC <- ""
+			}
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		scheme := "ws"
+		if useTLS {
+			scheme = "wss"
+			listener = tls.NewListener(listener, &tls.Config{
+				Certificates: []tls.Certificate{helloCert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    clientTLSConfig.RootCAs,
+			})
+		}
+		shutdownC := make(chan struct{})
+		go StartProxyServerWithOptions(&testLogger{}, listener, backend.Addr().String(), shutdownC, streamHandler, ProxyOptions{})
+
+		dialer := gws.Dialer{TLSClientConfig: clientTLSConfig}
+		conn, _, err := dialer.Dial(fmt.Sprintf("%s://%s/", scheme, listener.Addr()), nil)
+		if assert.NoError(t, err) {
+			subject := <-subjectC
+			if useTLS {
+				assert.Equal(t, "Argo Tunnel Sample Hello Server Certificate", subject)
+			} else {
+				assert.Empty(t, subject)
+			}
+			conn.Close()
+		}
+		close(shutdownC)
+	}
+}
+
+func TestHijackConnectionPipelinedData(t *testing.T) {
+	backend, receivedC := recordingBackend(t)
+	defer backend.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := HijackConnection(w)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		backendConn, err := net.Dial("tcp", backend.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer backendConn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(backendConn, conn)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	assert.NoError(t, err)
+	// Send the request and data together, so the server buffers the data with the request
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\npipelined data")
+	assert.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	conn.Close()
+
+	select {
+	case received := <-receivedC:
+		assert.Equal(t, "pipelined data", string(received))
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend did not receive the data")
+	}
+}
+
+func TestStartProxyServerShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	shutdownC := make(chan struct{})
+	errC := make(chan error, 1)
+	go func() {
+		errC <- StartProxyServer(&testLogger{}, listener, "", shutdownC, DefaultStreamHandler)
+	}()
+
+	close(shutdownC)
+	select {
+	case err := <-errC:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy server didn't stop")
+	}
+}
+
+func TestStartProxyServerListenerFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	listener.Close()
+
+	shutdownC := make(chan struct{})
+	defer close(shutdownC)
+	err = StartProxyServer(&testLogger{}, listener, "", shutdownC, DefaultStreamHandler)
+	var opErr *net.OpError
+	if assert.True(t, errors.As(err, &opErr), err) {
+		assert.Equal(t, "accept", opErr.Op)
+	}
+}
+
+func TestBackendDialTimeout(t *testing.T) {
+	options := ProxyOptions{
+		BackendDialTimeout: 50 * time.Millisecond,
+		DialBackend: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// A backend that never accepts the connection
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	log := &testLogger{}
+	h := newHandler(log, "backend.example.com:22", DefaultStreamHandler, options)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, testRequest(t, "http://localhost/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, defaultBackendDialTimeout, newHandler(log, "", nil, ProxyOptions{}).options.BackendDialTimeout)
+}
+
+func TestBackendDialRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	// Nothing listens on the port once the listener is closed
+	closedPort := listener.Addr().String()
+	listener.Close()
+	h := newHandler(&testLogger{}, closedPort, DefaultStreamHandler, ProxyOptions{})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, testRequest(t, "http://localhost/", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
+
+func TestHandshakeReadTimeout(t *testing.T) {
+	backend := echoBackend(t)
+	defer backend.Close()
+	timeout := 100 * time.Millisecond
+	addr := startTestProxy(t, backend.Addr().String(), DefaultStreamHandler, ProxyOptions{HandshakeReadTimeout: timeout, CloseGracePeriod: 10 * time.Millisecond})
+
+	// A client that stalls part way through its handshake is disconnected
+	var stalled net.Conn
+	require.Eventually(t, func() bool {
+		var err error
+		stalled, err = net.Dial("tcp", addr)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	defer stalled.Close()
+	start := time.Now()
+	_, err := stalled.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n"))
+	require.NoError(t, err)
+	stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ioutil.ReadAll(stalled)
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "the server did not give up on the handshake")
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(timeout))
+
+	// The deadline doesn't apply once the handshake is complete
+	conn := dialTestProxy(t, addr, nil)
+	time.Sleep(2 * timeout)
+	require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("after the timeout")))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after the timeout", string(message))
+}
+
+func TestClientConnectTrailers(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Denial-Reason")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("denied"))
+		w.Header().Set("X-Denial-Reason", "token expired")
+	}))
+	defer origin.Close()
+
+	req := testRequest(t, origin.URL, nil)
+	conn, resp, err := ClientConnect(req, nil)
+	assert.Nil(t, conn)
+	assert.Equal(t, gws.ErrBadHandshake, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "token expired", resp.Trailer.Get("X-Denial-Reason"))
+}
+
+func TestInitialBackendPayload(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	receivedC := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		received := make([]byte, len("preamble")+len("hello"))
+		io.ReadFull(conn, received)
+		receivedC <- received
+	}()
+	addr := startTestProxy(t, listener.Addr().String(), DefaultStreamHandler, ProxyOptions{InitialBackendPayload: []byte("preamble"), CloseGracePeriod: 10 * time.Millisecond})
+
+	conn := dialTestProxy(t, addr, nil)
+	require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte("hello")))
+	select {
+	case received := <-receivedC:
+		assert.Equal(t, "preamblehello", string(received))
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend didn't receive the payload")
+	}
+}
+
+func TestWriteAfterCloseIsQuiet(t *testing.T) {
+	server, _ := websocketPair(t)
+	log := &testLogger{}
+	require.NoError(t, server.WriteControl(gws.CloseMessage, gws.FormatCloseMessage(gws.CloseNormalClosure, ""), time.Now().Add(time.Second)))
+
+	// Writes after the close frame end the copy cleanly
+	n, err := (&Conn{Conn: server}).ReadFrom(strings.NewReader("after close"))
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	// and stop the pinger without logging
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		pinger(log, server, "test", done, time.Millisecond)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		close(done)
+		t.Fatal("pinger kept running after the close frame was sent")
+	}
+	assert.Empty(t, log.Lines())
+}
+
+func TestWriteAfterConnClosedIsQuiet(t *testing.T) {
+	server, _ := websocketPair(t)
+	// Closing the socket rather than sending a close frame makes the frame's flush fail
+	// instead of NextWriter
+	require.NoError(t, server.UnderlyingConn().Close())
+
+	n, err := (&Conn{Conn: server}).ReadFrom(strings.NewReader("after close"))
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestKeepAliveStopAfterClose(t *testing.T) {
+	server, _ := websocketPair(t)
+	h := newHandler(&testLogger{}, "", DefaultStreamHandler, ProxyOptions{PongWait: 10 * time.Millisecond})
+	keepAlive := h.startKeepAlive(&testLogger{}, server, "test")
+	require.NoError(t, server.WriteControl(gws.CloseMessage, gws.FormatCloseMessage(gws.CloseNormalClosure, ""), time.Now().Add(time.Second)))
+	// Give the pinger time to fail a ping on the closed connection and return by itself
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		keepAlive.stop()
+		keepAlive.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopping the keep alive blocked after the pinger returned")
+	}
+}
+
+func TestPingFailureLogsConnection(t *testing.T) {
+	server, client := websocketPair(t)
+	log := &testLogger{}
+	// Pings to a client that has gone away fail once the connection is reset
+	client.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go pinger(log, server, "2f1e7c", done, time.Millisecond)
+	require.Eventually(t, func() bool { return len(log.Lines()) > 0 }, 5*time.Second, time.Millisecond)
+	line := log.Lines()[0]
+	assert.Contains(t, line, "failed to send ping message on connection 2f1e7c")
+	assert.Contains(t, line, server.RemoteAddr().String())
+}
+
+// trackingConn counts the reads and writes in progress on a connection.
+type trackingConn struct {
+	net.Conn
+	active int32
+}
+
+func (c *trackingConn) Read(p []byte) (int, error) {
+	atomic.AddInt32(&c.active, 1)
+	defer atomic.AddInt32(&c.active, -1)
+	return c.Conn.Read(p)
+}
+
+func (c *trackingConn) Write(p []byte) (int, error) {
+	atomic.AddInt32(&c.active, 1)
+	defer atomic.AddInt32(&c.active, -1)
+	return c.Conn.Write(p)
+}
+
+func TestStreamWait(t *testing.T) {
+	client, conn := net.Pipe()
+	backend, backendConn := net.Pipe()
+	defer backend.Close()
+	trackedConn := &trackingConn{Conn: conn}
+	trackedBackendConn := &trackingConn{Conn: backendConn}
+
+	done := make(chan struct{})
+	go func() {
+		StreamWait(trackedConn, trackedBackendConn)
+		// Neither copy is still reading or writing once StreamWait returns
+		assert.Zero(t, atomic.LoadInt32(&trackedConn.active))
+		assert.Zero(t, atomic.LoadInt32(&trackedBackendConn.active))
+		close(done)
+	}()
+
+	// The client going away finishes one direction, while the other is blocked reading
+	// from the backend
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StreamWait didn't return")
+	}
+
+	// The backend connection was left open, with no deadline
+	go backendConn.Write([]byte("still open"))
+	buf := make([]byte, 10)
+	_, err := io.ReadFull(backend, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "still open", string(buf))
+}
+
+func TestMaxClientFrameSize(t *testing.T) {
+	const maxFrameSize = 1000
+	payload := make([]byte, 10*maxFrameSize+1)
+	rand.Read(payload)
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(payload)
+				time.Sleep(time.Second)
+			}()
+		}
+	}()
+	// Write sends the backend's data in one call, rather than streaming it
+	writeAll := func(wsConn *Conn, remoteConn net.Conn, _ http.Header) {
+		received := make([]byte, len(payload))
+		if _, err := io.ReadFull(remoteConn, received); err != nil {
+			return
+		}
+		wsConn.Write(received)
+		time.Sleep(time.Second)
+	}
+
+	tests := []struct {
+		name          string
+		streamHandler func(*Conn, net.Conn, http.Header)
+		options       ProxyOptions
+	}{
+		{name: "streaming", streamHandler: DefaultStreamHandler},
+		{name: "coalescing", streamHandler: DefaultStreamHandler, options: ProxyOptions{CoalesceDelay: 10 * time.Millisecond, CoalesceSize: 4 * len(payload)}},
+		{name: "write", streamHandler: writeAll},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// A write buffer larger than the frames keeps gorilla from fragmenting them
+			test.options.WriteBufferSize = 4 * maxFrameSize
+			test.options.MaxClientFrameSize = maxFrameSize
+			addr := startTestProxy(t, backend.Addr().String(), test.streamHandler, test.options)
+			conn, r := dialRawWebsocket(t, addr, nil)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			var received []byte
+			for len(received) < len(payload) {
+				b0, frame, err := readRawFrame(r)
+				require.NoError(t, err)
+				assert.Equal(t, byte(0x80|gws.BinaryMessage), b0)
+				assert.LessOrEqual(t, len(frame), maxFrameSize)
+				received = append(received, frame...)
+			}
+			assert.Equal(t, payload, received)
+		})
+	}
+}